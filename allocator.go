@@ -0,0 +1,190 @@
+package gobuddyfs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	mathrand "math/rand"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// BlockGenerator allocates the ids of new blocks.
+type BlockGenerator interface {
+	NewBlock(ctx context.Context) (StorageUnit, error)
+	NewNamedBlock(ctx context.Context, name string) (Block, error)
+}
+
+// Allocators a volume can be created with.
+const (
+	AllocRandom  = ""
+	AllocCounter = "counter"
+)
+
+// Number of ids a CounterBlockGenerator reserves at a time.
+const counterBatch = 1024
+
+// Number of random ids tried before giving up on finding an unused one.
+const randomAttempts = 8
+
+var errNoCounter = errors.New("volume has no id counter")
+
+// RandomizedBlockGenerator allocates ids from crypto/rand. Unless Store is nil,
+// an id is only handed out if no block is stored under it yet.
+type RandomizedBlockGenerator struct {
+	Store KVStore
+
+	// Implements: BlockGenerator
+}
+
+var _ BlockGenerator = new(RandomizedBlockGenerator)
+
+func (r *RandomizedBlockGenerator) newId(ctx context.Context) (int64, error) {
+	var b [8]byte
+	for attempt := 0; attempt < randomAttempts; attempt++ {
+		if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+			return 0, err
+		}
+		id := int64(binary.LittleEndian.Uint64(b[:]) >> 1)
+		if id == 0 {
+			continue
+		}
+		if r.Store == nil {
+			return id, nil
+		}
+
+		_, err := kvGet(ctx, r.Store, blockKey(r.Store, id), false)
+		if err == ErrNotFound {
+			return id, nil
+		} else if err != nil {
+			return 0, err
+		}
+		glog.Warningf("Block id %d is already in use", id)
+	}
+	return 0, errors.New("no unused block id found")
+}
+
+func (r *RandomizedBlockGenerator) NewBlock(ctx context.Context) (StorageUnit, error) {
+	id, err := r.newId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Block{Id: id}, nil
+}
+
+func (r *RandomizedBlockGenerator) NewNamedBlock(ctx context.Context, name string) (Block, error) {
+	id, err := r.newId(ctx)
+	return Block{Id: id, Name: name}, err
+}
+
+// CounterBlockGenerator allocates ids in increasing order from a counter kept
+// in the volume's superblock. Ranges of ids are reserved with compare-and-set,
+// so mounts sharing the volume never hand out the same id; ids reserved by a
+// mount which goes away are skipped.
+type CounterBlockGenerator struct {
+	store KVStore
+	lock  sync.Mutex
+	next  int64
+	limit int64
+
+	// Implements: BlockGenerator
+}
+
+var _ BlockGenerator = new(CounterBlockGenerator)
+
+// reserve takes the next range of ids from the superblock.
+func (c *CounterBlockGenerator) reserve(ctx context.Context) error {
+	key := rootBlockKey(c.store)
+	for {
+		value, err := kvGet(ctx, c.store, key, true)
+		if err != nil {
+			return err
+		}
+		sb, err := decodeSuperblock(value)
+		if err != nil {
+			return err
+		} else if sb.NextId <= 0 {
+			return errNoCounter
+		}
+
+		next := sb.NextId
+		sb.NextId += counterBatch
+		encoded, err := sb.encode()
+		if err != nil {
+			return err
+		}
+
+		err = kvCompareAndSet(ctx, c.store, key, value, encoded)
+		if err == nil {
+			c.next, c.limit = next, sb.NextId
+			return nil
+		} else if err != ErrConflict {
+			return err
+		}
+	}
+}
+
+func (c *CounterBlockGenerator) newId(ctx context.Context) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.next == c.limit {
+		if err := c.reserve(ctx); err != nil {
+			return 0, err
+		}
+	}
+	id := c.next
+	c.next++
+	return id, nil
+}
+
+func (c *CounterBlockGenerator) NewBlock(ctx context.Context) (StorageUnit, error) {
+	id, err := c.newId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Block{Id: id}, nil
+}
+
+func (c *CounterBlockGenerator) NewNamedBlock(ctx context.Context, name string) (Block, error) {
+	id, err := c.newId(ctx)
+	return Block{Id: id, Name: name}, err
+}
+
+// SeededBlockGenerator allocates ids from a pseudo-random sequence, the same
+// for every generator with the same seed, so that tests can predict them.
+// Ids are not checked against the store.
+type SeededBlockGenerator struct {
+	lock sync.Mutex
+	rand *mathrand.Rand
+
+	// Implements: BlockGenerator
+}
+
+var _ BlockGenerator = new(SeededBlockGenerator)
+
+func NewSeededBlockGenerator(seed int64) *SeededBlockGenerator {
+	return &SeededBlockGenerator{rand: mathrand.New(mathrand.NewSource(seed))}
+}
+
+func (s *SeededBlockGenerator) newId() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for {
+		if id := s.rand.Int63(); id != 0 {
+			return id
+		}
+	}
+}
+
+func (s *SeededBlockGenerator) NewBlock(ctx context.Context) (StorageUnit, error) {
+	return &Block{Id: s.newId()}, nil
+}
+
+func (s *SeededBlockGenerator) NewNamedBlock(ctx context.Context, name string) (Block, error) {
+	return Block{Id: s.newId(), Name: name}, nil
+}
@@ -0,0 +1,91 @@
+package gobuddyfs_test
+
+import (
+	"strconv"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func createFiles(t *testing.T, root fs.Node, prefix string, count int) []int64 {
+	var ids []int64
+	for i := 0; i < count; i++ {
+		node, _, err := root.(*gobuddyfs.FSMeta).Create(context.TODO(),
+			&fuse.CreateRequest{Name: prefix + strconv.Itoa(i)}, nil)
+		assert.NoError(t, err)
+		ids = append(ids, node.(*gobuddyfs.File).Id)
+	}
+	return ids
+}
+
+func TestCounterAllocator(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	bfs := gobuddyfs.NewBuddyFS(memkv)
+	bfs.Allocator = gobuddyfs.AllocCounter
+	root1, err := bfs.Root()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, root1.(*gobuddyfs.FSMeta).Id)
+
+	// A second mount reserves its own range, and keeps the volume's allocator.
+	root2, err := gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+
+	ids := createFiles(t, root1, "a", 1500)
+	ids = append(ids, createFiles(t, root2, "b", 10)...)
+	seen := map[int64]bool{1: true}
+	for i, id := range ids {
+		assert.False(t, seen[id], "id %d handed out twice", id)
+		seen[id] = true
+		assert.True(t, id > 1 && id < 4096, "id %d", id)
+		if i > 0 && i < 1500 {
+			assert.True(t, id > ids[i-1])
+		}
+	}
+}
+
+func TestSeededAllocator(t *testing.T) {
+	keys := func() []string {
+		memkv := gobuddyfs.NewMemStore()
+		bfs := gobuddyfs.NewBuddyFS(memkv)
+		bfs.BlockGenerator = gobuddyfs.NewSeededBlockGenerator(42)
+		root, err := bfs.Root()
+		assert.NoError(t, err)
+		createFiles(t, root, "f", 3)
+
+		var keys []string
+		assert.NoError(t, memkv.Scan("", "", func(key string, value []byte) bool {
+			keys = append(keys, key)
+			return true
+		}))
+		return keys
+	}
+
+	first := keys()
+	assert.Len(t, first, 5)
+	assert.Equal(t, first, keys())
+}
+
+// usedStore has a value under every key.
+type usedStore struct {
+	gobuddyfs.KVStore
+}
+
+func (usedStore) Get(key string, retry bool) ([]byte, error) {
+	return []byte{}, nil
+}
+
+func TestRandomAllocatorChecksIds(t *testing.T) {
+	gen := &gobuddyfs.RandomizedBlockGenerator{Store: usedStore{}}
+	_, err := gen.NewBlock(context.TODO())
+	assert.Error(t, err)
+
+	gen = &gobuddyfs.RandomizedBlockGenerator{Store: gobuddyfs.NewMemStore()}
+	blk, err := gen.NewBlock(context.TODO())
+	assert.NoError(t, err)
+	assert.True(t, blk.GetId() > 0)
+}
@@ -1,13 +1,14 @@
 package gobuddyfs
 
 import (
-	"encoding/binary"
+	"crypto/hmac"
 	"encoding/json"
 	"sync"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/golang/glog"
+	"golang.org/x/net/context"
 )
 
 const BLOCK_SIZE = 4096
@@ -27,6 +28,33 @@ type BuddyFS struct {
 	blkGen BlockGenerator
 	FSM    *FSMeta
 
+	// Compression is used for the blocks of a newly created volume.
+	// Existing volumes keep the compression they were created with.
+	Compression string
+	// HashKeys makes a newly created volume store its blocks under keys
+	// derived from KeyMaterial. Existing volumes keep the keys they were
+	// created with. Volumes of different key material can share a store; if
+	// none of them is for KeyMaterial, a new one is only created with
+	// HashKeys set.
+	HashKeys bool
+	// KeyMaterial is the secret, held by the user, from which the keys of a
+	// volume with hashed keys are derived, such as EncryptedKVStore.KeyMaterial
+	// returns. It is needed to create or open such a volume.
+	KeyMaterial []byte
+	// Dedup makes a newly created volume store data blocks under a hash of
+	// their contents, so that identical blocks are stored once. Given
+	// KeyMaterial, it needs HashKeys, so that the hashes are keyed.
+	Dedup bool
+	// Chunking makes a newly created volume split files into chunks at
+	// points chosen by their contents, rather than into fixed-size blocks.
+	Chunking bool
+	// Allocator chooses how a newly created volume allocates block ids.
+	// Existing volumes keep the allocator they were created with.
+	Allocator string
+	// BlockGenerator, if set, allocates block ids in place of the volume's
+	// allocator, such as a SeededBlockGenerator in tests.
+	BlockGenerator BlockGenerator
+
 	fs.FS
 }
 
@@ -43,14 +71,17 @@ func (fsm *FSMeta) Unmarshal(data []byte) error {
 }
 
 func NewBuddyFS(store KVStore) *BuddyFS {
-	bfs := &BuddyFS{Store: store, Lock: sync.Mutex{},
-		blkGen: new(RandomizedBlockGenerator)}
+	bfs := &BuddyFS{Store: store, Lock: sync.Mutex{}}
 	return bfs
 }
 
-func (bfs BuddyFS) CreateNewFSMetadata() *FSMeta {
-	return &FSMeta{Dir: Dir{Block: bfs.blkGen.NewNamedBlock("/"),
-		blkGen: bfs.blkGen, Dirs: []Block{}, Files: []Block{}, Lock: sync.RWMutex{}}}
+func (bfs *BuddyFS) CreateNewFSMetadata(ctx context.Context) (*FSMeta, error) {
+	blk, err := bfs.blkGen.NewNamedBlock(ctx, "/")
+	if err != nil {
+		return nil, err
+	}
+	return &FSMeta{Dir: Dir{Block: blk, blkGen: bfs.blkGen, Dirs: []Block{},
+		Files: []Block{}, Lock: sync.RWMutex{}}}, nil
 }
 
 func (bfs *BuddyFS) Root() (fs.Node, error) {
@@ -58,51 +89,175 @@ func (bfs *BuddyFS) Root() (fs.Node, error) {
 	defer bfs.Lock.Unlock()
 
 	if bfs.FSM == nil {
-		rootKey, err := bfs.Store.Get(ROOT_BLOCK_KEY, true)
+		// The kernel does not hand Root a request context.
+		ctx := context.Background()
+		rootKey, err := kvGet(ctx, bfs.Store, ROOT_BLOCK_KEY, true)
+		if err == ErrNotFound {
+			// Either a new volume, or one with hashed keys.
+			var hashed bool
+			if hashed, err = bfs.openVolume(ctx); err == nil && hashed {
+				rootKey, err = kvGet(ctx, bfs.Store, rootBlockKey(bfs.Store), true)
+			} else if err == nil {
+				err = ErrNotFound
+			}
+		}
+
+		if err == ErrNotFound && bfs.Dedup && bfs.KeyMaterial != nil && !bfs.HashKeys {
+			glog.Errorf("Error while creating root node: %q", ErrDedupKeys)
+			return nil, fuseError(ErrDedupKeys)
+		}
 
-		if rootKey == nil {
+		if err == ErrNotFound {
 			glog.Infoln("Creating new root block")
 			// Root key not found
-			root := bfs.CreateNewFSMetadata()
-			root.MarkDirty()
-			err = root.WriteBlock(root, bfs.Store)
+			sb := &superblock{Compression: bfs.Compression, Dedup: bfs.Dedup,
+				Chunking: bfs.Chunking, version: superblockVersion}
+			if bfs.Allocator == AllocCounter {
+				// The superblock which creates the volume reserves its first ids.
+				sb.NextId = 1 + counterBatch
+			}
+			bfs.useVolume(sb)
+			if gen, ok := bfs.blkGen.(*CounterBlockGenerator); ok {
+				gen.next, gen.limit = 1, sb.NextId
+			}
+
+			var root *FSMeta
+			if root, err = bfs.CreateNewFSMetadata(ctx); err == nil {
+				root.MarkDirty()
+				err = root.WriteBlock(ctx, root, bfs.Store)
+			}
 			if err == nil {
-				buffer := make([]byte, 80)
-				binary.PutVarint(buffer, root.Block.Id)
-				err = bfs.Store.Set(ROOT_BLOCK_KEY, buffer)
+				sb.Root = root.Block.Id
+				var buffer []byte
+				if buffer, err = sb.encode(); err == nil {
+					err = kvCompareAndSet(ctx, bfs.Store, rootBlockKey(bfs.Store), nil, buffer)
+				}
 				if err == nil {
 					bfs.FSM = root
 					bfs.FSM.KVS = bfs.Store
+					bfs.FSM.nodes = newNodeTable()
 					return bfs.FSM, nil
+				} else if err == ErrConflict {
+					// Another mount created the filesystem first; use theirs.
+					glog.Infoln("Root block created concurrently, reading it")
+					root.Delete(ctx, bfs.Store)
+					rootKey, err = kvGet(ctx, bfs.Store, rootBlockKey(bfs.Store), true)
 				} else {
 					glog.Errorf("Error while creating ROOT key: %q", err)
-					return nil, fuse.EIO
+					return nil, fuseError(err)
 				}
 			} else {
 				glog.Errorf("Error while creating root node: %q", err)
-				return nil, fuse.EIO
+				return nil, fuseError(err)
 			}
 		}
 
-		var root FSMeta
-		var n int
-		root.Block.Id, n = binary.Varint(rootKey)
-		if n <= 0 {
-			glog.Errorf("Error while decoding root key")
+		if err != nil {
+			// Never mistake a failing store for an empty one.
+			glog.Errorf("Error while reading ROOT key: %q", err)
+			return nil, fuseError(err)
+		}
+
+		sb, err := decodeSuperblock(rootKey)
+		if err != nil {
+			glog.Errorf("Error while decoding root key: %q", err)
 			return nil, fuse.EIO
 		}
+		bfs.useVolume(sb)
 
-		err = root.ReadBlock(&root, bfs.Store)
+		var root FSMeta
+		root.Block.Id = sb.Root
+
+		err = root.ReadBlock(ctx, &root, bfs.Store)
 		if err != nil {
 			glog.Errorf("Error while read root block: %q", err)
-			return nil, fuse.EIO
+			return nil, fuseError(err)
 		}
 
 		bfs.FSM = &root
 		bfs.FSM.KVS = bfs.Store
-		bfs.FSM.blkGen = new(RandomizedBlockGenerator)
+		bfs.FSM.blkGen = bfs.blkGen
+		bfs.FSM.nodes = newNodeTable()
 		return bfs.FSM, nil
 	}
 
 	return bfs.FSM, nil
 }
+
+// openVolume checks for a volume with keys hashed with the secret of
+// KeyMaterial, creating one if HashKeys is set, and switches to the volume's
+// keys if there is one. It returns whether the volume's keys are hashed.
+func (bfs *BuddyFS) openVolume(ctx context.Context) (bool, error) {
+	var vs *volumeStore
+	if bfs.KeyMaterial != nil {
+		secret, err := volumeSecret(bfs.KeyMaterial)
+		if err != nil {
+			return false, err
+		}
+		vs = &volumeStore{store: bfs.Store, secret: secret}
+	}
+
+	marked, err := kvGet(ctx, bfs.Store, VOLUME_KEYS_KEY, true)
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+	hasHashed := err == nil
+	if vs == nil {
+		if hasHashed || bfs.HashKeys {
+			return false, ErrNoKeyMaterial
+		}
+		return false, nil
+	}
+
+	markKey := vs.key(VOLUME_KEYS_KEY)
+	_, err = kvGet(ctx, bfs.Store, markKey, true)
+	if err == ErrNotFound && hasHashed && hmac.Equal(marked, []byte(markKey)) {
+		// An older volume, marked with a check value of its secret.
+		err = nil
+	} else if err == ErrNotFound && bfs.HashKeys {
+		glog.Infoln("Creating new volume with hashed keys")
+		err = kvCompareAndSet(ctx, bfs.Store, VOLUME_KEYS_KEY, nil, volumeMark)
+		if err == nil || err == ErrConflict {
+			err = kvCompareAndSet(ctx, bfs.Store, markKey, nil, volumeMark)
+		}
+		if err == ErrConflict {
+			// Another mount created the volume first.
+			err = nil
+		}
+	}
+
+	if err == ErrNotFound && hasHashed {
+		// The store's volumes with hashed keys all have other secrets.
+		return false, ErrWrongSecret
+	} else if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	bfs.Store = vs
+	return true, nil
+}
+
+// useVolume makes blocks follow the layout described by sb, and be allocated
+// as it says.
+func (bfs *BuddyFS) useVolume(sb *superblock) {
+	vs := &volumeStore{store: bfs.Store, sb: *sb}
+	if cur, ok := bfs.Store.(*volumeStore); ok {
+		vs.store, vs.secret = cur.store, cur.secret
+	}
+
+	if vs.secret == nil && sb.version == 0 {
+		// The original layout.
+		bfs.Store = vs.store
+	} else {
+		bfs.Store = vs
+	}
+
+	if bfs.BlockGenerator != nil {
+		bfs.blkGen = bfs.BlockGenerator
+	} else if sb.NextId > 0 {
+		bfs.blkGen = &CounterBlockGenerator{store: bfs.Store}
+	} else {
+		bfs.blkGen = &RandomizedBlockGenerator{Store: bfs.Store}
+	}
+}
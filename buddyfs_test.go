@@ -1,9 +1,17 @@
 package gobuddyfs_test
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"math/rand"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 
 	"bazil.org/fuse"
@@ -15,6 +23,11 @@ import (
 	"golang.org/x/net/context"
 )
 
+// lookup looks up name in the directory node.
+func lookup(node fs.Node, name string) (fs.Node, error) {
+	return node.(fs.NodeStringLookuper).Lookup(context.TODO(), name)
+}
+
 type MockKVStore struct {
 	mock.Mock
 	gobuddyfs.KVStore
@@ -35,32 +48,47 @@ func (m *MockKVStore) Set(key string, value []byte) error {
 	return args.Error(0)
 }
 
-// FIXME: Re-enable this test after fixing error passing semantics in Get()
-/*
 func TestRootGetNodeError(t *testing.T) {
 	mkv := new(MockKVStore)
 	bfs := gobuddyfs.NewBuddyFS(mkv)
-	mkv.On("Get", "ROOT").Return(nil, fmt.Errorf("Something bad")).Once()
+	mkv.On("Get", "ROOT", true).Return(nil, fmt.Errorf("Something bad")).Once()
 	node, err := bfs.Root()
 
-	assert.Error(t, err)
+	assert.Equal(t, fuse.EIO, err)
+	assert.Nil(t, node, "Error should return nil Root")
+
+	mkv.AssertExpectations(t)
+}
+
+func TestRootGetNodeTransientError(t *testing.T) {
+	mkv := new(MockKVStore)
+	bfs := gobuddyfs.NewBuddyFS(mkv)
+	mkv.On("Get", "ROOT", true).Return(nil, &gobuddyfs.StoreError{
+		Class: gobuddyfs.Transient, Op: "get", Key: "ROOT",
+		Err: fmt.Errorf("Peer unreachable")}).Once()
+	node, err := bfs.Root()
+
+	// Must not fall through to creating a fresh, empty filesystem.
+	assert.Equal(t, fuse.Errno(syscall.EAGAIN), err)
 	assert.Nil(t, node, "Error should return nil Root")
 
 	mkv.AssertExpectations(t)
 }
-*/
 
 func TestRootCreateSuccess(t *testing.T) {
 	mkv := new(MockKVStore)
 	bfs := gobuddyfs.NewBuddyFS(mkv)
-	mkv.On("Get", "ROOT", true).Return(nil, nil).Once()
+	mkv.On("Get", "ROOT", true).Return(nil, gobuddyfs.ErrNotFound).Once()
+	mkv.On("Get", "VOLUME_KEYS", true).Return(nil, gobuddyfs.ErrNotFound).Once()
+	// The root block's id is checked to be unused.
+	mkv.On("Get", mock.Anything, false).Return(nil, gobuddyfs.ErrNotFound).Once()
 	mkv.On("Set", mock.Anything, mock.Anything).Return(nil).Twice()
 	node, err := bfs.Root()
 
 	assert.NoError(t, err)
 	assert.NotNil(t, node, "Successfully created root should be non-nil")
 	attr := fuse.Attr{}
-	node.Attr(&attr)
+	node.Attr(context.TODO(), &attr)
 	assert.NotNil(t, attr)
 
 	mkv.AssertExpectations(t)
@@ -69,14 +97,17 @@ func TestRootCreateSuccess(t *testing.T) {
 func TestRootCreateAndReadRoot(t *testing.T) {
 	mkv := new(MockKVStore)
 	bfs := gobuddyfs.NewBuddyFS(mkv)
-	mkv.On("Get", "ROOT", true).Return(nil, nil).Once()
+	mkv.On("Get", "ROOT", true).Return(nil, gobuddyfs.ErrNotFound).Once()
+	mkv.On("Get", "VOLUME_KEYS", true).Return(nil, gobuddyfs.ErrNotFound).Once()
+	// The root block's id is checked to be unused.
+	mkv.On("Get", mock.Anything, false).Return(nil, gobuddyfs.ErrNotFound).Once()
 	mkv.On("Set", mock.Anything, mock.Anything).Return(nil).Twice()
 	node, err := bfs.Root()
 
 	assert.NoError(t, err)
 	assert.NotNil(t, node, "Successfully created root should be non-nil")
 	attr := fuse.Attr{}
-	node.Attr(&attr)
+	node.Attr(context.TODO(), &attr)
 	assert.NotNil(t, attr)
 
 	mkv.AssertExpectations(t)
@@ -92,7 +123,10 @@ func TestRootCreateAndReadRoot(t *testing.T) {
 func TestRootCreateWriteNodeFail(t *testing.T) {
 	mkv := new(MockKVStore)
 	bfs := gobuddyfs.NewBuddyFS(mkv)
-	mkv.On("Get", "ROOT", true).Return(nil, nil).Once()
+	mkv.On("Get", "ROOT", true).Return(nil, gobuddyfs.ErrNotFound).Once()
+	mkv.On("Get", "VOLUME_KEYS", true).Return(nil, gobuddyfs.ErrNotFound).Once()
+	// The root block's id is checked to be unused.
+	mkv.On("Get", mock.Anything, false).Return(nil, gobuddyfs.ErrNotFound).Once()
 	mkv.On("Set", mock.Anything, mock.Anything).Return(fmt.Errorf("Writing root node failed")).Once()
 	node, err := bfs.Root()
 
@@ -105,7 +139,10 @@ func TestRootCreateWriteNodeFail(t *testing.T) {
 func TestRootCreateWriteROOTKeyFail(t *testing.T) {
 	mkv := new(MockKVStore)
 	bfs := gobuddyfs.NewBuddyFS(mkv)
-	mkv.On("Get", "ROOT", true).Return(nil, nil).Once()
+	mkv.On("Get", "ROOT", true).Return(nil, gobuddyfs.ErrNotFound).Once()
+	mkv.On("Get", "VOLUME_KEYS", true).Return(nil, gobuddyfs.ErrNotFound).Once()
+	// The root block's id is checked to be unused.
+	mkv.On("Get", mock.Anything, false).Return(nil, gobuddyfs.ErrNotFound).Once()
 	mkv.On("Set", mock.Anything, mock.Anything).Return(nil).Once()
 	mkv.On("Set", mock.Anything, mock.Anything).Return(fmt.Errorf("Writing ROOT key failed")).Once()
 	node, err := bfs.Root()
@@ -166,7 +203,7 @@ func TestRootReadExistingRoot(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, node, "Successfully created root should be non-nil")
 	attr := fuse.Attr{}
-	node.Attr(&attr)
+	node.Attr(context.TODO(), &attr)
 	assert.NotNil(t, attr)
 
 	mkv.AssertExpectations(t)
@@ -189,7 +226,7 @@ func TestRootReReadExistingRoot(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, node, "Successfully created root should be non-nil")
 	attr := fuse.Attr{}
-	node.Attr(&attr)
+	node.Attr(context.TODO(), &attr)
 	assert.NotNil(t, attr)
 
 	node2, err2 := bfs.Root()
@@ -377,3 +414,562 @@ func TestParallelCreate(t *testing.T) {
 		}
 	}
 }
+
+func TestConcurrentMountsCreate(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+
+	root1, err := gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+	root2, err := gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+
+	// Both mounts append to the root directory they read at mount time.
+	_, _, err = root1.(*gobuddyfs.FSMeta).Create(context.TODO(), &fuse.CreateRequest{Name: "foo"}, nil)
+	assert.NoError(t, err)
+	_, err = root2.(*gobuddyfs.FSMeta).Mkdir(context.TODO(), &fuse.MkdirRequest{Name: "bar"})
+	assert.NoError(t, err)
+
+	// The second mount must have picked up the first mount's entry.
+	_, _, err = root2.(*gobuddyfs.FSMeta).Create(context.TODO(), &fuse.CreateRequest{Name: "foo"}, nil)
+	assert.Equal(t, fuse.Errno(syscall.EEXIST), err)
+
+	root3, err := gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+	dirEnts, err := root3.(*gobuddyfs.FSMeta).ReadDirAll(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []fuse.Dirent{{Name: "bar", Type: fuse.DT_Dir},
+		{Name: "foo", Type: fuse.DT_File}}, dirEnts)
+}
+
+func TestHashedKeys(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	bfs := gobuddyfs.NewBuddyFS(memkv)
+	bfs.HashKeys = true
+
+	// Hashed keys need key material.
+	_, err := bfs.Root()
+	assert.Error(t, err)
+
+	material := []byte("0123456789abcdef0123456789abcdef")
+	bfs.KeyMaterial = material
+	root, err := bfs.Root()
+	assert.NoError(t, err)
+	_, _, err = root.(*gobuddyfs.FSMeta).Create(context.TODO(), &fuse.CreateRequest{Name: "foo"}, nil)
+	assert.NoError(t, err)
+
+	// Neither the root nor any block id can be told from the keys.
+	_, err = memkv.Get("ROOT", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+	assert.NoError(t, memkv.Scan("", "", func(key string, value []byte) bool {
+		if key != gobuddyfs.VOLUME_KEYS_KEY {
+			assert.Len(t, key, 32)
+		} else {
+			// Nothing the keys can be derived from is stored.
+			assert.NotContains(t, string(value), string(material))
+		}
+		return true
+	}))
+
+	// Later mounts find the volume without being told, but only with the
+	// same key material.
+	_, err = gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.Error(t, err)
+	other := gobuddyfs.NewBuddyFS(memkv)
+	other.KeyMaterial = []byte("fedcba9876543210fedcba9876543210")
+	_, err = other.Root()
+	assert.Error(t, err)
+
+	later := gobuddyfs.NewBuddyFS(memkv)
+	later.KeyMaterial = material
+	root, err = later.Root()
+	assert.NoError(t, err)
+	dirEnts, err := root.(*gobuddyfs.FSMeta).ReadDirAll(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []fuse.Dirent{{Name: "foo", Type: fuse.DT_File}}, dirEnts)
+
+	// Other key material makes a volume of its own in the same store, which
+	// leaves the first one alone.
+	other.HashKeys = true
+	root, err = other.Root()
+	assert.NoError(t, err)
+	dirEnts, err = root.(*gobuddyfs.FSMeta).ReadDirAll(context.TODO())
+	assert.NoError(t, err)
+	assert.Empty(t, dirEnts)
+
+	later = gobuddyfs.NewBuddyFS(memkv)
+	later.KeyMaterial = material
+	root, err = later.Root()
+	assert.NoError(t, err)
+	dirEnts, err = root.(*gobuddyfs.FSMeta).ReadDirAll(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []fuse.Dirent{{Name: "foo", Type: fuse.DT_File}}, dirEnts)
+}
+
+func TestCompressedVolume(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	bfs := gobuddyfs.NewBuddyFS(memkv)
+	bfs.Compression = gobuddyfs.CompressFlate
+
+	root, err := bfs.Root()
+	assert.NoError(t, err)
+	node, _, err := root.(*gobuddyfs.FSMeta).Create(context.TODO(), &fuse.CreateRequest{Name: "foo"}, nil)
+	assert.NoError(t, err)
+	file := node.(*gobuddyfs.File)
+	data := bytes.Repeat([]byte("source code "), 1000)
+	for offset := 0; offset < len(data); {
+		res := &fuse.WriteResponse{}
+		assert.NoError(t, file.Write(context.TODO(),
+			&fuse.WriteRequest{Data: data[offset:], Offset: int64(offset)}, res))
+		offset += res.Size
+	}
+	assert.NoError(t, file.Flush(context.TODO(), &fuse.FlushRequest{}))
+
+	stored := 0
+	assert.NoError(t, memkv.Scan("", "", func(key string, value []byte) bool {
+		stored += len(value)
+		return true
+	}))
+	assert.True(t, stored < len(data)/4, "%d bytes stored", stored)
+
+	// Later mounts use the volume's compression whatever they are told.
+	root, err = gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+	node, err = lookup(root, "foo")
+	assert.NoError(t, err)
+	res := &fuse.ReadResponse{}
+	assert.NoError(t, node.(*gobuddyfs.File).Read(context.TODO(),
+		&fuse.ReadRequest{Offset: 5000, Size: 100}, res))
+	assert.Equal(t, data[5000:5100], res.Data)
+}
+
+func TestDedupVolume(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	bfs := gobuddyfs.NewBuddyFS(memkv)
+	bfs.Dedup = true
+
+	root, err := bfs.Root()
+	assert.NoError(t, err)
+	node, _, err := root.(*gobuddyfs.FSMeta).Create(context.TODO(), &fuse.CreateRequest{Name: "foo"}, nil)
+	assert.NoError(t, err)
+	file := node.(*gobuddyfs.File)
+
+	write := func(offset int, data []byte) {
+		for end := offset + len(data); offset < end; {
+			res := &fuse.WriteResponse{}
+			assert.NoError(t, file.Write(context.TODO(),
+				&fuse.WriteRequest{Data: data[:end-offset], Offset: int64(offset)}, res))
+			data = data[res.Size:]
+			offset += res.Size
+		}
+		assert.NoError(t, file.Flush(context.TODO(), &fuse.FlushRequest{}))
+	}
+
+	// The reference count of each stored data block.
+	refs := func() []uint64 {
+		var counts []uint64
+		assert.NoError(t, memkv.Scan("sha256:", "sha256;", func(key string, value []byte) bool {
+			n, _ := binary.Uvarint(value)
+			counts = append(counts, n)
+			return true
+		}))
+		return counts
+	}
+
+	data := bytes.Repeat([]byte{'a'}, 4*gobuddyfs.BLOCK_SIZE)
+	write(0, data)
+	assert.Equal(t, []uint64{4}, refs())
+
+	copy(data[gobuddyfs.BLOCK_SIZE:], bytes.Repeat([]byte{'b'}, gobuddyfs.BLOCK_SIZE))
+	write(gobuddyfs.BLOCK_SIZE, data[gobuddyfs.BLOCK_SIZE:2*gobuddyfs.BLOCK_SIZE])
+	assert.Len(t, refs(), 2)
+
+	assert.NoError(t, file.Setattr(context.TODO(),
+		&fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 2 * gobuddyfs.BLOCK_SIZE},
+		&fuse.SetattrResponse{}))
+	assert.Equal(t, []uint64{1, 1}, refs())
+
+	root, err = gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+	node, err = lookup(root, "foo")
+	assert.NoError(t, err)
+	for offset := 0; offset < 2*gobuddyfs.BLOCK_SIZE; offset += gobuddyfs.BLOCK_SIZE {
+		res := &fuse.ReadResponse{}
+		assert.NoError(t, node.(*gobuddyfs.File).Read(context.TODO(),
+			&fuse.ReadRequest{Offset: int64(offset), Size: gobuddyfs.BLOCK_SIZE}, res))
+		assert.Equal(t, data[offset:offset+gobuddyfs.BLOCK_SIZE], res.Data)
+	}
+}
+
+func TestDedupRemove(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	bfs := gobuddyfs.NewBuddyFS(memkv)
+	bfs.Dedup = true
+
+	root, err := bfs.Root()
+	assert.NoError(t, err)
+	dir := root.(*gobuddyfs.FSMeta)
+
+	data := bytes.Repeat([]byte{'a'}, 2*gobuddyfs.BLOCK_SIZE)
+	var files []*gobuddyfs.File
+	for _, name := range []string{"foo", "bar"} {
+		node, _, err := dir.Create(context.TODO(), &fuse.CreateRequest{Name: name}, nil)
+		assert.NoError(t, err)
+		file := node.(*gobuddyfs.File)
+		for offset := 0; offset < len(data); {
+			res := &fuse.WriteResponse{}
+			assert.NoError(t, file.Write(context.TODO(),
+				&fuse.WriteRequest{Data: data[offset:], Offset: int64(offset)}, res))
+			offset += res.Size
+		}
+		assert.NoError(t, file.Flush(context.TODO(), &fuse.FlushRequest{}))
+		files = append(files, file)
+	}
+
+	refs := func() []uint64 {
+		var counts []uint64
+		assert.NoError(t, memkv.Scan("sha256:", "sha256;", func(key string, value []byte) bool {
+			n, _ := binary.Uvarint(value)
+			counts = append(counts, n)
+			return true
+		}))
+		return counts
+	}
+	assert.Equal(t, []uint64{4}, refs())
+
+	assert.NoError(t, dir.Remove(context.TODO(), &fuse.RemoveRequest{Name: "foo"}))
+	assert.Equal(t, []uint64{2}, refs())
+
+	// A handle still open on a removed file doesn't release its blocks again.
+	assert.NoError(t, files[0].Flush(context.TODO(), &fuse.FlushRequest{}))
+	assert.Equal(t, []uint64{2}, refs())
+
+	assert.NoError(t, dir.Remove(context.TODO(), &fuse.RemoveRequest{Name: "bar"}))
+	assert.Empty(t, refs())
+}
+
+// ContendedKVStore loses every compare-and-set of a data block to some other
+// writer.
+type ContendedKVStore struct {
+	*gobuddyfs.MemStore
+	attempts int
+}
+
+func (s *ContendedKVStore) CompareAndSet(key string, expected, value []byte) error {
+	if strings.HasPrefix(key, "sha256:") {
+		s.attempts++
+		return gobuddyfs.ErrConflict
+	}
+	return s.MemStore.CompareAndSet(key, expected, value)
+}
+
+func TestDedupSharedBlock(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	bfs := gobuddyfs.NewBuddyFS(memkv)
+	bfs.Dedup = true
+
+	root, err := bfs.Root()
+	assert.NoError(t, err)
+	data := bytes.Repeat([]byte{'a'}, gobuddyfs.BLOCK_SIZE)
+	for _, name := range []string{"a", "b"} {
+		node, _, err := root.(*gobuddyfs.FSMeta).Create(context.TODO(), &fuse.CreateRequest{Name: name}, nil)
+		assert.NoError(t, err)
+		file := node.(*gobuddyfs.File)
+		assert.NoError(t, file.Write(context.TODO(), &fuse.WriteRequest{Data: data}, &fuse.WriteResponse{}))
+		assert.NoError(t, file.Flush(context.TODO(), &fuse.FlushRequest{}))
+	}
+
+	// A write to one file, even before it is flushed, leaves the block the
+	// other one shares with it alone.
+	root, err = gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+	node, err := lookup(root, "a")
+	assert.NoError(t, err)
+	a := node.(*gobuddyfs.File)
+	assert.NoError(t, a.Read(context.TODO(), &fuse.ReadRequest{Size: 4}, &fuse.ReadResponse{}))
+	assert.NoError(t, a.Write(context.TODO(), &fuse.WriteRequest{Data: []byte("bbbb")}, &fuse.WriteResponse{}))
+
+	node, err = lookup(root, "b")
+	assert.NoError(t, err)
+	res := &fuse.ReadResponse{}
+	assert.NoError(t, node.(*gobuddyfs.File).Read(context.TODO(),
+		&fuse.ReadRequest{Size: gobuddyfs.BLOCK_SIZE}, res))
+	assert.Equal(t, data, res.Data)
+}
+
+func TestDedupContention(t *testing.T) {
+	store := &ContendedKVStore{MemStore: gobuddyfs.NewMemStore()}
+	bfs := gobuddyfs.NewBuddyFS(store)
+	bfs.Dedup = true
+
+	root, err := bfs.Root()
+	assert.NoError(t, err)
+	node, _, err := root.(*gobuddyfs.FSMeta).Create(context.TODO(), &fuse.CreateRequest{Name: "foo"}, nil)
+	assert.NoError(t, err)
+	file := node.(*gobuddyfs.File)
+	assert.NoError(t, file.Write(context.TODO(),
+		&fuse.WriteRequest{Data: []byte("foo")}, &fuse.WriteResponse{}))
+
+	// Writing the block gives up rather than retrying forever.
+	assert.Error(t, file.Flush(context.TODO(), &fuse.FlushRequest{}))
+	assert.True(t, store.attempts > 1 && store.attempts < 100, "%d attempts", store.attempts)
+
+	// And not at all once the caller has.
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	store.attempts = 0
+	assert.Error(t, file.Flush(ctx, &fuse.FlushRequest{}))
+	assert.Equal(t, 0, store.attempts)
+}
+
+func TestDedupKeys(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	bfs := gobuddyfs.NewBuddyFS(memkv)
+	bfs.Dedup = true
+	bfs.KeyMaterial = []byte("0123456789abcdef0123456789abcdef")
+
+	// Content hashes are only stored keyed.
+	_, err := bfs.Root()
+	assert.Error(t, err)
+	assert.NoError(t, memkv.Scan("", "", func(key string, value []byte) bool {
+		t.Errorf("Unexpected key %q", key)
+		return true
+	}))
+
+	bfs.HashKeys = true
+	root, err := bfs.Root()
+	assert.NoError(t, err)
+	node, _, err := root.(*gobuddyfs.FSMeta).Create(context.TODO(), &fuse.CreateRequest{Name: "foo"}, nil)
+	assert.NoError(t, err)
+	file := node.(*gobuddyfs.File)
+	assert.NoError(t, file.Write(context.TODO(),
+		&fuse.WriteRequest{Data: []byte("foo")}, &fuse.WriteResponse{}))
+	assert.NoError(t, file.Flush(context.TODO(), &fuse.FlushRequest{}))
+
+	hash := sha256.Sum256([]byte("foo"))
+	assert.NoError(t, memkv.Scan("", "", func(key string, value []byte) bool {
+		assert.NotContains(t, key, "sha256:")
+		assert.NotContains(t, key, hex.EncodeToString(hash[:]))
+		return true
+	}))
+}
+
+func TestChunkedVolume(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	bfs := gobuddyfs.NewBuddyFS(memkv)
+	bfs.Dedup = true
+	bfs.Chunking = true
+
+	root, err := bfs.Root()
+	assert.NoError(t, err)
+
+	create := func(name string, data []byte) *gobuddyfs.File {
+		node, _, err := root.(*gobuddyfs.FSMeta).Create(context.TODO(), &fuse.CreateRequest{Name: name}, nil)
+		assert.NoError(t, err)
+		file := node.(*gobuddyfs.File)
+		for offset := 0; offset < len(data); {
+			res := &fuse.WriteResponse{}
+			assert.NoError(t, file.Write(context.TODO(),
+				&fuse.WriteRequest{Data: data[offset:], Offset: int64(offset)}, res))
+			offset += res.Size
+		}
+		assert.NoError(t, file.Flush(context.TODO(), &fuse.FlushRequest{}))
+		return file
+	}
+
+	chunks := func() int {
+		count := 0
+		assert.NoError(t, memkv.Scan("sha256:", "sha256;", func(key string, value []byte) bool {
+			count++
+			return true
+		}))
+		return count
+	}
+
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	create("foo", data)
+	first := chunks()
+	assert.True(t, first > 4, "%d chunks", first)
+
+	// Inserting at the start only changes the chunks around the insertion.
+	create("bar", append([]byte("inserted"), data...))
+	assert.True(t, chunks()-first <= 2, "%d chunks added", chunks()-first)
+
+	root, err = gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+	node, err := lookup(root, "foo")
+	assert.NoError(t, err)
+	file := node.(*gobuddyfs.File)
+
+	// Reads span chunks.
+	res := &fuse.ReadResponse{}
+	assert.NoError(t, file.Read(context.TODO(), &fuse.ReadRequest{Offset: 1000, Size: 100 << 10}, res))
+	assert.Equal(t, data[1000:1000+100<<10], res.Data)
+
+	// So do writes, a chunk at a time.
+	patch := bytes.Repeat([]byte{'x'}, 40<<10)
+	for offset := 0; offset < len(patch); {
+		res := &fuse.WriteResponse{}
+		assert.NoError(t, file.Write(context.TODO(),
+			&fuse.WriteRequest{Data: patch[offset:], Offset: int64(50<<10 + offset)}, res))
+		offset += res.Size
+	}
+	copy(data[50<<10:], patch)
+	assert.NoError(t, file.Setattr(context.TODO(),
+		&fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 200 << 10}, &fuse.SetattrResponse{}))
+	data = data[:200<<10]
+
+	root, err = gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+	node, err = lookup(root, "foo")
+	assert.NoError(t, err)
+	res = &fuse.ReadResponse{}
+	assert.NoError(t, node.(*gobuddyfs.File).Read(context.TODO(), &fuse.ReadRequest{Size: 1 << 20}, res))
+	assert.Equal(t, data, res.Data)
+}
+
+// Growing a file adds chunks backed by shared zeros, rather than one chunk
+// holding every byte it grew by.
+func TestChunkedGrow(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	bfs := gobuddyfs.NewBuddyFS(memkv)
+	bfs.Dedup = true
+	bfs.Chunking = true
+	root, err := bfs.Root()
+	assert.NoError(t, err)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	files := make([]*gobuddyfs.File, 2)
+	for i := range files {
+		node, _, err := root.(*gobuddyfs.FSMeta).Create(context.TODO(),
+			&fuse.CreateRequest{Name: fmt.Sprint(i)}, nil)
+		assert.NoError(t, err)
+		files[i] = node.(*gobuddyfs.File)
+		assert.NoError(t, files[i].Setattr(context.TODO(),
+			&fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 64 << 20}, &fuse.SetattrResponse{}))
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	assert.True(t, after.HeapAlloc < before.HeapAlloc+16<<20,
+		"%d bytes in use", after.HeapAlloc-before.HeapAlloc)
+	count := 0
+	assert.NoError(t, memkv.Scan("sha256:", "sha256;", func(key string, value []byte) bool {
+		count++
+		return true
+	}))
+	assert.Equal(t, 1, count)
+
+	// Writing to one file leaves the zeros of the other alone.
+	assert.NoError(t, files[0].Write(context.TODO(),
+		&fuse.WriteRequest{Data: []byte("x"), Offset: 10 << 20}, &fuse.WriteResponse{}))
+	assert.NoError(t, files[0].Flush(context.TODO(), &fuse.FlushRequest{}))
+	for i, want := range [][]byte{{0, 'x', 0}, {0, 0, 0}} {
+		res := &fuse.ReadResponse{}
+		assert.NoError(t, files[i].Read(context.TODO(),
+			&fuse.ReadRequest{Offset: 10<<20 - 1, Size: 3}, res))
+		assert.Equal(t, want, res.Data)
+	}
+
+	// And so does appending to one cut short.
+	assert.NoError(t, files[1].Setattr(context.TODO(),
+		&fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 20<<20 + 1}, &fuse.SetattrResponse{}))
+	assert.NoError(t, files[1].Write(context.TODO(),
+		&fuse.WriteRequest{Data: []byte("y"), Offset: 20<<20 + 1}, &fuse.WriteResponse{}))
+	res := &fuse.ReadResponse{}
+	assert.NoError(t, files[0].Read(context.TODO(),
+		&fuse.ReadRequest{Offset: 20 << 20, Size: 3}, res))
+	assert.Equal(t, []byte{0, 0, 0}, res.Data)
+	runtime.KeepAlive(files)
+}
+
+func TestStableNodes(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	root, err := gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+
+	dir, err := root.(*gobuddyfs.FSMeta).Mkdir(context.TODO(), &fuse.MkdirRequest{Name: "dir"})
+	assert.NoError(t, err)
+	file, _, err := dir.(*gobuddyfs.Dir).Create(context.TODO(), &fuse.CreateRequest{Name: "foo"}, nil)
+	assert.NoError(t, err)
+
+	// Repeated lookups give the same node.
+	node, err := lookup(root, "dir")
+	assert.NoError(t, err)
+	assert.True(t, node == dir)
+	node, err = lookup(dir, "foo")
+	assert.NoError(t, err)
+	assert.True(t, node == file)
+
+	// A file made again under the same name is a different one, with another
+	// inode.
+	root2, err := gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+	dir2, err := lookup(root2, "dir")
+	assert.NoError(t, err)
+	assert.NoError(t, dir2.(*gobuddyfs.Dir).Remove(context.TODO(), &fuse.RemoveRequest{Name: "foo"}))
+	file2, _, err := dir2.(*gobuddyfs.Dir).Create(context.TODO(), &fuse.CreateRequest{Name: "foo"}, nil)
+	assert.NoError(t, err)
+	var attr, attr2 fuse.Attr
+	assert.NoError(t, file.Attr(context.TODO(), &attr))
+	assert.NoError(t, file2.Attr(context.TODO(), &attr2))
+	assert.NotEqual(t, attr.Inode, attr2.Inode)
+
+	// Directories in the table still see changes made by other mounts.
+	_, err = lookup(root, "dir")
+	assert.NoError(t, err)
+	node, err = lookup(dir, "foo")
+	assert.NoError(t, err)
+	assert.False(t, node == file)
+}
+
+func TestSharedFileState(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	root, err := gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+
+	node, h1, err := root.(*gobuddyfs.FSMeta).Create(context.TODO(), &fuse.CreateRequest{Name: "foo"}, nil)
+	assert.NoError(t, err)
+	same, err := lookup(root, "foo")
+	assert.NoError(t, err)
+	assert.True(t, same == node)
+	h2, err := node.(*gobuddyfs.File).Open(context.TODO(), &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	assert.NoError(t, err)
+	assert.False(t, h2 == h1)
+
+	// Writes through one handle are seen through the other before a flush.
+	var wg sync.WaitGroup
+	for i, h := range []fs.Handle{h1, h2} {
+		wg.Add(1)
+		go func(i int, h fs.Handle) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte('a' + i)}, gobuddyfs.BLOCK_SIZE)
+			assert.NoError(t, h.(fs.HandleWriter).Write(context.TODO(),
+				&fuse.WriteRequest{Data: data, Offset: int64(i * gobuddyfs.BLOCK_SIZE)},
+				&fuse.WriteResponse{}))
+		}(i, h)
+	}
+	wg.Wait()
+
+	for i, h := range []fs.Handle{h2, h1} {
+		res := &fuse.ReadResponse{}
+		assert.NoError(t, h.(fs.HandleReader).Read(context.TODO(),
+			&fuse.ReadRequest{Offset: int64(i * gobuddyfs.BLOCK_SIZE), Size: 1}, res))
+		assert.Equal(t, []byte{byte('a' + i)}, res.Data)
+	}
+	assert.NoError(t, h1.(fs.HandleFlusher).Flush(context.TODO(), &fuse.FlushRequest{}))
+	assert.NoError(t, h1.(fs.HandleReleaser).Release(context.TODO(), &fuse.ReleaseRequest{}))
+	assert.NoError(t, h2.(fs.HandleReleaser).Release(context.TODO(), &fuse.ReleaseRequest{}))
+
+	// Once the kernel forgets the node, a lookup reads the file again.
+	node.(fs.NodeForgetter).Forget()
+	fresh, err := lookup(root, "foo")
+	assert.NoError(t, err)
+	assert.False(t, fresh == node)
+	var attr fuse.Attr
+	assert.NoError(t, fresh.Attr(context.TODO(), &attr))
+	assert.EqualValues(t, 2*gobuddyfs.BLOCK_SIZE, attr.Size)
+}
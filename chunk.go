@@ -0,0 +1,370 @@
+package gobuddyfs
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// In a volume created with BuddyFS.Chunking set, files are split into chunks
+// of varying size, at points chosen by a rolling hash of their contents as in
+// FastCDC. An insertion then only changes the chunks around it, instead of
+// shifting the contents of every later block, so the rest still deduplicate.
+//
+// Writes change the chunks in place, and only the last one grows. Once it is
+// chunkMax long it is split at its boundaries, and the file goes on in a new
+// chunk. When the file is flushed, the changed chunks are split again,
+// continuing into the chunks after them until a boundary falls where one did
+// before.
+
+// Chunk sizes, in bytes. Boundaries are harder to find before chunkAvg and
+// easier after it, which keeps most chunks close to that size.
+const (
+	chunkMin = 2 << 10
+	chunkAvg = 8 << 10
+	chunkMax = 64 << 10
+)
+
+// The masks test the top bits of the hash, which depend on the most bytes.
+const (
+	chunkMaskSmall uint64 = (1<<15 - 1) << (64 - 15)
+	chunkMaskLarge uint64 = (1<<11 - 1) << (64 - 11)
+)
+
+// gear holds a fixed pseudo-random value for every byte, from which the
+// rolling hash is computed. Chunk boundaries depend on it, so it must never
+// change; it is generated with splitmix64 from a fixed seed.
+var gear = func() (table [256]uint64) {
+	var x uint64
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := (x ^ x>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return
+}()
+
+// cutPoint returns the length of the first chunk of data, and whether it ends
+// at a boundary. If it doesn't, the chunk may go on in the data that follows.
+func cutPoint(data []byte) (int, bool) {
+	if len(data) <= chunkMin {
+		return len(data), false
+	}
+
+	n := min(len(data), chunkMax)
+	var h uint64
+	i := chunkMin
+	for ; i < n && i < chunkAvg; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&chunkMaskSmall == 0 {
+			return i + 1, true
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&chunkMaskLarge == 0 {
+			return i + 1, true
+		}
+	}
+	return n, n == chunkMax
+}
+
+var errChunkSize = errors.New("chunk size mismatch")
+
+// zeroChunk backs the chunks a file is extended with until they are written
+// to, so that growing a file takes no memory for its contents. A run of zeros
+// holds no boundary before chunkMax.
+var zeroChunk = make([]byte, chunkMax)
+
+// isZeroChunk tells whether data is backed by zeroChunk, and must be copied
+// before it is changed.
+func isZeroChunk(data []byte) bool {
+	return len(data) > 0 && &data[0] == &zeroChunk[0]
+}
+
+// isChunked tells whether files in store are split into chunks by content.
+func isChunked(store KVStore) bool {
+	vs, ok := store.(*volumeStore)
+	return ok && vs.sb.Chunking
+}
+
+// chunkAt returns the index of the chunk holding the byte at offset, and the
+// offset the chunk starts at.
+func (file *File) chunkAt(offset uint64) (int, uint64) {
+	i := sort.Search(len(file.chunkEnds), func(i int) bool {
+		return file.chunkEnds[i] > offset
+	})
+	return i, file.chunkStart(i)
+}
+
+func (file *File) chunkStart(i int) uint64 {
+	if i == 0 {
+		return 0
+	}
+	return file.chunkEnds[i-1]
+}
+
+func (file *File) chunkDirty(i int) bool {
+	dBlk := file.BlockCache[file.Blocks[i].GetId()]
+	return dBlk != nil && dBlk.IsDirty()
+}
+
+// dropChunks removes the blocks of chunks which are no longer part of the file.
+func (file *File) dropChunks(ctx context.Context, blocks []StorageUnit) {
+	for _, blk := range blocks {
+		delete(file.BlockCache, blk.GetId())
+		if hash := blockHash(blk); hash != nil {
+			file.released = append(file.released, hash)
+		} else {
+			blk.Delete(ctx, file.KVS)
+		}
+	}
+}
+
+func (file *File) setSizeChunked(ctx context.Context, size uint64) error {
+	if size < file.Size {
+		i, start := file.chunkAt(size)
+		if start < size {
+			// The chunk holding the new end is cut short.
+			dBlk, err := file.getBlock(ctx, int64(i))
+			if err != nil {
+				return err
+			}
+			end := size - start
+			dBlk.Data = dBlk.Data[:end:end]
+			dBlk.MarkDirty()
+			file.chunkEnds[i] = size
+			i++
+		}
+		file.dropChunks(ctx, file.Blocks[i:])
+		file.Blocks = file.Blocks[:i]
+		file.chunkEnds = file.chunkEnds[:i]
+	} else if size > file.Size {
+		if err := file.appendChunked(ctx, nil, size-file.Size); err != nil {
+			return err
+		}
+	}
+
+	file.Size = size
+	file.MarkDirty()
+	return nil
+}
+
+// appendChunked adds data to the end of the file, or n zero bytes if data is
+// nil.
+func (file *File) appendChunked(ctx context.Context, data []byte, n uint64) error {
+	if data != nil {
+		n = uint64(len(data))
+	}
+
+	for n > 0 {
+		last := len(file.Blocks) - 1
+		var dBlk *DataBlock
+		if last >= 0 {
+			var err error
+			if dBlk, err = file.getBlock(ctx, int64(last)); err != nil {
+				return err
+			} else if uint64(len(dBlk.Data)) != file.Size-file.chunkStart(last) {
+				return errChunkSize
+			}
+		}
+		if dBlk == nil || len(dBlk.Data) == chunkMax {
+			blk, err := file.blkGen.NewBlock(ctx)
+			if err != nil {
+				return err
+			}
+			dBlk = &DataBlock{StorageUnit: blk, Data: []byte{}}
+			file.Blocks = append(file.Blocks, blk)
+			file.chunkEnds = append(file.chunkEnds, file.Size)
+			file.appendBlock(dBlk)
+			last++
+		}
+
+		k := uint64(chunkMax - len(dBlk.Data))
+		if n < k {
+			k = n
+		}
+		if data != nil {
+			dBlk.Data = append(dBlk.Data, data[:k]...)
+			data = data[k:]
+		} else if len(dBlk.Data) == 0 || isZeroChunk(dBlk.Data) {
+			end := len(dBlk.Data) + int(k)
+			dBlk.Data = zeroChunk[:end:end]
+		} else {
+			dBlk.Data = append(dBlk.Data, zeroChunk[:k]...)
+		}
+		dBlk.MarkDirty()
+		n -= k
+		file.Size += k
+		file.chunkEnds[last] = file.Size
+
+		if len(dBlk.Data) == chunkMax && !isZeroChunk(dBlk.Data) {
+			if err := file.cutLast(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cutLast splits the last chunk at the boundaries in it, leaving the data
+// after them to grow into the next chunk.
+func (file *File) cutLast(ctx context.Context) error {
+	for {
+		last := len(file.Blocks) - 1
+		dBlk := file.BlockCache[file.Blocks[last].GetId()]
+		n, cut := cutPoint(dBlk.Data)
+		if !cut || n == len(dBlk.Data) {
+			return nil
+		}
+
+		blk, err := file.blkGen.NewBlock(ctx)
+		if err != nil {
+			return err
+		}
+		rest := &DataBlock{StorageUnit: blk, Data: append([]byte(nil), dBlk.Data[n:]...)}
+		rest.MarkDirty()
+		dBlk.Data = dBlk.Data[:n:n]
+		file.chunkEnds[last] -= uint64(len(rest.Data))
+		file.Blocks = append(file.Blocks, blk)
+		file.chunkEnds = append(file.chunkEnds, file.Size)
+		file.appendBlock(rest)
+	}
+}
+
+func (file *File) writeChunked(ctx context.Context, offset uint64, data []byte) (int, error) {
+	if offset > file.Size {
+		if err := file.appendChunked(ctx, nil, offset-file.Size); err != nil {
+			return 0, err
+		}
+	}
+
+	n := 0
+	if offset < file.Size {
+		i, start := file.chunkAt(offset)
+		dBlk, err := file.getBlock(ctx, int64(i))
+		if err != nil {
+			return 0, err
+		} else if uint64(len(dBlk.Data)) != file.chunkEnds[i]-start {
+			return 0, errChunkSize
+		}
+
+		if isZeroChunk(dBlk.Data) {
+			dBlk.Data = append([]byte(nil), dBlk.Data...)
+		}
+		n = copy(dBlk.Data[offset-start:], data)
+		dBlk.MarkDirty()
+		file.MarkDirty()
+		if i < len(file.Blocks)-1 {
+			// The rest is left for another write.
+			return n, nil
+		}
+	}
+
+	// Whatever goes past the end of the file is appended to it.
+	if n < len(data) {
+		if err := file.appendChunked(ctx, data[n:], 0); err != nil {
+			return n, err
+		}
+		file.MarkDirty()
+	}
+	return len(data), nil
+}
+
+func (file *File) readChunked(ctx context.Context, offset uint64, size int) ([]byte, error) {
+	data := []byte{}
+	for len(data) < size && offset < file.Size {
+		i, start := file.chunkAt(offset)
+		dBlk, err := file.getBlock(ctx, int64(i))
+		if err != nil {
+			return nil, err
+		} else if uint64(len(dBlk.Data)) != file.chunkEnds[i]-start {
+			return nil, errChunkSize
+		}
+
+		chunk := dBlk.Data[offset-start:]
+		chunk = chunk[:min(len(chunk), size-len(data))]
+		data = append(data, chunk...)
+		offset += uint64(len(chunk))
+	}
+	return data, nil
+}
+
+// rechunk splits the changed chunks of the file again at the boundaries their
+// contents call for. Chunks keep their blocks where they can, so that blocks
+// are rewritten rather than replaced.
+func (file *File) rechunk(ctx context.Context) error {
+	for i := 0; i < len(file.Blocks); i++ {
+		if !file.chunkDirty(i) {
+			continue
+		}
+
+		var pieces [][]byte
+		var buf []byte
+		j := i
+		for {
+			dBlk, err := file.getBlock(ctx, int64(j))
+			if err != nil {
+				return err
+			}
+			buf = append(buf, dBlk.Data...)
+			j++
+
+			for len(buf) > 0 {
+				n, cut := cutPoint(buf)
+				if !cut && j < len(file.Blocks) {
+					break
+				}
+				pieces = append(pieces, buf[:n:n])
+				buf = buf[n:]
+			}
+
+			// A boundary falls where one did before, so the chunks after it
+			// split the same whether or not this one changed.
+			if j == len(file.Blocks) || len(buf) == 0 {
+				break
+			}
+		}
+
+		// New blocks are allocated first, so that failing leaves the file as it was.
+		blocks := make([]StorageUnit, len(pieces))
+		for k := j - i; k < len(pieces); k++ {
+			blk, err := file.blkGen.NewBlock(ctx)
+			if err != nil {
+				return err
+			}
+			blocks[k] = blk
+		}
+
+		ends := make([]uint64, len(pieces))
+		offset := file.chunkStart(i)
+		for k, piece := range pieces {
+			if k < j-i {
+				blocks[k] = file.Blocks[i+k]
+				dBlk := file.BlockCache[blocks[k].GetId()]
+				if !bytes.Equal(dBlk.Data, piece) {
+					dBlk.Data = piece
+					dBlk.MarkDirty()
+				}
+			} else {
+				dBlk := &DataBlock{StorageUnit: blocks[k], Data: piece}
+				dBlk.MarkDirty()
+				file.appendBlock(dBlk)
+			}
+			offset += uint64(len(piece))
+			ends[k] = offset
+		}
+		if len(pieces) < j-i {
+			file.dropChunks(ctx, file.Blocks[i+len(pieces):j])
+		}
+
+		file.Blocks = append(append(file.Blocks[:i:i], blocks...), file.Blocks[j:]...)
+		file.chunkEnds = append(append(file.chunkEnds[:i:i], ends...), file.chunkEnds[j:]...)
+		file.MarkDirty()
+		i += len(pieces) - 1
+	}
+	return nil
+}
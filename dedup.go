@@ -0,0 +1,138 @@
+package gobuddyfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// In a volume created with BuddyFS.Dedup set, data blocks are stored under a
+// key derived from the SHA-256 of their contents, so that blocks with the same
+// contents are stored once. The stored value is the number of file blocks
+// referring to it, as a uvarint, followed by the encoded block. Counting
+// references relies on compare-and-set; with a store which lacks it,
+// concurrent writers may miscount.
+//
+// References are dropped when a file's blocks are rewritten, when it is
+// truncated, and when it is removed.
+
+var errBadRefCount = errors.New("invalid reference count")
+
+func contentHash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// contentKey returns the key of the data block whose contents hash to hash.
+func contentKey(store KVStore, hash []byte) string {
+	name := "sha256:" + hex.EncodeToString(hash)
+	if vs, ok := store.(*volumeStore); ok {
+		return vs.key(name)
+	}
+	return name
+}
+
+// isDedup tells whether data blocks in store are content-addressed.
+func isDedup(store KVStore) bool {
+	vs, ok := store.(*volumeStore)
+	return ok && vs.sb.Dedup
+}
+
+func withRefs(refs uint64, encoded []byte) []byte {
+	value := make([]byte, binary.MaxVarintLen64+len(encoded))
+	n := binary.PutUvarint(value, refs)
+	return append(value[:n], encoded...)
+}
+
+func splitRefs(key string, value []byte) (uint64, []byte, error) {
+	refs, n := binary.Uvarint(value)
+	if n <= 0 {
+		return 0, nil, &StoreError{Class: Corrupt, Op: "decode", Key: key, Err: errBadRefCount}
+	}
+	return refs, value[n:], nil
+}
+
+// acquireContent adds a reference to the data block with the given contents,
+// which hash to hash, storing the block if it didn't exist yet. Like a
+// directory update, it gives up with ErrConflict after maxUpdateAttempts.
+func acquireContent(ctx context.Context, store KVStore, hash, data []byte) error {
+	key := contentKey(store, hash)
+	var err error
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var stored []byte
+		stored, err = kvGet(ctx, store, key, true)
+		if err == ErrNotFound {
+			var encoded []byte
+			if encoded, err = encodeBlock(store, data); err != nil {
+				return err
+			}
+			err = kvCompareAndSet(ctx, store, key, nil, withRefs(1, encoded))
+		} else if err == nil {
+			var refs uint64
+			var encoded []byte
+			if refs, encoded, err = splitRefs(key, stored); err != nil {
+				return err
+			}
+			err = kvCompareAndSet(ctx, store, key, stored, withRefs(refs+1, encoded))
+		}
+
+		if err != ErrConflict {
+			return err
+		}
+	}
+	return err
+}
+
+// releaseContent drops a reference to the data block whose contents hash to
+// hash, deleting the block once nothing refers to it. It gives up as
+// acquireContent does.
+func releaseContent(ctx context.Context, store KVStore, hash []byte) error {
+	key := contentKey(store, hash)
+	var err error
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var stored []byte
+		stored, err = kvGet(ctx, store, key, true)
+		if err == ErrNotFound {
+			glog.Warningf("Releasing missing data block %s", key)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var refs uint64
+		var encoded []byte
+		if refs, encoded, err = splitRefs(key, stored); err != nil {
+			return err
+		}
+		if refs > 1 {
+			err = kvCompareAndSet(ctx, store, key, stored, withRefs(refs-1, encoded))
+		} else {
+			err = kvCompareAndSet(ctx, store, key, stored, nil)
+		}
+
+		if err != ErrConflict {
+			return err
+		}
+	}
+	return err
+}
+
+// blockHash returns the hash of a content-addressed block's contents, or nil.
+func blockHash(su StorageUnit) []byte {
+	if b, ok := su.(*Block); ok {
+		return b.hash
+	}
+	return nil
+}
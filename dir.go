@@ -22,6 +22,7 @@ type Dir struct {
 	BFS    *BuddyFS       `json:"-"`
 	KVS    KVStore        `json:"-"`
 	blkGen BlockGenerator `json:"-"`
+	nodes  *nodeTable     `json:"-"`
 	Block
 	fs.Node
 }
@@ -40,14 +41,21 @@ func (dir *Dir) Forget() {
 	if glog.V(2) {
 		glog.Infoln("FORGET", dir.Name)
 	}
+	dir.nodes.forget(dir.Id, dir)
 }
 
 func (dir Dir) Attr(ctx context.Context, attr *fuse.Attr) error {
 	attr.Mode = os.ModeDir | 0555
+	// As for files, the inode is the block id.
 	attr.Inode = uint64(dir.Id)
 	return nil
 }
 
+// TODO: Handles which stay valid across remounts, as NFS exports need, take
+// a generation stored with each entry and returned in LookupResponse. The
+// bazil.org/fuse server numbers nodes itself and replaces the generation with
+// a counter of its own, so that needs a serve path which lets nodes supply
+// both.
 func (dir *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	if glog.V(2) {
 		glog.Infof("Looking up file %s", name)
@@ -56,48 +64,141 @@ func (dir *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	dir.Lock.RLock()
 	defer dir.Lock.RUnlock()
 
-	_, _, node, err := dir.LookupUnlocked(ctx, name)
+	isDir, posn, node, err := dir.LookupUnlocked(ctx, name)
+	if err == nil {
+		if isDir {
+			dir.nodes.handOver(dir.Dirs[posn].Id)
+		} else {
+			dir.nodes.handOver(dir.Files[posn].Id)
+		}
+	}
 	return node, err
 }
 
+// LookupUnlocked finds the node of the entry called name. The caller holds a
+// reference to the node, which it must release or hand over to the kernel.
 func (dir *Dir) LookupUnlocked(ctx context.Context, name string) (bool, int, fs.Node, error) {
 	for dirId := range dir.Dirs {
 		if dir.Dirs[dirId].Name == name {
-			var dirDir Dir
+			if node := dir.nodes.get(dir.Dirs[dirId].Id); node != nil {
+				if err := node.(*Dir).refresh(ctx); err != nil {
+					dir.nodes.release(dir.Dirs[dirId].Id)
+					glog.Errorf("Error while read dir block: %q", err)
+					return true, dirId, nil, fuseError(err)
+				}
+				return true, dirId, node, nil
+			}
+
+			dirDir := new(Dir)
 			dirDir.Id = dir.Dirs[dirId].Id
 
-			err := dirDir.ReadBlock(&dirDir, dir.KVS)
+			err := dirDir.ReadBlock(ctx, dirDir, dir.KVS)
 			if err != nil {
 				glog.Errorf("Error while read dir block: %q", err)
-				return true, dirId, nil, fuse.EIO
+				return true, dirId, nil, fuseError(err)
 			}
 
 			dirDir.KVS = dir.KVS
 			dirDir.blkGen = dir.blkGen
-			return true, dirId, &dirDir, nil
+			dirDir.nodes = dir.nodes
+			return true, dirId, dir.nodes.put(dirDir.Id, dirDir), nil
 		}
 	}
 
 	for fileId := range dir.Files {
 		if dir.Files[fileId].Name == name {
-			var file File
+			if node := dir.nodes.get(dir.Files[fileId].Id); node != nil {
+				if err := node.(*File).refresh(ctx); err != nil {
+					dir.nodes.release(dir.Files[fileId].Id)
+					glog.Errorf("Error while read file block: %q", err)
+					return false, fileId, nil, fuseError(err)
+				}
+				return false, fileId, node, nil
+			}
+
+			file := new(File)
 			file.Block.Id = dir.Files[fileId].Id
 
-			err := file.ReadBlock(&file, dir.KVS)
+			err := file.ReadBlock(ctx, file, dir.KVS)
 			if err != nil {
 				glog.Errorf("Error while read file block: %q", err)
-				return false, fileId, nil, fuse.EIO
+				return false, fileId, nil, fuseError(err)
 			}
 
 			file.KVS = dir.KVS
 			file.blkGen = dir.blkGen
-			return false, fileId, &file, nil
+			file.nodes = dir.nodes
+			return false, fileId, dir.nodes.put(file.Id, file), nil
 		}
 	}
 
 	return false, 0, nil, fuse.ENOENT
 }
 
+// maxUpdateAttempts bounds how often a directory update is re-applied while
+// other writers keep changing the directory underneath it.
+const maxUpdateAttempts = 10
+
+// findEntry returns the position of the entry called name, without reading
+// the entry's block.
+func (dir *Dir) findEntry(name string) (isDir bool, posn int, found bool) {
+	for dirId := range dir.Dirs {
+		if dir.Dirs[dirId].Name == name {
+			return true, dirId, true
+		}
+	}
+
+	for fileId := range dir.Files {
+		if dir.Files[fileId].Name == name {
+			return false, fileId, true
+		}
+	}
+
+	return false, 0, false
+}
+
+// update applies change to the directory and writes it back. If another
+// writer, such as a second mount of the same store, has modified the
+// directory since it was last read, the directory is re-read and change is
+// applied again to the fresh copy so that neither writer's entries are lost.
+// If the update fails, the directory is left as it was before.
+func (dir *Dir) update(ctx context.Context, change func() error) error {
+	var err error
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		if attempt > 0 {
+			if glog.V(1) {
+				glog.Infof("Directory %s changed concurrently, re-reading", dir.Name)
+			}
+			err = dir.ReadBlock(ctx, dir, dir.KVS)
+			if err != nil {
+				return err
+			}
+		}
+
+		dirs := append([]Block(nil), dir.Dirs...)
+		files := append([]Block(nil), dir.Files...)
+
+		err = change()
+		if err == nil {
+			dir.MarkDirty()
+			err = dir.CompareAndWriteBlock(ctx, dir, dir.KVS)
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		// Undo the change, which never made it to the store.
+		dir.Dirs, dir.Files = dirs, files
+		dir.MarkClean()
+
+		if err != ErrConflict {
+			return err
+		}
+	}
+	return err
+}
+
 func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
 	if glog.V(2) {
 		glog.Infof("Mkdir %s %d", req.Name, len(req.Name))
@@ -110,29 +211,38 @@ func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, err
 	dir.Lock.Lock()
 	defer dir.Lock.Unlock()
 
-	_, _, _, err := dir.LookupUnlocked(ctx, req.Name)
-	if err != fuse.ENOENT {
+	if _, _, found := dir.findEntry(req.Name); found {
 		return nil, fuse.Errno(syscall.EEXIST)
 	}
 
-	blk := dir.blkGen.NewNamedBlock(req.Name)
+	blk, err := dir.blkGen.NewNamedBlock(ctx, req.Name)
+	if err != nil {
+		return nil, fuseError(err)
+	}
 
-	newDir := &Dir{Block: blk, KVS: dir.KVS, blkGen: dir.blkGen, Dirs: []Block{},
-		Files: []Block{}, Lock: sync.RWMutex{}}
+	newDir := &Dir{Block: blk, KVS: dir.KVS, blkGen: dir.blkGen, nodes: dir.nodes,
+		Dirs: []Block{}, Files: []Block{}, Lock: sync.RWMutex{}}
 	newDir.MarkDirty()
-	err = newDir.WriteBlock(newDir, dir.KVS)
+	err = newDir.CompareAndWriteBlock(ctx, newDir, dir.KVS)
 	if err != nil {
-		return nil, fuse.EIO
+		return nil, fuseError(err)
 	}
 
-	dir.Dirs = append(dir.Dirs, blk)
-	dir.MarkDirty()
-	dir.WriteBlock(dir, dir.KVS)
+	err = dir.update(ctx, func() error {
+		if _, _, found := dir.findEntry(req.Name); found {
+			return fuse.Errno(syscall.EEXIST)
+		}
+		dir.Dirs = append(dir.Dirs, blk)
+		return nil
+	})
 	if err != nil {
-		return nil, fuse.EIO
+		newDir.Delete(ctx, dir.KVS)
+		return nil, fuseError(err)
 	}
 
-	return newDir, nil
+	node := dir.nodes.put(newDir.Id, newDir)
+	dir.nodes.handOver(newDir.Id)
+	return node, nil
 }
 
 func (dir *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
@@ -151,17 +261,15 @@ func (dir *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	if err != nil {
 		return err
 	}
-
-	if !isDir {
-		dir.Files = append(dir.Files[:posn], dir.Files[posn+1:]...)
-		dir.MarkDirty()
-		dir.WriteBlock(dir, dir.KVS)
-		if err != nil {
-			return fuse.EIO
-		}
-
-		return nil
+	if isDir {
+		defer dir.nodes.release(dir.Dirs[posn].Id)
 	} else {
+		defer dir.nodes.release(dir.Files[posn].Id)
+	}
+
+	var id int64
+	var file *File
+	if isDir {
 		dirDir, ok := node.(*Dir)
 		if !ok {
 			return fuse.EIO
@@ -170,18 +278,39 @@ func (dir *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 		if len(dirDir.Dirs) != 0 || len(dirDir.Files) != 0 {
 			return fuse.Errno(syscall.ENOTEMPTY)
 		}
-
-		dir.Dirs = append(dir.Dirs[:posn], dir.Dirs[posn+1:]...)
-		dir.MarkDirty()
-		dir.WriteBlock(dir, dir.KVS)
-		if err != nil {
+		id = dirDir.Id
+	} else {
+		var ok bool
+		if file, ok = node.(*File); !ok {
 			return fuse.EIO
 		}
+		id = file.Id
+	}
 
+	err = dir.update(ctx, func() error {
+		entryIsDir, posn, found := dir.findEntry(req.Name)
+		if !found || entryIsDir != isDir {
+			return fuse.ENOENT
+		}
+
+		if isDir {
+			if dir.Dirs[posn].Id != id {
+				// Replaced by another writer since it was checked.
+				return fuse.ENOENT
+			}
+			dir.Dirs = append(dir.Dirs[:posn], dir.Dirs[posn+1:]...)
+		} else {
+			if dir.Files[posn].Id != id {
+				return fuse.ENOENT
+			}
+			dir.Files = append(dir.Files[:posn], dir.Files[posn+1:]...)
+		}
 		return nil
+	})
+	if err == nil && file != nil {
+		file.remove(ctx)
 	}
-
-	return fuse.ENOSYS
+	return fuseError(err)
 }
 
 func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
@@ -196,28 +325,38 @@ func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.
 	dir.Lock.Lock()
 	defer dir.Lock.Unlock()
 
-	_, _, _, err := dir.LookupUnlocked(ctx, req.Name)
-	if err != fuse.ENOENT {
+	if _, _, found := dir.findEntry(req.Name); found {
 		return nil, nil, fuse.Errno(syscall.EEXIST)
 	}
 
-	blk := dir.blkGen.NewNamedBlock(req.Name)
+	blk, err := dir.blkGen.NewNamedBlock(ctx, req.Name)
+	if err != nil {
+		return nil, nil, fuseError(err)
+	}
 
-	newFile := &File{Block: blk, Blocks: []StorageUnit{}, KVS: dir.KVS, blkGen: dir.blkGen}
+	newFile := &File{Block: blk, Blocks: []StorageUnit{}, KVS: dir.KVS, blkGen: dir.blkGen,
+		nodes: dir.nodes}
 	newFile.MarkDirty()
-	err = newFile.WriteBlock(newFile, dir.KVS)
+	err = newFile.CompareAndWriteBlock(ctx, newFile, dir.KVS)
 	if err != nil {
-		return nil, nil, fuse.EIO
+		return nil, nil, fuseError(err)
 	}
 
-	dir.Files = append(dir.Files, blk)
-	dir.MarkDirty()
-	dir.WriteBlock(dir, dir.KVS)
+	err = dir.update(ctx, func() error {
+		if _, _, found := dir.findEntry(req.Name); found {
+			return fuse.Errno(syscall.EEXIST)
+		}
+		dir.Files = append(dir.Files, blk)
+		return nil
+	})
 	if err != nil {
-		return nil, nil, fuse.EIO
+		newFile.Delete(ctx, dir.KVS)
+		return nil, nil, fuseError(err)
 	}
 
-	return newFile, newFile, nil
+	node := dir.nodes.put(newFile.Id, newFile)
+	dir.nodes.handOver(newFile.Id)
+	return node, &FileHandle{File: node.(*File)}, nil
 }
 
 func (dir *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
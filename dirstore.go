@@ -0,0 +1,375 @@
+package gobuddyfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// DirStoreOptions controls the durability of DirStore writes.
+type DirStoreOptions struct {
+	// Sync flushes every written file, and the directory it is renamed into,
+	// to stable storage before the write returns. Otherwise that is left to
+	// Sync.
+	Sync bool
+}
+
+// Number of locks which writes to the same key are serialized on.
+const dirStoreLocks = 64
+
+// DirStore stores every key in a file of its own. Files are spread over two
+// levels of directories named after a hash of the key, as in ab/cd/KEY, and
+// file names are the keys with everything but letters, digits, '-' and '_'
+// escaped as %XX. Keys whose escaped form is longer than a file name can be
+// are not supported.
+//
+// Each write goes to a temporary file which is then renamed over the old one,
+// so a crash leaves either the old or the new value behind. Temporary files
+// start with a dot and are ignored.
+type DirStore struct {
+	root     string
+	opts     DirStoreOptions
+	lockFile *os.File
+	locks    [dirStoreLocks]sync.Mutex
+
+	// Files and directories written since the last Sync, when writes aren't
+	// synced as they happen.
+	unsyncedLock sync.Mutex
+	unsynced     map[string]bool
+
+	// Implements: KVStore, DeletableKVStore, ScannableKVStore, CASKVStore,
+	// SyncableKVStore
+}
+
+// OpenDirStore opens the store in the directory root, creating it if needed.
+// The store holds an exclusive lock on the directory until it is closed.
+func OpenDirStore(root string, opts DirStoreOptions) (*DirStore, error) {
+	if err := os.MkdirAll(root, 0770); err != nil {
+		return nil, err
+	}
+
+	f, err := openLocked(filepath.Join(root, "LOCK"), os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DirStore{root: root, opts: opts, lockFile: f,
+		unsynced: make(map[string]bool)}, nil
+}
+
+func escapeKey(key string) string {
+	if key == "" {
+		return "%"
+	}
+
+	var b bytes.Buffer
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func unescapeKey(name string) (string, error) {
+	if name == "%" {
+		return "", nil
+	}
+	return url.PathUnescape(name)
+}
+
+func (self *DirStore) hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (self *DirStore) path(key string) (dir, path string) {
+	h := self.hash(key)
+	dir = filepath.Join(self.root, fmt.Sprintf("%02x", h>>24), fmt.Sprintf("%02x", (h>>16)&0xff))
+	return dir, filepath.Join(dir, escapeKey(key))
+}
+
+func (self *DirStore) lock(key string) *sync.Mutex {
+	return &self.locks[self.hash(key)%dirStoreLocks]
+}
+
+func (self *DirStore) Get(key string, retry bool) ([]byte, error) {
+	if glog.V(2) {
+		glog.Infof("Get(%s)\n", key)
+	}
+
+	_, path := self.path(key)
+	value, err := self.read(path)
+	if err != nil && err != ErrNotFound {
+		return nil, &StoreError{Class: Permanent, Op: "get", Key: key, Err: err}
+	}
+	return value, err
+}
+
+func (self *DirStore) read(path string) ([]byte, error) {
+	value, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if value == nil {
+		// Distinguish an empty value from a missing one.
+		value = []byte{}
+	}
+	return value, nil
+}
+
+func (self *DirStore) Set(key string, value []byte) error {
+	if glog.V(2) {
+		glog.Infof("Set(%s)\n", key)
+	}
+
+	l := self.lock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	return self.set(key, value)
+}
+
+// set writes or, for a nil value, deletes key. The caller must hold the
+// key's lock.
+func (self *DirStore) set(key string, value []byte) error {
+	dir, path := self.path(key)
+
+	if value == nil {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return &StoreError{Class: Permanent, Op: "delete", Key: key, Err: err}
+		}
+		return self.synced("delete", key, dir)
+	}
+
+	if err := self.write(dir, path, value); err != nil {
+		return &StoreError{Class: Permanent, Op: "set", Key: key, Err: err}
+	}
+	return self.synced("set", key, dir, path)
+}
+
+func (self *DirStore) write(dir, path string, value []byte) error {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(value)
+	if err == nil && self.opts.Sync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// synced makes the given files and directories durable, or remembers them
+// for the next Sync.
+func (self *DirStore) synced(op, key string, paths ...string) error {
+	if !self.opts.Sync {
+		self.unsyncedLock.Lock()
+		for _, path := range paths {
+			self.unsynced[path] = true
+		}
+		self.unsyncedLock.Unlock()
+		return nil
+	}
+
+	// Files were synced before they were renamed; only the directory is left.
+	if err := syncDir(paths[0]); err != nil {
+		return &StoreError{Class: Permanent, Op: op, Key: key, Err: err}
+	}
+	return nil
+}
+
+func (self *DirStore) Delete(key string) error {
+	return self.Set(key, nil)
+}
+
+func (self *DirStore) CompareAndSet(key string, expected, value []byte) error {
+	l := self.lock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	_, path := self.path(key)
+	current, err := self.read(path)
+	if err != nil && err != ErrNotFound {
+		return &StoreError{Class: Permanent, Op: "get", Key: key, Err: err}
+	}
+
+	if (err == nil) != (expected != nil) || !bytes.Equal(current, expected) {
+		return ErrConflict
+	}
+
+	return self.set(key, value)
+}
+
+func (self *DirStore) Scan(start, end string, visit ScanFunc) error {
+	var keys []string
+	err := self.walk(func(name string) {
+		key, err := unescapeKey(name)
+		if err != nil {
+			glog.Warningf("Ignoring unexpected file %s in %s", name, self.root)
+			return
+		}
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	})
+	if err != nil {
+		return &StoreError{Class: Permanent, Op: "scan", Key: start, Err: err}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, err := self.Get(key, false)
+		if err == ErrNotFound {
+			// Deleted since the keys were collected.
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !visit(key, value) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// walk calls fn with the name of every file in the fan-out directories,
+// except for temporary files.
+func (self *DirStore) walk(fn func(name string)) error {
+	level1, err := readDirNames(self.root)
+	if err != nil {
+		return err
+	}
+
+	for _, d1 := range level1 {
+		if !isFanoutDir(d1) {
+			continue
+		}
+		level2, err := readDirNames(filepath.Join(self.root, d1))
+		if err != nil {
+			return err
+		}
+
+		for _, d2 := range level2 {
+			if !isFanoutDir(d2) {
+				continue
+			}
+			names, err := readDirNames(filepath.Join(self.root, d1, d2))
+			if err != nil {
+				return err
+			}
+
+			for _, name := range names {
+				if name[0] != '.' {
+					fn(name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isFanoutDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// readDirNames lists the directory at path, which is treated as empty if it
+// doesn't exist.
+func readDirNames(path string) ([]string, error) {
+	d, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	return d.Readdirnames(-1)
+}
+
+// Sync makes every write completed so far durable. Stores which sync every
+// write have nothing to do.
+func (self *DirStore) Sync() error {
+	self.unsyncedLock.Lock()
+	paths := self.unsynced
+	self.unsynced = make(map[string]bool)
+	self.unsyncedLock.Unlock()
+
+	// Sync files before the directories they were renamed into.
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+
+	for i, path := range sorted {
+		// syncDir works just as well for files.
+		err := syncDir(path)
+		if os.IsNotExist(err) {
+			// Replaced or deleted since; whatever replaced it is listed too.
+			continue
+		} else if err != nil {
+			// Try again next time.
+			self.unsyncedLock.Lock()
+			for _, path := range sorted[i:] {
+				self.unsynced[path] = true
+			}
+			self.unsyncedLock.Unlock()
+			return &StoreError{Class: Permanent, Op: "sync", Key: path, Err: err}
+		}
+	}
+	return nil
+}
+
+// Close syncs the store and releases its directory.
+func (self *DirStore) Close() error {
+	err := self.Sync()
+	self.lockFile.Close()
+	return err
+}
+
+var _ KVStore = new(DirStore)
+var _ DeletableKVStore = new(DirStore)
+var _ CASKVStore = new(DirStore)
+var _ SyncableKVStore = new(DirStore)
+var _ ScannableKVStore = new(DirStore)
@@ -0,0 +1,82 @@
+package gobuddyfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := gobuddyfs.OpenDirStore(dir, gobuddyfs.DirStoreOptions{})
+	assert.NoError(t, err)
+
+	keys := []string{"", "..", "12345", "ROOT", "a/b", "b%20", "\xff"}
+	for _, key := range keys {
+		assert.NoError(t, s.Set(key, []byte("v"+key)))
+	}
+	assert.NoError(t, s.Set("empty", []byte{}))
+
+	for _, key := range keys {
+		r, err := s.Get(key, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v"+key), r)
+	}
+	r, err := s.Get("empty", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, r)
+
+	assert.NoError(t, s.Set("ROOT", nil))
+	assert.NoError(t, s.Delete("missing"))
+	_, err = s.Get("ROOT", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+
+	assert.Equal(t, gobuddyfs.ErrConflict, s.CompareAndSet("ROOT", []byte("vROOT"), []byte("x")))
+	assert.NoError(t, s.CompareAndSet("ROOT", nil, []byte("x")))
+	assert.Equal(t, gobuddyfs.ErrConflict, s.CompareAndSet("ROOT", nil, []byte("y")))
+	assert.NoError(t, s.CompareAndSet("ROOT", []byte("x"), nil))
+
+	// Leftover temporary files are ignored.
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "00", "00"), 0770))
+	_, err = ioutil.TempFile(filepath.Join(dir, "00", "00"), ".tmp-")
+	assert.NoError(t, err)
+
+	found := []string{}
+	err = s.Scan("", "b", func(key string, value []byte) bool {
+		assert.Equal(t, "v"+key, string(value))
+		found = append(found, key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "..", "12345", "a/b"}, found)
+	assert.NoError(t, s.Close())
+}
+
+func TestDirStoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := gobuddyfs.OpenDirStore(dir, gobuddyfs.DirStoreOptions{Sync: true})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set("Foo", []byte("bar")))
+
+	// The directory can only be used by one store at a time.
+	_, err = gobuddyfs.OpenDirStore(dir, gobuddyfs.DirStoreOptions{})
+	assert.True(t, isLocked(err))
+	assert.NoError(t, s.Close())
+
+	s, err = gobuddyfs.OpenDirStore(dir, gobuddyfs.DirStoreOptions{})
+	assert.NoError(t, err)
+	r, err := s.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), r)
+	assert.NoError(t, s.Close())
+}
@@ -0,0 +1,596 @@
+package gobuddyfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/net/context"
+)
+
+// Every encrypted value starts with a version byte, the id of the data key it
+// was encrypted with and the nonce, followed by the AES-GCM ciphertext. Both
+// the header and the key the value is stored under are authenticated, so a
+// value can't be moved to another key or altered without notice.
+const (
+	encryptionVersion = 1
+	encryptionHeader  = 1 + 4 + 12
+)
+
+// The keyring is stored under this key unless the options name another one.
+const defaultKeyringKey = "KEYRING"
+
+// Cost parameters for deriving the key-encryption key from the secret.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrWrongSecret is returned when the secret doesn't unlock the keyring.
+var ErrWrongSecret = errors.New("wrong passphrase or key file")
+
+var errReservedKey = errors.New("key is reserved for the keyring")
+
+// EncryptionOptions controls how an EncryptedKVStore keeps its keys.
+type EncryptionOptions struct {
+	// KeyringKey is the key the keyring is stored under. Defaults to KEYRING.
+	KeyringKey string
+}
+
+type wrappedKey struct {
+	ID uint32
+	// Nonce followed by the data key, sealed with the key-encryption key.
+	Key []byte
+}
+
+// keyring is stored in the underlying store as JSON. It holds the data keys,
+// encrypted with a key derived from the secret with scrypt.
+type keyring struct {
+	Salt    []byte
+	N, R, P int
+	Current uint32
+	Keys    []wrappedKey
+}
+
+// EncryptedKVStore encrypts every value with AES-GCM before passing it on to
+// the underlying store. Values are encrypted with random data keys, which are
+// kept in a keyring in the store itself, encrypted with a key derived from a
+// passphrase or the contents of a key file.
+//
+// Rotate adds a new data key, which is used for every later write, and
+// Reencrypt rewrites the values still encrypted with older ones. Older keys
+// stay in the keyring, so that values written by mounts which haven't seen
+// the new key yet can still be read. ChangeSecret encrypts the keyring with a
+// new secret.
+type EncryptedKVStore struct {
+	store      KVStore
+	keyringKey string
+
+	lock sync.RWMutex
+	// The keyring as last read from the store.
+	raw  []byte
+	ring keyring
+	kek  []byte
+	keys map[uint32]cipher.AEAD
+
+	// Implements: KVStore, ContextKVStore, DeletableKVStore, ScannableKVStore,
+	// CASKVStore, SyncableKVStore
+}
+
+// OpenEncryptedKVStore unlocks the keyring in store with secret, creating the
+// keyring if the store has none.
+func OpenEncryptedKVStore(store KVStore, secret []byte, opts EncryptionOptions) (*EncryptedKVStore, error) {
+	if opts.KeyringKey == "" {
+		opts.KeyringKey = defaultKeyringKey
+	}
+
+	self := &EncryptedKVStore{store: store, keyringKey: opts.KeyringKey}
+	for {
+		err := self.reload(secret)
+		if err != ErrNotFound {
+			if err != nil {
+				return nil, err
+			}
+			return self, nil
+		}
+
+		ring := keyring{N: scryptN, R: scryptR, P: scryptP}
+		if ring.Salt, err = randomBytes(16); err != nil {
+			return nil, err
+		}
+		kek, err := deriveKey(secret, &ring)
+		if err != nil {
+			return nil, err
+		}
+		if err := addDataKey(&ring, kek); err != nil {
+			return nil, err
+		}
+
+		err = self.storeKeyring(nil, &ring)
+		if err == nil {
+			glog.Infof("Created keyring %s", self.keyringKey)
+		} else if err != ErrConflict {
+			return nil, err
+		}
+		// Read back what was stored, by us or by someone faster.
+	}
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func deriveKey(secret []byte, ring *keyring) ([]byte, error) {
+	return scrypt.Key(secret, ring.Salt, ring.N, ring.R, ring.P, 32)
+}
+
+// wrapAD binds a wrapped data key to its id.
+func wrapAD(id uint32) []byte {
+	ad := []byte("buddyfs key ....")
+	binary.BigEndian.PutUint32(ad[len(ad)-4:], id)
+	return ad
+}
+
+func wrapKey(kek []byte, id uint32, key []byte) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, wrapAD(id)), nil
+}
+
+func unwrapKey(kek []byte, wk wrappedKey) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wk.Key) < aead.NonceSize() {
+		return nil, ErrWrongSecret
+	}
+	nonce, sealed := wk.Key[:aead.NonceSize()], wk.Key[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, wrapAD(wk.ID))
+	if err != nil {
+		return nil, ErrWrongSecret
+	}
+	return key, nil
+}
+
+// addDataKey adds a new random data key to ring and makes it the current one.
+func addDataKey(ring *keyring, kek []byte) error {
+	key, err := randomBytes(32)
+	if err != nil {
+		return err
+	}
+
+	id := uint32(1)
+	for _, wk := range ring.Keys {
+		if wk.ID >= id {
+			id = wk.ID + 1
+		}
+	}
+
+	wrapped, err := wrapKey(kek, id, key)
+	if err != nil {
+		return err
+	}
+	ring.Keys = append(ring.Keys, wrappedKey{ID: id, Key: wrapped})
+	ring.Current = id
+	return nil
+}
+
+// reload reads the keyring from the store and unlocks its keys with a key
+// derived from secret. Without a secret, the key-encryption key of the keyring
+// read before is used.
+func (self *EncryptedKVStore) reload(secret []byte) error {
+	return self.load(secret, nil)
+}
+
+// load reads the keyring and unlocks it with kek, or with the key derived from
+// secret if kek is nil, or with the current key if both are.
+func (self *EncryptedKVStore) load(secret, kek []byte) error {
+	raw, err := kvGet(context.Background(), self.store, self.keyringKey, true)
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if secret == nil && kek == nil && bytes.Equal(raw, self.raw) {
+		return nil
+	}
+
+	var ring keyring
+	if err := json.Unmarshal(raw, &ring); err != nil {
+		return &StoreError{Class: Corrupt, Op: "keyring", Key: self.keyringKey, Err: err}
+	}
+
+	if kek == nil {
+		kek = self.kek
+		if secret != nil {
+			if kek, err = deriveKey(secret, &ring); err != nil {
+				return err
+			}
+		}
+	}
+
+	// If another mount changed the secret, the keys can't be unwrapped
+	// any more, and the store has to be opened with the new secret.
+	keys := make(map[uint32]cipher.AEAD, len(ring.Keys))
+	for _, wk := range ring.Keys {
+		key, err := unwrapKey(kek, wk)
+		if err != nil {
+			return err
+		}
+		if keys[wk.ID], err = newGCM(key); err != nil {
+			return err
+		}
+	}
+	if keys[ring.Current] == nil {
+		return &StoreError{Class: Corrupt, Op: "keyring", Key: self.keyringKey,
+			Err: errors.New("current key missing")}
+	}
+
+	self.raw, self.ring, self.kek, self.keys = raw, ring, kek, keys
+	return nil
+}
+
+// storeKeyring replaces the keyring in the store, if it is still old.
+func (self *EncryptedKVStore) storeKeyring(old []byte, ring *keyring) error {
+	raw, err := json.Marshal(ring)
+	if err != nil {
+		return err
+	}
+	return kvCompareAndSet(context.Background(), self.store, self.keyringKey, old, raw)
+}
+
+// updateKeyring applies update to the current keyring until it is stored
+// without a concurrent change getting in the way.
+func (self *EncryptedKVStore) updateKeyring(update func(ring *keyring, kek []byte) ([]byte, error)) error {
+	for {
+		self.lock.RLock()
+		old := self.raw
+		ring := self.ring
+		ring.Keys = append([]wrappedKey(nil), ring.Keys...)
+		kek := self.kek
+		self.lock.RUnlock()
+
+		newKEK, err := update(&ring, kek)
+		if err != nil {
+			return err
+		}
+
+		err = self.storeKeyring(old, &ring)
+		if err == nil {
+			return self.load(nil, newKEK)
+		} else if err != ErrConflict {
+			return err
+		}
+
+		if err := self.reload(nil); err != nil {
+			return err
+		}
+	}
+}
+
+// Rotate adds a new data key to the keyring, and uses it for every later
+// write.
+func (self *EncryptedKVStore) Rotate() error {
+	err := self.updateKeyring(func(ring *keyring, kek []byte) ([]byte, error) {
+		return kek, addDataKey(ring, kek)
+	})
+	if err == nil {
+		glog.Infof("Rotated to data key %d", self.currentID())
+	}
+	return err
+}
+
+// ChangeSecret encrypts the keyring's data keys with a key derived from
+// secret instead of the current one.
+func (self *EncryptedKVStore) ChangeSecret(secret []byte) error {
+	return self.updateKeyring(func(ring *keyring, kek []byte) ([]byte, error) {
+		salt, err := randomBytes(16)
+		if err != nil {
+			return nil, err
+		}
+
+		newRing := keyring{Salt: salt, N: scryptN, R: scryptR, P: scryptP, Current: ring.Current}
+		newKEK, err := deriveKey(secret, &newRing)
+		if err != nil {
+			return nil, err
+		}
+		for _, wk := range ring.Keys {
+			key, err := unwrapKey(kek, wk)
+			if err != nil {
+				return nil, err
+			}
+			wrapped, err := wrapKey(newKEK, wk.ID, key)
+			if err != nil {
+				return nil, err
+			}
+			newRing.Keys = append(newRing.Keys, wrappedKey{ID: wk.ID, Key: wrapped})
+		}
+
+		*ring = newRing
+		return newKEK, nil
+	})
+}
+
+// KeyMaterial returns a key derived from the keyring's first data key, for
+// keys which must outlive rotations and changes of the secret, such as
+// BuddyFS.KeyMaterial.
+func (self *EncryptedKVStore) KeyMaterial() ([]byte, error) {
+	self.lock.RLock()
+	first := self.ring.Keys[0]
+	for _, wk := range self.ring.Keys {
+		if wk.ID < first.ID {
+			first = wk
+		}
+	}
+	kek := self.kek
+	self.lock.RUnlock()
+
+	key, err := unwrapKey(kek, first)
+	if err != nil {
+		return nil, err
+	}
+	material := make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("buddyfs key material")), material)
+	return material, err
+}
+
+func (self *EncryptedKVStore) currentID() uint32 {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.ring.Current
+}
+
+// dataKey returns the data key with the given id, reloading the keyring if
+// it was added since it was read.
+func (self *EncryptedKVStore) dataKey(id uint32) (cipher.AEAD, error) {
+	self.lock.RLock()
+	aead := self.keys[id]
+	self.lock.RUnlock()
+	if aead != nil {
+		return aead, nil
+	}
+
+	if err := self.reload(nil); err != nil {
+		return nil, err
+	}
+
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.keys[id], nil
+}
+
+func (self *EncryptedKVStore) encrypt(key string, value []byte) ([]byte, error) {
+	self.lock.RLock()
+	id := self.ring.Current
+	aead := self.keys[id]
+	self.lock.RUnlock()
+
+	header := make([]byte, encryptionHeader, encryptionHeader+len(value)+aead.Overhead())
+	header[0] = encryptionVersion
+	binary.BigEndian.PutUint32(header[1:], id)
+	nonce := header[5:encryptionHeader]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	ad := append(append([]byte(nil), header...), key...)
+	return aead.Seal(header, nonce, value, ad), nil
+}
+
+// decrypt returns the value stored under key, along with the id of the data
+// key it was encrypted with.
+func (self *EncryptedKVStore) decrypt(key string, stored []byte) ([]byte, uint32, error) {
+	if len(stored) < encryptionHeader || stored[0] != encryptionVersion {
+		return nil, 0, &StoreError{Class: Corrupt, Op: "decrypt", Key: key,
+			Err: errors.New("not an encrypted value")}
+	}
+
+	id := binary.BigEndian.Uint32(stored[1:])
+	aead, err := self.dataKey(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if aead == nil {
+		return nil, 0, &StoreError{Class: Corrupt, Op: "decrypt", Key: key,
+			Err: errors.New("unknown data key")}
+	}
+
+	header := stored[:encryptionHeader]
+	ad := append(append([]byte(nil), header...), key...)
+	value, err := aead.Open(nil, header[5:], stored[encryptionHeader:], ad)
+	if err != nil {
+		return nil, 0, &StoreError{Class: Corrupt, Op: "decrypt", Key: key, Err: err}
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, id, nil
+}
+
+func (self *EncryptedKVStore) Get(key string, retry bool) ([]byte, error) {
+	return self.GetContext(context.Background(), key, retry)
+}
+
+func (self *EncryptedKVStore) Set(key string, value []byte) error {
+	return self.SetContext(context.Background(), key, value)
+}
+
+func (self *EncryptedKVStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	if key == self.keyringKey {
+		return nil, ErrNotFound
+	}
+
+	stored, err := kvGet(ctx, self.store, key, retry)
+	if err != nil {
+		return nil, err
+	}
+	value, _, err := self.decrypt(key, stored)
+	return value, err
+}
+
+func (self *EncryptedKVStore) SetContext(ctx context.Context, key string, value []byte) error {
+	if key == self.keyringKey {
+		return &StoreError{Class: Permanent, Op: "set", Key: key, Err: errReservedKey}
+	}
+	if value == nil {
+		return kvDelete(ctx, self.store, key)
+	}
+
+	stored, err := self.encrypt(key, value)
+	if err != nil {
+		return err
+	}
+	return kvSet(ctx, self.store, key, stored)
+}
+
+func (self *EncryptedKVStore) Delete(key string) error {
+	return self.SetContext(context.Background(), key, nil)
+}
+
+// CompareAndSet compares against the decrypted value. Encryption is not
+// deterministic, so the stored value is read first and replaced only if it is
+// still the one which was compared.
+func (self *EncryptedKVStore) CompareAndSet(key string, expected, value []byte) error {
+	ctx := context.Background()
+	if key == self.keyringKey {
+		return &StoreError{Class: Permanent, Op: "cas", Key: key, Err: errReservedKey}
+	}
+
+	stored, err := kvGet(ctx, self.store, key, true)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	if err == nil {
+		current, _, err := self.decrypt(key, stored)
+		if err != nil {
+			return err
+		}
+		if expected == nil || !bytes.Equal(current, expected) {
+			return ErrConflict
+		}
+	} else if expected != nil {
+		return ErrConflict
+	}
+
+	var newStored []byte
+	if value != nil {
+		if newStored, err = self.encrypt(key, value); err != nil {
+			return err
+		}
+	}
+	return kvCompareAndSet(ctx, self.store, key, stored, newStored)
+}
+
+// Scan visits the decrypted values, leaving out the keyring.
+func (self *EncryptedKVStore) Scan(start, end string, visit ScanFunc) error {
+	var err error
+	scanErr := Scan(self.store, start, end, func(key string, stored []byte) bool {
+		if key == self.keyringKey {
+			return true
+		}
+
+		var value []byte
+		if value, _, err = self.decrypt(key, stored); err != nil {
+			return false
+		}
+		return visit(key, value)
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+	return err
+}
+
+// Reencrypt rewrites every value which isn't encrypted with the current data
+// key, and returns how many it rewrote. Values changed concurrently are left
+// to the writer which changed them.
+func (self *EncryptedKVStore) Reencrypt() (int, error) {
+	ctx := context.Background()
+	current := self.currentID()
+
+	var keys []string
+	err := Scan(self.store, "", "", func(key string, stored []byte) bool {
+		if key != self.keyringKey && (len(stored) < encryptionHeader ||
+			binary.BigEndian.Uint32(stored[1:]) != current) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, key := range keys {
+		stored, err := kvGet(ctx, self.store, key, true)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return rewritten, err
+		}
+
+		value, id, err := self.decrypt(key, stored)
+		if err != nil {
+			return rewritten, err
+		}
+		if id == current {
+			continue
+		}
+
+		newStored, err := self.encrypt(key, value)
+		if err != nil {
+			return rewritten, err
+		}
+		err = kvCompareAndSet(ctx, self.store, key, stored, newStored)
+		if err == nil {
+			rewritten++
+		} else if err != ErrConflict {
+			return rewritten, err
+		}
+	}
+	return rewritten, nil
+}
+
+func (self *EncryptedKVStore) Sync() error {
+	return kvSync(context.Background(), self.store)
+}
+
+var _ KVStore = new(EncryptedKVStore)
+var _ ContextKVStore = new(EncryptedKVStore)
+var _ DeletableKVStore = new(EncryptedKVStore)
+var _ CASKVStore = new(EncryptedKVStore)
+var _ SyncableKVStore = new(EncryptedKVStore)
+var _ ScannableKVStore = new(EncryptedKVStore)
@@ -0,0 +1,107 @@
+package gobuddyfs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	mem := gobuddyfs.NewMemStore()
+	s, err := gobuddyfs.OpenEncryptedKVStore(mem, []byte("secret"), gobuddyfs.EncryptionOptions{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Set("1", []byte("hello")))
+	assert.NoError(t, s.Set("2", []byte("world")))
+	assert.True(t, hasValue(s, "1", []byte("hello"))())
+
+	stored, err := mem.Get("1", false)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(stored, []byte("hello")))
+	_, err = mem.Get("KEYRING", false)
+	assert.NoError(t, err)
+
+	// Values are bound to their keys.
+	assert.NoError(t, mem.Set("2", stored))
+	_, err = s.Get("2", false)
+	assert.True(t, gobuddyfs.IsCorrupt(err))
+	assert.NoError(t, s.Set("2", []byte("world")))
+
+	assert.Equal(t, gobuddyfs.ErrConflict, s.CompareAndSet("1", []byte("x"), []byte("y")))
+	assert.NoError(t, s.CompareAndSet("1", []byte("hello"), []byte("bye")))
+	assert.NoError(t, s.CompareAndSet("3", nil, []byte("new")))
+	assert.NoError(t, s.Delete("3"))
+	_, err = s.Get("3", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+
+	var keys []string
+	assert.NoError(t, s.Scan("", "", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	assert.Equal(t, []string{"1", "2"}, keys)
+
+	_, err = gobuddyfs.OpenEncryptedKVStore(mem, []byte("guess"), gobuddyfs.EncryptionOptions{})
+	assert.Equal(t, gobuddyfs.ErrWrongSecret, err)
+}
+
+func TestEncryptedRotate(t *testing.T) {
+	mem := gobuddyfs.NewMemStore()
+	opts := gobuddyfs.EncryptionOptions{KeyringKey: "keys"}
+	s, err := gobuddyfs.OpenEncryptedKVStore(mem, []byte("old"), opts)
+	assert.NoError(t, err)
+	other, err := gobuddyfs.OpenEncryptedKVStore(mem, []byte("old"), opts)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Set("a", []byte("a")))
+	assert.NoError(t, s.Set("b", []byte("b")))
+	before, _ := mem.Get("a", false)
+
+	assert.NoError(t, s.Rotate())
+	assert.NoError(t, s.Set("c", []byte("c")))
+	n, err := s.Reencrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	after, _ := mem.Get("a", false)
+	assert.NotEqual(t, before[:5], after[:5])
+
+	// A mount which hasn't seen the new key picks it up.
+	assert.True(t, hasValue(other, "a", []byte("a"))())
+	assert.True(t, hasValue(other, "c", []byte("c"))())
+
+	assert.NoError(t, s.ChangeSecret([]byte("new")))
+	assert.True(t, hasValue(s, "b", []byte("b"))())
+	_, err = gobuddyfs.OpenEncryptedKVStore(mem, []byte("old"), opts)
+	assert.Equal(t, gobuddyfs.ErrWrongSecret, err)
+	s, err = gobuddyfs.OpenEncryptedKVStore(mem, []byte("new"), opts)
+	assert.NoError(t, err)
+	assert.True(t, hasValue(s, "c", []byte("c"))())
+}
+
+func TestEncryptedKeyMaterial(t *testing.T) {
+	mem := gobuddyfs.NewMemStore()
+	s, err := gobuddyfs.OpenEncryptedKVStore(mem, []byte("old"), gobuddyfs.EncryptionOptions{})
+	assert.NoError(t, err)
+	material, err := s.KeyMaterial()
+	assert.NoError(t, err)
+	assert.Len(t, material, 32)
+
+	// It outlives rotations and changes of the secret.
+	assert.NoError(t, s.Rotate())
+	assert.NoError(t, s.ChangeSecret([]byte("new")))
+	s, err = gobuddyfs.OpenEncryptedKVStore(mem, []byte("new"), gobuddyfs.EncryptionOptions{})
+	assert.NoError(t, err)
+	now, err := s.KeyMaterial()
+	assert.NoError(t, err)
+	assert.Equal(t, material, now)
+
+	// But every keyring has its own.
+	other, err := gobuddyfs.OpenEncryptedKVStore(gobuddyfs.NewMemStore(), []byte("new"),
+		gobuddyfs.EncryptionOptions{})
+	assert.NoError(t, err)
+	theirs, err := other.KeyMaterial()
+	assert.NoError(t, err)
+	assert.NotEqual(t, material, theirs)
+}
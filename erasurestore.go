@@ -0,0 +1,488 @@
+package gobuddyfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Every shard starts with the length of the whole value, the version of the
+// write which stored it, a CRC32 of the whole value and one of the shard's
+// data, all big-endian. Shards from the same write share the first three.
+const shardHeader = 24
+
+// Number of locks which writes to the same key are serialized on.
+const erasureLocks = 64
+
+// A write's version is one more than the highest found on the key's shards
+// when it was made. Writes made from different stores on the same version are
+// told apart, and ordered, by the checksum of their values.
+type shardVersion struct {
+	length int
+	stamp  int64
+	sum    uint32
+}
+
+func (v shardVersion) newer(other shardVersion) bool {
+	if v.stamp != other.stamp {
+		return v.stamp > other.stamp
+	}
+	if v.sum != other.sum {
+		return v.sum > other.sum
+	}
+	return v.length > other.length
+}
+
+// ErasureKVStore splits every value into data shards and adds parity shards
+// computed with a Reed-Solomon code, so that the value can be reconstructed
+// from any set of shards as large as the number of data shards. Shard i of a
+// key is stored under key/i in child i, wrapping around when there are fewer
+// children than shards.
+//
+// A write succeeds once a quorum of shards are stored, by default one more than
+// is needed to reconstruct the value, so that it survives the loss of a shard.
+// Shards which were missed, damaged or left over from an older write are
+// rewritten when the key is next read, and those a delete left behind are
+// removed. Compare-and-set is only atomic with
+// respect to other writes through the same ErasureKVStore.
+type ErasureKVStore struct {
+	children []KVStore
+	rs       *reedSolomon
+	quorum   int
+	locks    [erasureLocks]sync.Mutex
+
+	// Implements: KVStore, ContextKVStore, DeletableKVStore, ScannableKVStore,
+	// CASKVStore, SyncableKVStore
+}
+
+// NewErasureKVStore spreads dataShards data and parityShards parity shards of
+// every value over children. Writes must store quorum shards; a quorum outside
+// dataShards..dataShards+parityShards requires dataShards+1 of them, or all if
+// there is no parity.
+func NewErasureKVStore(children []KVStore, dataShards, parityShards, quorum int) (*ErasureKVStore, error) {
+	if len(children) == 0 {
+		return nil, errors.New("no child stores")
+	}
+
+	rs, err := newReedSolomon(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	if quorum < rs.k || quorum > rs.k+rs.m {
+		quorum = min(rs.k+1, rs.k+rs.m)
+	}
+	return &ErasureKVStore{children: children, rs: rs, quorum: quorum}, nil
+}
+
+func (self *ErasureKVStore) shards() int {
+	return self.rs.k + self.rs.m
+}
+
+func (self *ErasureKVStore) child(shard int) KVStore {
+	return self.children[shard%len(self.children)]
+}
+
+func shardKey(key string, shard int) string {
+	return key + "/" + strconv.Itoa(shard)
+}
+
+func (self *ErasureKVStore) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &self.locks[h.Sum32()%erasureLocks]
+}
+
+func encodeShard(v shardVersion, data []byte) []byte {
+	shard := make([]byte, shardHeader+len(data))
+	binary.BigEndian.PutUint64(shard, uint64(v.length))
+	binary.BigEndian.PutUint64(shard[8:], uint64(v.stamp))
+	binary.BigEndian.PutUint32(shard[16:], v.sum)
+	binary.BigEndian.PutUint32(shard[20:], crc32.ChecksumIEEE(data))
+	copy(shard[shardHeader:], data)
+	return shard
+}
+
+func decodeShard(shard []byte) (shardVersion, []byte, bool) {
+	if len(shard) < shardHeader {
+		return shardVersion{}, nil, false
+	}
+
+	data := shard[shardHeader:]
+	if binary.BigEndian.Uint32(shard[20:]) != crc32.ChecksumIEEE(data) {
+		return shardVersion{}, nil, false
+	}
+
+	v := shardVersion{length: int(binary.BigEndian.Uint64(shard)),
+		stamp: int64(binary.BigEndian.Uint64(shard[8:])),
+		sum:   binary.BigEndian.Uint32(shard[16:])}
+	return v, data, true
+}
+
+type shardResult struct {
+	shard int
+	value []byte
+	err   error
+}
+
+// each runs op for every shard in parallel.
+func (self *ErasureKVStore) each(op func(shard int) ([]byte, error)) []shardResult {
+	results := make(chan shardResult, self.shards())
+	for i := 0; i < self.shards(); i++ {
+		go func(i int) {
+			value, err := op(i)
+			results <- shardResult{i, value, err}
+		}(i)
+	}
+
+	all := make([]shardResult, self.shards())
+	for i := 0; i < self.shards(); i++ {
+		res := <-results
+		all[res.shard] = res
+	}
+	return all
+}
+
+func (self *ErasureKVStore) Get(key string, retry bool) ([]byte, error) {
+	return self.GetContext(context.Background(), key, retry)
+}
+
+func (self *ErasureKVStore) Set(key string, value []byte) error {
+	return self.SetContext(context.Background(), key, value)
+}
+
+func (self *ErasureKVStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	value, _, err := self.read(ctx, key, retry, true)
+	return value, err
+}
+
+// read reconstructs the value of key from the newest complete set of shards,
+// and repairs the shards which don't belong to it if asked to. It also returns
+// the highest version found on any shard, complete or not.
+//
+// Shards too few to make up any value are what a delete leaves behind, so the
+// key is taken not to exist, and they are deleted if repairs were asked for.
+func (self *ErasureKVStore) read(ctx context.Context, key string, retry, repair bool) ([]byte, int64, error) {
+	stored, versions, latest, firstErr := self.gather(ctx, key, retry)
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	newest := self.newest(versions)
+	if newest == nil {
+		if firstErr != nil {
+			// Some child might have had the missing shards.
+			return nil, latest, firstErr
+		}
+		if repair && anyShard(stored) {
+			self.dropLeftovers(ctx, key, retry)
+		}
+		return nil, latest, ErrNotFound
+	}
+
+	value, err := self.rs.decode(versions[*newest], newest.length)
+	if err != nil {
+		return nil, latest, &StoreError{Class: Corrupt, Op: "get", Key: key, Err: err}
+	}
+
+	if repair && firstErr == nil {
+		self.repair(ctx, key, *newest, value, versions[*newest], stored)
+	}
+	return value, latest, nil
+}
+
+// gather reads the shards of key, and sorts the undamaged ones by the write
+// which stored them. It also returns the first error met reading a shard.
+func (self *ErasureKVStore) gather(ctx context.Context, key string, retry bool) (
+	stored [][]byte, versions map[shardVersion][][]byte, latest int64, firstErr error) {
+	results := self.each(func(i int) ([]byte, error) {
+		return kvGet(ctx, self.child(i), shardKey(key, i), retry)
+	})
+
+	stored = make([][]byte, self.shards())
+	versions = make(map[shardVersion][][]byte)
+	for i, res := range results {
+		if res.err == ErrNotFound {
+			continue
+		} else if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+
+		stored[i] = res.value
+		v, data, ok := decodeShard(res.value)
+		if !ok {
+			glog.Warningf("Ignoring damaged shard %s", shardKey(key, i))
+			continue
+		}
+		latest = max(latest, v.stamp)
+		if versions[v] == nil {
+			versions[v] = make([][]byte, self.shards())
+		}
+		versions[v][i] = data
+	}
+
+	return stored, versions, latest, firstErr
+}
+
+// newest returns the newest write of which enough shards are left to
+// reconstruct the value, or nil.
+func (self *ErasureKVStore) newest(versions map[shardVersion][][]byte) *shardVersion {
+	var newest *shardVersion
+	for v, shards := range versions {
+		present := 0
+		for _, shard := range shards {
+			if shard != nil {
+				present++
+			}
+		}
+		if present >= self.rs.k && (newest == nil || v.newer(*newest)) {
+			v := v
+			newest = &v
+		}
+	}
+	return newest
+}
+
+func anyShard(stored [][]byte) bool {
+	for _, shard := range stored {
+		if shard != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// dropLeftovers deletes the shards of key if they are too few to make up any
+// value. It takes the key's lock, so that the shards of a write still in
+// progress through this store aren't taken for leftovers.
+func (self *ErasureKVStore) dropLeftovers(ctx context.Context, key string, retry bool) {
+	l := self.lock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	stored, versions, _, err := self.gather(ctx, key, retry)
+	if err != nil || ctx.Err() != nil || self.newest(versions) != nil {
+		return
+	}
+	for i, shard := range stored {
+		if shard == nil {
+			continue
+		}
+		err := kvCompareAndSet(ctx, self.child(i), shardKey(key, i), shard, nil)
+		if err != nil && err != ErrConflict {
+			glog.Warningf("Unable to delete leftover shard %s: %s", shardKey(key, i), err)
+		} else if err == nil && glog.V(1) {
+			glog.Infof("Deleted leftover shard %s", shardKey(key, i))
+		}
+	}
+}
+
+// repair rewrites the shards of key which are missing, damaged or left over
+// from an older write. Shards from a newer write may belong to one which is
+// still in progress, and are left alone. Rewrites are conditional on the
+// shard being as it was read, so that a concurrent write is never undone.
+func (self *ErasureKVStore) repair(ctx context.Context, key string, v shardVersion,
+	value []byte, current [][]byte, stored [][]byte) {
+	var shards [][]byte
+	for i := range current {
+		if current[i] != nil {
+			continue
+		}
+		if other, _, ok := decodeShard(stored[i]); ok && other.newer(v) {
+			continue
+		}
+		if shards == nil {
+			shards = self.rs.encode(value)
+		}
+
+		err := kvCompareAndSet(ctx, self.child(i), shardKey(key, i), stored[i],
+			encodeShard(v, shards[i]))
+		if err != nil && err != ErrConflict {
+			glog.Warningf("Unable to repair shard %s: %s", shardKey(key, i), err)
+		} else if err == nil && glog.V(1) {
+			glog.Infof("Repaired shard %s", shardKey(key, i))
+		}
+	}
+}
+
+func (self *ErasureKVStore) SetContext(ctx context.Context, key string, value []byte) error {
+	if value == nil {
+		return self.delete(ctx, key)
+	}
+
+	l := self.lock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	// Only the versions on the shards matter, whether or not they make up a
+	// value.
+	_, latest, err := self.read(ctx, key, false, false)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	return self.write(ctx, key, value, latest)
+}
+
+// write stores the shards of value, as a newer version than latest. The caller
+// must hold the key's lock.
+func (self *ErasureKVStore) write(ctx context.Context, key string, value []byte, latest int64) error {
+	v := shardVersion{length: len(value), stamp: latest + 1, sum: crc32.ChecksumIEEE(value)}
+	shards := self.rs.encode(value)
+
+	results := self.each(func(i int) ([]byte, error) {
+		return nil, kvSet(ctx, self.child(i), shardKey(key, i), encodeShard(v, shards[i]))
+	})
+	return self.checkQuorum("set", key, results, self.quorum)
+}
+
+// checkQuorum checks that at least need of the shard operations succeeded.
+func (self *ErasureKVStore) checkQuorum(op, key string, results []shardResult, need int) error {
+	var succeeded int
+	var firstErr error
+	for _, res := range results {
+		if res.err == nil {
+			succeeded++
+		} else if firstErr == nil {
+			firstErr = res.err
+		}
+	}
+
+	if succeeded >= need {
+		if firstErr != nil {
+			glog.Warningf("%s(%s) missed %d shards: %s", op, key,
+				len(results)-succeeded, firstErr)
+		}
+		return nil
+	}
+
+	if firstErr == context.Canceled || firstErr == context.DeadlineExceeded {
+		return firstErr
+	}
+	return &StoreError{Class: ErrorClassOf(firstErr), Op: op, Key: key,
+		Err: fmt.Errorf("%d of %d shards failed: %s", len(results)-succeeded,
+			len(results), firstErr)}
+}
+
+func (self *ErasureKVStore) Delete(key string) error {
+	return self.delete(context.Background(), key)
+}
+
+// delete removes the shards of key. Once fewer shards than are needed to
+// reconstruct the value are left, it is gone, and reads delete the rest.
+func (self *ErasureKVStore) delete(ctx context.Context, key string) error {
+	l := self.lock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	results := self.each(func(i int) ([]byte, error) {
+		return nil, kvDelete(ctx, self.child(i), shardKey(key, i))
+	})
+	return self.checkQuorum("delete", key, results, self.rs.m+1)
+}
+
+func (self *ErasureKVStore) CompareAndSet(key string, expected, value []byte) error {
+	ctx := context.Background()
+
+	l := self.lock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	current, latest, err := self.read(ctx, key, true, false)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	if (err == nil) != (expected != nil) || !bytes.Equal(current, expected) {
+		return ErrConflict
+	}
+
+	if value == nil {
+		results := self.each(func(i int) ([]byte, error) {
+			return nil, kvDelete(ctx, self.child(i), shardKey(key, i))
+		})
+		return self.checkQuorum("delete", key, results, self.rs.m+1)
+	}
+	return self.write(ctx, key, value, latest)
+}
+
+// Scan visits the keys which have at least one shard stored.
+func (self *ErasureKVStore) Scan(start, end string, visit ScanFunc) error {
+	// key < end doesn't imply key/i < end if end continues with a character
+	// sorting before the separator, so such ranges are scanned to the end.
+	shardEnd := end
+	if strings.IndexFunc(end, func(r rune) bool { return r <= '/' }) >= 0 {
+		shardEnd = ""
+	}
+
+	keys := make(map[string]bool)
+	for i := 0; i < self.shards() && i < len(self.children); i++ {
+		err := Scan(self.children[i], start, shardEnd, func(sk string, value []byte) bool {
+			sep := strings.LastIndex(sk, "/")
+			if sep < 0 {
+				return true
+			}
+			shard, err := strconv.Atoi(sk[sep+1:])
+			if err != nil || shard%len(self.children) != i {
+				return true
+			}
+
+			key := sk[:sep]
+			if key >= start && (end == "" || key < end) {
+				keys[key] = true
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		value, err := self.Get(key, false)
+		if err == ErrNotFound {
+			// Deleted since the keys were collected.
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !visit(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (self *ErasureKVStore) Sync() error {
+	for _, child := range self.children {
+		if err := kvSync(context.Background(), child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ KVStore = new(ErasureKVStore)
+var _ ContextKVStore = new(ErasureKVStore)
+var _ DeletableKVStore = new(ErasureKVStore)
+var _ CASKVStore = new(ErasureKVStore)
+var _ SyncableKVStore = new(ErasureKVStore)
+var _ ScannableKVStore = new(ErasureKVStore)
@@ -0,0 +1,189 @@
+package gobuddyfs_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func newErasureTestStore(t *testing.T, data, parity int) (*gobuddyfs.ErasureKVStore, []*FlakyKVStore) {
+	var flaky []*FlakyKVStore
+	var children []gobuddyfs.KVStore
+	for i := 0; i < data+parity; i++ {
+		f := NewFlakyKVStore()
+		flaky = append(flaky, f)
+		children = append(children, f)
+	}
+
+	s, err := gobuddyfs.NewErasureKVStore(children, data, parity, 0)
+	assert.NoError(t, err)
+	return s, flaky
+}
+
+func TestErasureReconstruct(t *testing.T) {
+	s, children := newErasureTestStore(t, 3, 2)
+
+	values := map[string][]byte{"Empty": {}, "One": {42}}
+	for _, n := range []int{7, 4096, 10001} {
+		value := make([]byte, n)
+		rand.Read(value)
+		values[string(rune('A'+n%26))] = value
+	}
+	for key, value := range values {
+		assert.NoError(t, s.Set(key, value))
+	}
+
+	// Any two children can be lost.
+	for i := range children {
+		for j := i + 1; j < len(children); j++ {
+			children[i].SetDown(true)
+			children[j].SetDown(true)
+
+			for key, value := range values {
+				r, err := s.Get(key, false)
+				assert.NoError(t, err, "children %d and %d down", i, j)
+				assert.Equal(t, value, r)
+			}
+
+			children[i].SetDown(false)
+			children[j].SetDown(false)
+		}
+	}
+
+	// But not three.
+	for i := 0; i < 3; i++ {
+		children[i].SetDown(true)
+	}
+	_, err := s.Get("One", false)
+	assert.True(t, gobuddyfs.IsTransient(err))
+}
+
+func TestErasureRepair(t *testing.T) {
+	s, children := newErasureTestStore(t, 2, 2)
+	assert.NoError(t, s.Set("Foo", []byte("foobarbaz")))
+
+	// Lose one shard and damage another, then write a newer value while a
+	// child is down, leaving a shard of the old value behind.
+	children[0].MemStore.Delete("Foo/0")
+	r, err := s.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("foobarbaz"), r)
+	_, err = children[0].MemStore.Get("Foo/0", false)
+	assert.NoError(t, err)
+
+	shard, _ := children[1].MemStore.Get("Foo/1", false)
+	damaged := append([]byte(nil), shard...)
+	damaged[len(damaged)-1] ^= 1
+	children[1].MemStore.Set("Foo/1", damaged)
+	r, err = s.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("foobarbaz"), r)
+	repaired, _ := children[1].MemStore.Get("Foo/1", false)
+	assert.Equal(t, shard, repaired)
+
+	children[3].SetDown(true)
+	assert.NoError(t, s.Set("Foo", []byte("quux")))
+	children[3].SetDown(false)
+
+	r, err = s.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("quux"), r)
+
+	// All shards are current again, so any two of them will do.
+	children[0].SetDown(true)
+	children[1].SetDown(true)
+	r, err = s.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("quux"), r)
+}
+
+func TestErasureWriteQuorum(t *testing.T) {
+	s, children := newErasureTestStore(t, 2, 2)
+
+	// Two shards would be enough to read the value back, but not to survive
+	// the loss of one of them.
+	children[2].SetDown(true)
+	children[3].SetDown(true)
+	err := s.Set("Foo", []byte("foo"))
+	assert.True(t, gobuddyfs.IsTransient(err))
+
+	children[3].SetDown(false)
+	assert.NoError(t, s.Set("Foo", []byte("foo")))
+}
+
+// Writes from other stores over the same children are ordered by the versions
+// they find, not by the clocks of the machines making them.
+func TestErasureVersions(t *testing.T) {
+	s, children := newErasureTestStore(t, 2, 1)
+	other, err := gobuddyfs.NewErasureKVStore([]gobuddyfs.KVStore{children[0],
+		children[1], children[2]}, 2, 1, 0)
+	assert.NoError(t, err)
+
+	for i, value := range []string{"a", "b", "c", "d"} {
+		w := s
+		if i%2 == 1 {
+			w = other
+		}
+		assert.NoError(t, w.Set("Foo", []byte(value)))
+		for _, r := range []*gobuddyfs.ErasureKVStore{s, other} {
+			v, err := r.Get("Foo", false)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(value), v)
+		}
+	}
+}
+
+func TestErasureDeleteAndScan(t *testing.T) {
+	// Fewer children than shards: shards wrap around.
+	s, err := gobuddyfs.NewErasureKVStore([]gobuddyfs.KVStore{gobuddyfs.NewMemStore(),
+		gobuddyfs.NewMemStore()}, 2, 2, 0)
+	assert.NoError(t, err)
+
+	for _, key := range []string{"a", "b1", "b2", "c"} {
+		assert.NoError(t, s.Set(key, []byte(key)))
+	}
+	assert.NoError(t, s.Delete("b2"))
+	_, err = s.Get("b2", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+
+	assert.Equal(t, gobuddyfs.ErrConflict, s.CompareAndSet("a", nil, []byte("x")))
+	assert.NoError(t, s.CompareAndSet("a", []byte("a"), []byte("x")))
+
+	keys := []string{}
+	err = gobuddyfs.ScanPrefix(s, "b", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b1"}, keys)
+
+	keys = []string{}
+	err = s.Scan("", "", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b1", "c"}, keys)
+}
+
+func TestErasureDeleteLeftovers(t *testing.T) {
+	s, children := newErasureTestStore(t, 2, 2)
+	assert.NoError(t, s.Set("Foo", []byte("foo")))
+
+	// The delete reaches enough shards, but leaves one behind.
+	children[0].SetDown(true)
+	assert.NoError(t, s.Delete("Foo"))
+	children[0].SetDown(false)
+
+	_, err := s.Get("Foo", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+	_, err = children[0].Get("Foo/0", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+
+	assert.NoError(t, s.CompareAndSet("Foo", nil, []byte("bar")))
+	v, err := s.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), v)
+}
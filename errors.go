@@ -0,0 +1,34 @@
+package gobuddyfs
+
+import (
+	"syscall"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// fuseError converts an error returned by the storage layer into the error
+// reported back to the kernel. Errors which already carry an errno are passed
+// through unchanged.
+func fuseError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case ErrNotFound:
+		return fuse.ENOENT
+	case context.Canceled:
+		return fuse.EINTR
+	case context.DeadlineExceeded:
+		return fuse.Errno(syscall.ETIMEDOUT)
+	}
+
+	if _, ok := err.(fuse.ErrorNumber); ok {
+		return err
+	}
+
+	if err == ErrConflict || IsTransient(err) {
+		return fuse.Errno(syscall.EAGAIN)
+	}
+
+	return fuse.EIO
+}
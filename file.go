@@ -1,7 +1,11 @@
 package gobuddyfs
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
 
 	"bytes"
 
@@ -28,24 +32,84 @@ type File struct {
 	blkGen     BlockGenerator       `json:"-"`
 	BlockCache map[int64]*DataBlock `json:"-"`
 	BFS        *BuddyFS             `json:"-"`
+	nodes      *nodeTable
+	// Guards everything above, which is shared by every handle to the file.
+	Lock sync.Mutex `json:"-"`
+
+	// Hashes of content-addressed blocks the file no longer refers to, which
+	// are released once that is written out.
+	released [][]byte
+	// For a file split into chunks by content, the offset each chunk ends at.
+	chunkEnds []uint64
+	// Set once the file is removed, after which it is no longer written out.
+	removed bool
 }
 
+// The encoding of a file in a layout other than the original one starts with
+// fileTagged and the flags of the layout, where others start with the file's
+// size, which never has the top bit set.
+const (
+	fileTagged uint64 = 1 << 63
+	// Blocks are referred to by the hash of their contents.
+	fileContent uint64 = 1
+	// Every block is preceded by the length of its chunk.
+	fileChunked uint64 = 2
+)
+
 var _ Marshalable = new(File)
 
 func (file *File) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (fs.Handle, error) {
 	if glog.V(2) {
 		glog.Infoln("Open called")
 	}
-	return file, nil
+	return &FileHandle{File: file}, nil
+}
+
+// FileHandle is an open file. Every handle to a file shares the File's state,
+// so what is written through one can be read through the others before it is
+// flushed.
+type FileHandle struct {
+	File *File
+
+	// Implements: fs.Handle, fs.HandleReader, fs.HandleWriter, fs.HandleFlusher,
+	// fs.HandleReleaser
+}
+
+var _ fs.HandleReader = new(FileHandle)
+var _ fs.HandleWriter = new(FileHandle)
+var _ fs.HandleFlusher = new(FileHandle)
+var _ fs.HandleReleaser = new(FileHandle)
+
+func (h *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, res *fuse.ReadResponse) error {
+	return h.File.Read(ctx, req, res)
+}
+
+func (h *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, res *fuse.WriteResponse) error {
+	return h.File.Write(ctx, req, res)
+}
+
+func (h *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return h.File.Flush(ctx, req)
+}
+
+func (h *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if glog.V(2) {
+		glog.Infoln("Release", h.File.Name)
+	}
+	return nil
 }
 
-func (file *File) getBlock(index int64) *DataBlock {
+func (file *File) getBlock(ctx context.Context, index int64) (*DataBlock, error) {
 	if glog.V(2) {
 		glog.Infoln("GetBlock:", index)
 	}
 
-	if uint64(index) >= blkCount(file.Size, BLOCK_SIZE) {
-		return nil
+	count := blkCount(file.Size, BLOCK_SIZE)
+	if isChunked(file.KVS) {
+		count = uint64(len(file.Blocks))
+	}
+	if uint64(index) >= count {
+		return nil, nil
 	}
 
 	if file.BlockCache == nil {
@@ -57,18 +121,18 @@ func (file *File) getBlock(index int64) *DataBlock {
 	if file.BlockCache[blkId] == nil {
 		// TODO: This mechanism of fetching blocks from disk to cache makes testing
 		// harder. Find an alternate mechanism to do so.
-		startBlock := &DataBlock{StorageUnit: &Block{}}
+		startBlock := &DataBlock{StorageUnit: &Block{hash: blockHash(file.Blocks[index])}}
 		startBlock.SetId(blkId)
-		err := startBlock.ReadBlock(startBlock, file.KVS)
+		err := startBlock.ReadBlock(ctx, startBlock, file.KVS)
 		if err != nil {
 			glog.Errorf("Error while reading data block: %q", err)
-			return nil
+			return nil, err
 		}
 
 		file.BlockCache[blkId] = startBlock
 	}
 
-	return file.BlockCache[blkId]
+	return file.BlockCache[blkId], nil
 }
 
 func (file *File) appendBlock(dblk *DataBlock) {
@@ -90,7 +154,11 @@ func blkCount(size uint64, BLK_SIZE uint64) uint64 {
 
 // TODO: Should the return type be a standard error instead?
 // TODO: Unit tests!
-func (file *File) setSize(size uint64) error {
+func (file *File) setSize(ctx context.Context, size uint64) error {
+	if isChunked(file.KVS) {
+		return file.setSizeChunked(ctx, size)
+	}
+
 	newBlockCount := blkCount(size, BLOCK_SIZE)
 
 	if newBlockCount < uint64(len(file.Blocks)) {
@@ -102,14 +170,21 @@ func (file *File) setSize(size uint64) error {
 
 		for blk := range blocksToDelete {
 			delete(file.BlockCache, blocksToDelete[blk].GetId())
-			blocksToDelete[blk].Delete(file.KVS)
+			if hash := blockHash(blocksToDelete[blk]); hash != nil {
+				file.released = append(file.released, hash)
+			} else {
+				blocksToDelete[blk].Delete(ctx, file.KVS)
+			}
 		}
 	} else if newBlockCount > uint64(len(file.Blocks)) {
 		if glog.V(2) {
 			glog.Infoln("Increasing number of blocks to", newBlockCount)
 		}
 		for uint64(len(file.Blocks)) < newBlockCount {
-			blk := file.blkGen.NewBlock()
+			blk, err := file.blkGen.NewBlock(ctx)
+			if err != nil {
+				return err
+			}
 			dBlk := DataBlock{StorageUnit: blk, Data: []byte{}}
 			dBlk.MarkDirty()
 
@@ -134,15 +209,20 @@ func (file *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, res *fu
 		glog.Infoln("Req: ", req)
 	}
 
+	file.Lock.Lock()
+	defer file.Lock.Unlock()
+
 	metaChanges := false
 	valid := req.Valid
 	if valid.Size() && req.Size != file.Size {
-		file.setSize(req.Size)
+		if err := file.setSize(ctx, req.Size); err != nil {
+			return fuseError(err)
+		}
 		metaChanges = true
 	}
 
 	currAttr := fuse.Attr{}
-	file.Attr(ctx, &currAttr)
+	file.attr(&currAttr)
 	if res.Attr != currAttr {
 		res.Attr = currAttr
 		metaChanges = true
@@ -152,7 +232,7 @@ func (file *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, res *fu
 
 	if metaChanges {
 		// There are metadata changes to the file, write back before proceeding.
-		return file.Flush(ctx, nil)
+		return file.flush(ctx)
 	}
 
 	return nil
@@ -164,15 +244,32 @@ func (file *File) Write(ctx context.Context, req *fuse.WriteRequest, res *fuse.W
 		glog.Infof("Writing %d byte(s) at offset %d", dataBytes, req.Offset)
 	}
 
+	file.Lock.Lock()
+	defer file.Lock.Unlock()
+
+	if isChunked(file.KVS) {
+		n, err := file.writeChunked(ctx, uint64(req.Offset), req.Data)
+		if err != nil {
+			return fuseError(err)
+		}
+		res.Size = n
+		return nil
+	}
+
 	// In case we write past current EOF, expand the file.
 	if uint64(req.Offset)+uint64(dataBytes) > file.Size {
-		file.setSize(uint64(req.Offset) + uint64(dataBytes))
+		if err := file.setSize(ctx, uint64(req.Offset)+uint64(dataBytes)); err != nil {
+			return fuseError(err)
+		}
 	}
 
 	// TODO: Write currently only updates one block worth of data.
 	startBlockId := req.Offset / BLOCK_SIZE
 
-	var startBlock *DataBlock = file.getBlock(startBlockId)
+	startBlock, err := file.getBlock(ctx, startBlockId)
+	if err != nil {
+		return fuseError(err)
+	}
 
 	if glog.V(2) {
 		glog.Infof("Block content length: %d", len(startBlock.Data))
@@ -201,6 +298,17 @@ func (file *File) Write(ctx context.Context, req *fuse.WriteRequest, res *fuse.W
 }
 
 func (file *File) Marshal() ([]byte, error) {
+	var flags uint64
+	if isDedup(file.KVS) {
+		flags |= fileContent
+	}
+	if isChunked(file.KVS) {
+		flags |= fileChunked
+	}
+	if flags != 0 {
+		return file.marshalTagged(flags)
+	}
+
 	var buf = new(bytes.Buffer)
 
 	binary.Write(buf, binary.LittleEndian, &file.Size)
@@ -219,6 +327,10 @@ func (file *File) Marshal() ([]byte, error) {
 }
 
 func (file *File) Unmarshal(data []byte) error {
+	if len(data) >= 8 && binary.LittleEndian.Uint64(data)&fileTagged != 0 {
+		return file.unmarshalTagged(binary.LittleEndian.Uint64(data)&^fileTagged, data[8:])
+	}
+
 	var err error
 	var sz int64
 	rd := bytes.NewReader(data)
@@ -255,65 +367,136 @@ func (file *File) Unmarshal(data []byte) error {
 	return nil
 }
 
-func (file File) Attr(ctx context.Context, attr *fuse.Attr) error {
+func (file *File) Attr(ctx context.Context, attr *fuse.Attr) error {
 	if glog.V(2) {
 		glog.Infoln("Attr called", file.Name)
 	}
 
+	file.Lock.Lock()
+	defer file.Lock.Unlock()
+	file.attr(attr)
+	return nil
+}
+
+func (file *File) attr(attr *fuse.Attr) {
 	attr.Mode = 0444
+	// The inode is the block id, which may be handed out again once the file
+	// is removed. See the TODO on Dir.Lookup.
 	attr.Inode = uint64(file.Id)
 	attr.Blocks = uint64(len(file.Blocks))
 	attr.Size = file.Size
-
-	return nil
-}
-
-func (file *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	if glog.V(2) {
-		glog.Infoln("Release", file.Name)
-	}
-	return nil
 }
 
 func (file *File) Forget() {
 	if glog.V(2) {
 		glog.Infoln("FORGET", file.Name)
 	}
+	file.nodes.forget(file.Id, file)
 }
 
 func (file *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	file.Lock.Lock()
+	defer file.Lock.Unlock()
+	return file.flush(ctx)
+}
+
+func (file *File) flush(ctx context.Context) error {
 	if glog.V(2) {
 		glog.Infoln("FLUSH", file.Name, file.IsDirty())
 	}
-	for i := range file.BlockCache {
-		if file.BlockCache[i] != nil && file.BlockCache[i].IsDirty() {
-			err := file.BlockCache[i].WriteBlock(file.BlockCache[i], file.KVS)
-			if err != nil {
-				glog.Warning("Unable to write block %s due to error: %s",
-					file.Blocks[i].GetId(), err)
-			} else {
-				// TODO: Use an LRU cache to keep blocks in memory. Dropping dirty items
-				// as soon as they are written is wasteful. On the other hand, not
-				// dropping these items will fill up memory and cause OOMs for
-				// relatively small sized files.
+	if file.removed {
+		// Writes through handles still open stay in memory.
+		return nil
+	}
+	if isChunked(file.KVS) {
+		if err := file.rechunk(ctx); err != nil {
+			return fuseError(err)
+		}
+	}
 
-				file.BlockCache[i].MarkClean()
-				// file.BlockCache[i] = nil
+	var firstErr error
+	if isDedup(file.KVS) {
+		firstErr = file.flushContent(ctx)
+	} else {
+		for i := range file.BlockCache {
+			if file.BlockCache[i] != nil && file.BlockCache[i].IsDirty() {
+				err := file.BlockCache[i].WriteBlock(ctx, file.BlockCache[i], file.KVS)
+				if err != nil {
+					glog.Warningf("Unable to write block %d due to error: %s", i, err)
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					// TODO: Use an LRU cache to keep blocks in memory. Dropping dirty items
+					// as soon as they are written is wasteful. On the other hand, not
+					// dropping these items will fill up memory and cause OOMs for
+					// relatively small sized files.
+
+					file.BlockCache[i].MarkClean()
+					// file.BlockCache[i] = nil
+				}
 			}
 		}
 	}
 
+	if firstErr != nil {
+		// Don't write out metadata pointing at blocks which didn't make it.
+		return fuseError(firstErr)
+	}
+
 	if file.IsDirty() {
-		file.WriteBlock(file, file.KVS)
+		if err := file.WriteBlock(ctx, file, file.KVS); err != nil {
+			return fuseError(err)
+		}
 	}
+
+	file.releaseContent(ctx)
 	return nil
 }
 
+// releaseContent drops the references held in file.released.
+func (file *File) releaseContent(ctx context.Context) {
+	for len(file.released) > 0 {
+		if err := releaseContent(ctx, file.KVS, file.released[0]); err != nil {
+			// The block is leaked rather than released twice.
+			glog.Warningf("Unable to release data block: %s", err)
+		}
+		file.released = file.released[1:]
+	}
+}
+
+// remove drops the references of a file which was removed from its directory
+// to its content-addressed blocks.
+func (file *File) remove(ctx context.Context) {
+	file.Lock.Lock()
+	defer file.Lock.Unlock()
+
+	file.removed = true
+	if !isDedup(file.KVS) {
+		return
+	}
+	for _, su := range file.Blocks {
+		if hash := blockHash(su); hash != nil {
+			file.released = append(file.released, hash)
+		}
+	}
+	file.releaseContent(ctx)
+}
+
 func (file *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 	if glog.V(2) {
-		glog.Infoln("FSYNC", file.Name, file.IsDirty())
+		glog.Infoln("FSYNC", file.Name)
 	}
-	return file.Flush(ctx, nil)
+
+	file.Lock.Lock()
+	defer file.Lock.Unlock()
+	err := file.flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Flushing hands the blocks to the store, which may still be buffering them.
+	return fuseError(kvSync(ctx, file.KVS))
 }
 
 func (file *File) Read(ctx context.Context, req *fuse.ReadRequest, res *fuse.ReadResponse) error {
@@ -321,17 +504,31 @@ func (file *File) Read(ctx context.Context, req *fuse.ReadRequest, res *fuse.Rea
 		glog.Infof("Reading %d byte(s) at offset %d", req.Size, req.Offset)
 	}
 
+	file.Lock.Lock()
+	defer file.Lock.Unlock()
+
 	if req.Offset >= int64(file.Size) {
 		res.Data = []byte{}
 		return nil
 	}
 
+	if isChunked(file.KVS) {
+		data, err := file.readChunked(ctx, uint64(req.Offset), req.Size)
+		if err != nil {
+			return fuseError(err)
+		}
+		res.Data = data
+		return nil
+	}
+
 	res.Data = []byte{}
 
 	startBlockId := req.Offset / BLOCK_SIZE
 
-	var startBlock *DataBlock = file.getBlock(startBlockId)
-	if startBlock == nil {
+	startBlock, err := file.getBlock(ctx, startBlockId)
+	if err != nil {
+		return fuseError(err)
+	} else if startBlock == nil {
 		glog.Error("Error while reading block")
 		return fuse.EIO
 	}
@@ -346,3 +543,139 @@ func (file *File) Read(ctx context.Context, req *fuse.ReadRequest, res *fuse.Rea
 
 	return nil
 }
+
+// flushContent stores the file's dirty content-addressed blocks whose
+// contents changed, under their new hashes. The old ones are released once
+// the file refers to the new ones.
+func (file *File) flushContent(ctx context.Context) error {
+	var firstErr error
+	for _, su := range file.Blocks {
+		blk, ok := su.(*Block)
+		dBlk := file.BlockCache[su.GetId()]
+		if !ok || dBlk == nil || !dBlk.IsDirty() {
+			continue
+		}
+
+		hash := contentHash(dBlk.Data)
+		if !bytes.Equal(hash, blk.hash) {
+			if err := acquireContent(ctx, file.KVS, hash, dBlk.Data); err != nil {
+				glog.Warningf("Unable to write data block: %s", err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if blk.hash != nil {
+				file.released = append(file.released, blk.hash)
+			}
+			blk.hash = hash
+			file.MarkDirty()
+		}
+		dBlk.MarkClean()
+	}
+	return firstErr
+}
+
+// marshalTagged encodes a file in the layout the flags describe.
+func (file *File) marshalTagged(flags uint64) ([]byte, error) {
+	var buf = new(bytes.Buffer)
+
+	binary.Write(buf, binary.LittleEndian, fileTagged|flags)
+	binary.Write(buf, binary.LittleEndian, &file.Size)
+	binary.Write(buf, binary.LittleEndian, file.BlockSize)
+	binary.Write(buf, binary.LittleEndian, int64(len(file.Blocks)))
+
+	if flags&fileChunked != 0 && len(file.chunkEnds) != len(file.Blocks) {
+		return nil, errChunkSize
+	}
+
+	for i, blk := range file.Blocks {
+		if flags&fileChunked != 0 {
+			binary.Write(buf, binary.LittleEndian, uint32(file.chunkEnds[i]-file.chunkStart(i)))
+		}
+
+		if flags&fileContent != 0 {
+			hash := blockHash(blk)
+			if len(hash) != sha256.Size {
+				return nil, errors.New("data block was not written")
+			}
+			buf.Write(hash)
+		} else {
+			binary.Write(buf, binary.LittleEndian, blk.GetId())
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (file *File) unmarshalTagged(flags uint64, data []byte) error {
+	if flags&^(fileContent|fileChunked) != 0 {
+		return errors.New("unknown file layout")
+	}
+
+	var sz int64
+	rd := bytes.NewReader(data)
+
+	if err := binary.Read(rd, binary.LittleEndian, &file.Size); err != nil {
+		return err
+	}
+	if err := binary.Read(rd, binary.LittleEndian, &file.BlockSize); err != nil {
+		return err
+	}
+	if err := binary.Read(rd, binary.LittleEndian, &sz); err != nil {
+		return err
+	}
+
+	entrySize := 8
+	if flags&fileContent != 0 {
+		entrySize = sha256.Size
+	}
+	if flags&fileChunked != 0 {
+		entrySize += 4
+	}
+	if sz < 0 || sz > int64(rd.Len()/entrySize) {
+		return errors.New("invalid block count")
+	}
+
+	file.Blocks = make([]StorageUnit, sz)
+	file.chunkEnds = nil
+	if flags&fileChunked != 0 {
+		file.chunkEnds = make([]uint64, sz)
+	}
+
+	var offset uint64
+	for i := range file.Blocks {
+		if flags&fileChunked != 0 {
+			var length uint32
+			if err := binary.Read(rd, binary.LittleEndian, &length); err != nil {
+				return err
+			}
+			offset += uint64(length)
+			file.chunkEnds[i] = offset
+		}
+
+		if flags&fileContent != 0 {
+			// The blocks are known by their hashes in the store, but the block
+			// cache needs an id for each of them, which is only used in memory.
+			// Negative ones never clash with those allocated to new blocks.
+			hash := make([]byte, sha256.Size)
+			if _, err := io.ReadFull(rd, hash); err != nil {
+				return err
+			}
+			file.Blocks[i] = &Block{Id: -int64(i) - 1, hash: hash}
+		} else {
+			var blkId int64
+			if err := binary.Read(rd, binary.LittleEndian, &blkId); err != nil {
+				return err
+			}
+			file.Blocks[i] = &Block{Id: blkId}
+		}
+	}
+	if flags&fileChunked != 0 && offset != file.Size {
+		return errChunkSize
+	}
+
+	file.BlockCache = make(map[int64]*DataBlock)
+
+	return nil
+}
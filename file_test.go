@@ -5,6 +5,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
 
 	"bazil.org/fuse"
 )
@@ -15,14 +16,14 @@ type MockBlockGenerator struct {
 
 var _ BlockGenerator = new(MockBlockGenerator)
 
-func (m *MockBlockGenerator) NewBlock() StorageUnit {
+func (m *MockBlockGenerator) NewBlock(ctx context.Context) (StorageUnit, error) {
 	args := m.Mock.Called()
-	return args.Get(0).(StorageUnit)
+	return args.Get(0).(StorageUnit), args.Error(1)
 }
 
-func (m *MockBlockGenerator) NewNamedBlock(name string) Block {
+func (m *MockBlockGenerator) NewNamedBlock(ctx context.Context, name string) (Block, error) {
 	args := m.Mock.Called(name)
-	return args.Get(0).(Block)
+	return args.Get(0).(Block), args.Error(1)
 }
 
 type MockBlock struct {
@@ -31,8 +32,8 @@ type MockBlock struct {
 
 var _ StorageUnit = new(MockBlock)
 
-func (b *MockBlock) Delete(store KVStore) {
-	b.Mock.Called(store)
+func (b *MockBlock) Delete(ctx context.Context, store KVStore) {
+	b.Mock.Called(ctx, store)
 }
 
 func (b *MockBlock) GetId() int64 {
@@ -53,8 +54,8 @@ func (b *MockBlock) MarkClean() {
 	b.Mock.Called()
 }
 
-func (b *MockBlock) ReadBlock(m Marshalable, store KVStore) error {
-	args := b.Mock.Called(m, store)
+func (b *MockBlock) ReadBlock(ctx context.Context, m Marshalable, store KVStore) error {
+	args := b.Mock.Called(ctx, m, store)
 	return args.Error(0)
 }
 
@@ -62,8 +63,8 @@ func (b *MockBlock) SetId(id int64) {
 	b.Mock.Called(id)
 }
 
-func (b *MockBlock) WriteBlock(m Marshalable, store KVStore) error {
-	args := b.Mock.Called(m, store)
+func (b *MockBlock) WriteBlock(ctx context.Context, m Marshalable, store KVStore) error {
+	args := b.Mock.Called(ctx, m, store)
 	return args.Error(0)
 }
 
@@ -101,7 +102,7 @@ func BenchmarkFileWriteToCache(b *testing.B) {
 
 	b.N = min(b.N, 500000)
 	for i := 0; i < b.N; i++ {
-		file.Write(nil, req, res)
+		file.Write(context.TODO(), req, res)
 		req.Offset += bSize
 	}
 }
@@ -123,21 +124,21 @@ func TestFileSetSize(t *testing.T) {
 	mBlocks[2].On("MarkDirty").Return()
 	mBlocks[2].On("GetId").Return(int64(3))
 
-	mBlkGen.On("NewBlock").Return(mBlocks[0]).Once()
-	file.setSize(4095)
+	mBlkGen.On("NewBlock").Return(mBlocks[0], nil).Once()
+	file.setSize(context.TODO(), 4095)
 	mBlkGen.AssertExpectations(t)
 
-	mBlkGen.On("NewBlock").Return(mBlocks[1]).Once()
-	mBlkGen.On("NewBlock").Return(mBlocks[2]).Once()
-	file.setSize(12288)
+	mBlkGen.On("NewBlock").Return(mBlocks[1], nil).Once()
+	mBlkGen.On("NewBlock").Return(mBlocks[2], nil).Once()
+	file.setSize(context.TODO(), 12288)
 	mBlkGen.AssertExpectations(t)
 
-	file.setSize(10000)
+	file.setSize(context.TODO(), 10000)
 	mBlkGen.AssertExpectations(t)
 
-	mBlocks[1].On("Delete", nil).Return().Once()
-	mBlocks[2].On("Delete", nil).Return().Once()
-	file.setSize(4096)
+	mBlocks[1].On("Delete", mock.Anything, nil).Return().Once()
+	mBlocks[2].On("Delete", mock.Anything, nil).Return().Once()
+	file.setSize(context.TODO(), 4096)
 	mBlkGen.AssertExpectations(t)
 	mBlocks[1].AssertExpectations(t)
 	mBlocks[2].AssertExpectations(t)
@@ -165,22 +166,22 @@ func TestFileWrite(t *testing.T) {
 	req := &fuse.WriteRequest{Data: data[:1000], Offset: 0}
 	res := &fuse.WriteResponse{}
 
-	mBlkGen.On("NewBlock").Return(mBlocks[0]).Once()
+	mBlkGen.On("NewBlock").Return(mBlocks[0], nil).Once()
 	// Once for NewBlock and once more after writing data.
 	mBlocks[0].On("MarkDirty").Return().Twice()
-	file.Write(nil, req, res)
+	file.Write(context.TODO(), req, res)
 	mBlkGen.AssertExpectations(t)
 	mBlocks[0].AssertExpectations(t)
 	assert.EqualValues(t, 1000, file.Size)
 
 	mBlocks[0].On("IsDirty").Return(true).Once()
 	// TODO: Block output
-	mBlocks[0].On("WriteBlock", mock.AnythingOfType("*gobuddyfs.DataBlock"),
-		mStore).Return(nil).Once()
+	mBlocks[0].On("WriteBlock", mock.Anything,
+		mock.AnythingOfType("*gobuddyfs.DataBlock"), mStore).Return(nil).Once()
 	mBlocks[0].On("MarkClean").Return().Once()
 	// TODO: File layout output
 	mStore.On("Set", "0", mock.Anything).Return(nil).Once()
-	file.Flush(nil, nil)
+	file.Flush(context.TODO(), nil)
 	mBlkGen.AssertExpectations(t)
 	mBlocks[0].AssertExpectations(t)
 
@@ -190,7 +191,7 @@ func TestFileWrite(t *testing.T) {
 
 	mBlocks[0].On("MarkDirty").Return().Once()
 	mStore.On("Get", "1", mock.Anything).Return(data[:1000], nil).Once()
-	file.Write(nil, req, res)
+	file.Write(context.TODO(), req, res)
 	mBlkGen.AssertExpectations(t)
 	mBlocks[0].AssertExpectations(t)
 	assert.EqualValues(t, 4096, file.Size)
@@ -200,7 +201,7 @@ func TestFileWrite(t *testing.T) {
 	res = &fuse.WriteResponse{}
 
 	mBlocks[0].On("MarkDirty").Return().Once()
-	file.Write(nil, req, res)
+	file.Write(context.TODO(), req, res)
 	mBlkGen.AssertExpectations(t)
 	mBlocks[0].AssertExpectations(t)
 	assert.EqualValues(t, 4096, file.Size)
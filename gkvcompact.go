@@ -0,0 +1,217 @@
+package gobuddyfs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/steveyen/gkvlite"
+)
+
+// gkvlite never overwrites data in place, so every commit leaves the nodes it
+// replaced behind as garbage. Compaction copies the live items of every
+// collection into a new file and renames it over the old one.
+
+// Files smaller than this are not worth compacting online.
+const minCompactSize = 1 << 20
+
+// Approximate number of bytes gkvlite writes for every item besides its key
+// and value: the item's header, and the tree node pointing to it.
+const gkvItemOverhead = 64
+
+// Number of items copied between flushes of the new file, which bounds the
+// memory used while compacting.
+const compactFlushEvery = 1000
+
+// CompactGKVFile compacts the gkvlite file at path. It fails with a StoreError
+// wrapping ErrLocked if the file is in use by a mounted filesystem.
+func CompactGKVFile(path string) error {
+	f, err := openLocked(path, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s, err := gkvlite.NewStore(f)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	newStore, newFile, err := replaceCompacted(s, path)
+	if err != nil {
+		return err
+	}
+
+	newStore.Close()
+	return newFile.Close()
+}
+
+// replaceCompacted writes a compacted copy of store next to path, and renames
+// it over path once it is safely on disk. It returns the store and file of
+// the copy.
+func replaceCompacted(store *gkvlite.Store, path string) (*gkvlite.Store, *os.File, error) {
+	tmpPath := path + ".compact"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Lock the copy before it replaces path, so that nobody else can open it
+	// in between.
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return nil, nil, err
+	}
+
+	newStore, err := store.CopyTo(f, compactFlushEvery)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return nil, nil, err
+	}
+
+	// Make the rename itself durable. The compacted file is complete either
+	// way, so a failure here is not fatal.
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		glog.Warningf("Unable to sync directory of %s: %s", path, err)
+	}
+
+	return newStore, f, nil
+}
+
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Compact replaces the store's file with a compacted copy. Reads and writes
+// wait until it is done. Only stores opened with OpenGKVStore can be
+// compacted.
+func (self *GKVStore) Compact() error {
+	defer self.lock.Unlock()
+	self.lock.Lock()
+
+	return self.compact()
+}
+
+func (self *GKVStore) compact() error {
+	if self.file == nil {
+		return ErrNotSupported
+	}
+
+	self.compacting = true
+	defer func() { self.compacting = false }()
+
+	if err := self.commit(); err != nil {
+		return &StoreError{Class: Permanent, Op: "compact", Key: self.path, Err: err}
+	}
+
+	name := self.collection.Name()
+	newStore, newFile, err := replaceCompacted(self.store, self.path)
+	if err != nil {
+		return &StoreError{Class: Permanent, Op: "compact", Key: self.path, Err: err}
+	}
+
+	self.current.retire()
+	self.current = &gkvFile{store: newStore, file: newFile}
+	self.store, self.file = newStore, newFile
+	self.collection = newStore.GetCollection(name)
+
+	// The compacted file holds nothing but live data, which tells how much
+	// space that takes up in this file better than the estimate does.
+	if fi, err := newFile.Stat(); err == nil {
+		if live, err := self.liveBytes(); err == nil && live > 0 {
+			self.liveScale = float64(fi.Size()) / float64(live)
+		}
+	}
+
+	if glog.V(1) {
+		glog.Infof("Compacted %s", self.path)
+	}
+	return nil
+}
+
+// liveBytes estimates the space taken up in the file by the items reachable
+// from the latest commit. The caller must hold the lock.
+func (self *GKVStore) liveBytes() (uint64, error) {
+	var live uint64
+	for _, name := range self.store.GetCollectionNames() {
+		numItems, numBytes, err := self.store.GetCollection(name).GetTotals()
+		if err != nil {
+			return 0, err
+		}
+		live += numBytes + numItems*gkvItemOverhead
+	}
+	return live, nil
+}
+
+// garbageRatio estimates the fraction of the file which is taken up by nodes
+// no longer reachable from the latest commit. The caller must hold the lock.
+func (self *GKVStore) garbageRatio() (float64, int64, error) {
+	fi, err := self.file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size := fi.Size()
+	if size == 0 {
+		return 0, 0, nil
+	}
+
+	n, err := self.liveBytes()
+	if err != nil {
+		return 0, 0, err
+	}
+	live := float64(n)
+	if self.liveScale > 0 {
+		live *= self.liveScale
+	}
+
+	if live >= float64(size) {
+		return 0, size, nil
+	}
+	return 1 - live/float64(size), size, nil
+}
+
+// maybeCompact starts a background compaction if enough of the file is
+// garbage. The caller must hold the write lock.
+func (self *GKVStore) maybeCompact() {
+	if self.opts.CompactRatio <= 0 || self.file == nil || self.compacting {
+		return
+	}
+
+	ratio, size, err := self.garbageRatio()
+	if err != nil {
+		glog.Warningf("Unable to estimate garbage in %s: %s", self.path, err)
+		return
+	}
+
+	if size < minCompactSize || ratio < self.opts.CompactRatio {
+		return
+	}
+
+	if glog.V(1) {
+		glog.Infof("Compacting %s, %.0f%% of %d bytes is garbage", self.path,
+			ratio*100, size)
+	}
+
+	self.compacting = true
+	go func() {
+		if err := self.Compact(); err != nil {
+			glog.Errorf("Error while compacting %s: %q", self.path, err)
+		}
+	}()
+}
@@ -0,0 +1,83 @@
+package gobuddyfs
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/steveyen/gkvlite"
+)
+
+// ErrLocked is returned when a gkvlite file is already open in another store,
+// such as a filesystem mounted by another process.
+var ErrLocked = errors.New("file is locked by another store")
+
+// openLocked opens the file at path and takes an exclusive lock on it. The
+// lock is released when the file is closed. If another store holds the lock,
+// it fails with a permanent StoreError wrapping ErrLocked.
+func openLocked(path string, flag int) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, flag, 0660)
+		if err != nil {
+			return nil, err
+		}
+
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, &StoreError{Class: Permanent, Op: "lock", Key: path, Err: ErrLocked}
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// A compaction may have renamed a new file over path between the open
+		// and the lock, leaving us with a lock on the old one.
+		same, err := isFileAt(f, path)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if same {
+			return f, nil
+		}
+		f.Close()
+	}
+}
+
+func isFileAt(f *os.File, path string) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	pathFi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi, pathFi), nil
+}
+
+// ListGKVVolumes returns the sorted names of the collections in the gkvlite
+// file at path. Like opening a store, it fails with a StoreError wrapping
+// ErrLocked while the file is in use.
+func ListGKVVolumes(path string) ([]string, error) {
+	f, err := openLocked(path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s, err := gkvlite.NewStore(f)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	names := s.GetCollectionNames()
+	sort.Strings(names)
+	return names, nil
+}
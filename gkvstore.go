@@ -1,24 +1,142 @@
 package gobuddyfs
 
 import (
+	"bytes"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/steveyen/gkvlite"
+	"golang.org/x/net/context"
 )
 
+// GKVStoreOptions controls when a GKVStore commits buffered writes to its
+// file. The zero value commits after every write.
+type GKVStoreOptions struct {
+	// CommitInterval is the longest a write stays buffered before it is
+	// committed.
+	CommitInterval time.Duration
+	// MaxDirtyBytes commits as soon as this many bytes of keys and values have
+	// been written since the last commit.
+	MaxDirtyBytes int
+	// File is the file backing the gkvlite store. If set, Sync flushes it to
+	// stable storage after committing. Stores opened with OpenGKVStore know
+	// their file already.
+	File interface {
+		Sync() error
+	}
+	// CompactRatio starts an online compaction after a commit once this
+	// fraction of the file is estimated to be garbage. Zero disables online
+	// compaction. Only stores opened with OpenGKVStore can be compacted.
+	CompactRatio float64
+}
+
+// GKVStore stores blocks in a gkvlite collection. Writes can be grouped into
+// commits, which gkvlite appends to its file as new tree nodes followed by a
+// new root. A commit interrupted by a crash is therefore ignored when the
+// file is reopened, and the store comes back as of the previous commit.
 type GKVStore struct {
 	collection *gkvlite.Collection
 	store      *gkvlite.Store
 	lock       sync.RWMutex
+	opts       GKVStoreOptions
+
+	dirtyBytes int
+	timer      *time.Timer
+
+	// Set when the store was opened by OpenGKVStore and owns its file.
+	path       string
+	file       *os.File
+	compacting bool
+	// Size of the file per byte of live data, as measured by the last
+	// compaction. Zero until the store has been compacted.
+	liveScale float64
+	// The file above along with its gkvlite store, which scans hold on to.
+	current *gkvFile
+
+	// Implements: KVStore, ContextKVStore, DeletableKVStore, ScannableKVStore,
+	// CASKVStore, SyncableKVStore
+}
 
-	// Implements: KVStore
+// gkvFile is a file owned by a GKVStore, along with the gkvlite store reading
+// it. Once the store has moved on to a compacted copy, or been closed, the
+// file is closed as soon as no scan is reading a snapshot of it.
+type gkvFile struct {
+	lock    sync.Mutex
+	store   *gkvlite.Store
+	file    *os.File
+	scans   int
+	retired bool
+}
+
+func (f *gkvFile) acquire() {
+	f.lock.Lock()
+	f.scans++
+	f.lock.Unlock()
+}
+
+func (f *gkvFile) release() {
+	f.lock.Lock()
+	f.scans--
+	done := f.retired && f.scans == 0
+	f.lock.Unlock()
+
+	if done {
+		f.close()
+	}
+}
+
+func (f *gkvFile) retire() {
+	f.lock.Lock()
+	f.retired = true
+	done := f.scans == 0
+	f.lock.Unlock()
+
+	if done {
+		f.close()
+	}
+}
+
+func (f *gkvFile) close() {
+	f.store.Close()
+	f.file.Close()
 }
 
 func NewGKVStore(collection *gkvlite.Collection, store *gkvlite.Store) *GKVStore {
 	return &GKVStore{collection: collection, store: store}
 }
 
+func NewGKVStoreWithOptions(collection *gkvlite.Collection, store *gkvlite.Store,
+	opts GKVStoreOptions) *GKVStore {
+	return &GKVStore{collection: collection, store: store, opts: opts}
+}
+
+// OpenGKVStore opens, creating it if needed, the named collection in the
+// gkvlite file at path. The returned store owns the file, and holds an
+// exclusive lock on it until closed. One file can hold several collections,
+// but only one of them can be open at a time.
+func OpenGKVStore(path, collection string, opts GKVStoreOptions) (*GKVStore, error) {
+	f, err := openLocked(path, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := gkvlite.NewStore(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c := s.GetCollection(collection)
+	if c == nil {
+		c = s.SetCollection(collection, bytes.Compare)
+	}
+
+	return &GKVStore{collection: c, store: s, opts: opts, path: path, file: f,
+		current: &gkvFile{store: s, file: f}}, nil
+}
+
 func (self *GKVStore) Get(key string, retry bool) ([]byte, error) {
 	defer self.lock.RUnlock()
 	self.lock.RLock()
@@ -26,7 +144,20 @@ func (self *GKVStore) Get(key string, retry bool) ([]byte, error) {
 	if glog.V(2) {
 		glog.Infof("Get(%s)\n", key)
 	}
-	return self.collection.Get([]byte(key))
+	item, err := self.collection.GetItem([]byte(key), true)
+	if err != nil {
+		return nil, &StoreError{Class: Permanent, Op: "get", Key: key, Err: err}
+	}
+
+	if item == nil {
+		return nil, ErrNotFound
+	}
+
+	if item.Val == nil {
+		// Distinguish an empty value from a missing one.
+		return []byte{}, nil
+	}
+	return item.Val, nil
 }
 
 func (self *GKVStore) Set(key string, value []byte) error {
@@ -36,10 +167,195 @@ func (self *GKVStore) Set(key string, value []byte) error {
 	if glog.V(2) {
 		glog.Infof("Set(%s)\n", key)
 	}
-	err := self.collection.Set([]byte(key), value)
-	self.collection.Write()
-	self.store.Flush()
+
+	var err error
+	if value == nil {
+		// Implicit delete operation
+		_, err = self.collection.Delete([]byte(key))
+	} else {
+		err = self.collection.Set([]byte(key), value)
+	}
+	if err == nil {
+		err = self.written(len(key) + len(value))
+	}
+	if err != nil {
+		return &StoreError{Class: Permanent, Op: "set", Key: key, Err: err}
+	}
+	return nil
+}
+
+// written accounts for n bytes of buffered writes and commits them if the
+// options call for it. The caller must hold the write lock.
+func (self *GKVStore) written(n int) error {
+	self.dirtyBytes += n
+
+	if self.opts.CommitInterval <= 0 && self.opts.MaxDirtyBytes <= 0 {
+		return self.commit()
+	}
+
+	if self.opts.MaxDirtyBytes > 0 && self.dirtyBytes >= self.opts.MaxDirtyBytes {
+		return self.commit()
+	}
+
+	if self.timer == nil && self.opts.CommitInterval > 0 {
+		self.timer = time.AfterFunc(self.opts.CommitInterval, self.timedCommit)
+	}
+	return nil
+}
+
+// commit writes out the collection's dirty nodes and flushes the store. The
+// caller must hold the write lock.
+func (self *GKVStore) commit() error {
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+
+	if err := self.collection.Write(); err != nil {
+		return err
+	}
+	if err := self.store.Flush(); err != nil {
+		return err
+	}
+
+	self.dirtyBytes = 0
+	self.maybeCompact()
+	return nil
+}
+
+func (self *GKVStore) timedCommit() {
+	defer self.lock.Unlock()
+	self.lock.Lock()
+
+	self.timer = nil
+	if self.dirtyBytes == 0 {
+		return
+	}
+
+	// On failure the writes stay buffered, and the next commit retries them.
+	if err := self.commit(); err != nil {
+		glog.Errorf("Error while committing gkvlite store: %q", err)
+	}
+}
+
+// Sync commits all buffered writes and, if the backing file is known, flushes
+// it to stable storage. It is the durability barrier behind File.Fsync.
+func (self *GKVStore) Sync() error {
+	defer self.lock.Unlock()
+	self.lock.Lock()
+
+	if err := self.commit(); err != nil {
+		return &StoreError{Class: Permanent, Op: "sync", Err: err}
+	}
+
+	var err error
+	if self.file != nil {
+		err = self.file.Sync()
+	} else if self.opts.File != nil {
+		err = self.opts.File.Sync()
+	}
+	if err != nil {
+		return &StoreError{Class: Permanent, Op: "sync", Err: err}
+	}
+	return nil
+}
+
+// Close commits and syncs all buffered writes. The gkvlite store and its file
+// are only closed if the store was opened with OpenGKVStore.
+func (self *GKVStore) Close() error {
+	err := self.Sync()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.current != nil {
+		// Scans still running close it when they are done.
+		self.current.retire()
+		self.current, self.file = nil, nil
+	}
+
 	return err
 }
 
+func (self *GKVStore) Delete(key string) error {
+	return self.Set(key, nil)
+}
+
+func (self *GKVStore) CompareAndSet(key string, expected, value []byte) error {
+	defer self.lock.Unlock()
+	self.lock.Lock()
+
+	item, err := self.collection.GetItem([]byte(key), true)
+	if err != nil {
+		return &StoreError{Class: Permanent, Op: "get", Key: key, Err: err}
+	}
+
+	if (item != nil) != (expected != nil) ||
+		(item != nil && !bytes.Equal(item.Val, expected)) {
+		return ErrConflict
+	}
+
+	if value == nil {
+		_, err = self.collection.Delete([]byte(key))
+	} else {
+		err = self.collection.Set([]byte(key), value)
+	}
+	if err == nil {
+		err = self.written(len(key) + len(value))
+	}
+	if err != nil {
+		return &StoreError{Class: Permanent, Op: "set", Key: key, Err: err}
+	}
+	return nil
+}
+
+func (self *GKVStore) Scan(start, end string, visit ScanFunc) error {
+	// Visit a read-only snapshot, so that visit can modify the store.
+	self.lock.RLock()
+	snapshot := self.store.Snapshot()
+	if f := self.current; f != nil {
+		// The file must outlive the snapshot, even if it is compacted away.
+		f.acquire()
+		defer f.release()
+	}
+	self.lock.RUnlock()
+	defer snapshot.Close()
+
+	collection := snapshot.GetCollection(self.collection.Name())
+	if collection == nil {
+		return nil
+	}
+
+	err := collection.VisitItemsAscend([]byte(start), true, func(item *gkvlite.Item) bool {
+		key := string(item.Key)
+		if end != "" && key >= end {
+			return false
+		}
+		return visit(key, item.Val)
+	})
+	if err != nil {
+		return &StoreError{Class: Permanent, Op: "scan", Key: start, Err: err}
+	}
+	return nil
+}
+
+func (self *GKVStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return self.Get(key, retry)
+}
+
+func (self *GKVStore) SetContext(ctx context.Context, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return self.Set(key, value)
+}
+
 var _ KVStore = new(GKVStore)
+var _ ContextKVStore = new(GKVStore)
+var _ DeletableKVStore = new(GKVStore)
+var _ CASKVStore = new(GKVStore)
+var _ SyncableKVStore = new(GKVStore)
+var _ ScannableKVStore = new(GKVStore)
@@ -0,0 +1,347 @@
+package gobuddyfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/steveyen/gkvlite"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestGKVStore(t *testing.T, path string, opts gobuddyfs.GKVStoreOptions) (*gobuddyfs.GKVStore, *os.File) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	assert.NoError(t, err)
+
+	s, err := gkvlite.NewStore(f)
+	assert.NoError(t, err)
+
+	c := s.GetCollection("BuddyFS")
+	if c == nil {
+		c = s.SetCollection("BuddyFS", bytes.Compare)
+	}
+
+	opts.File = f
+	return gobuddyfs.NewGKVStoreWithOptions(c, s, opts), f
+}
+
+// committedValue reads key from a fresh gkvlite store opened on path, which
+// only sees what has been committed to the file.
+func committedValue(t *testing.T, path string, key string) []byte {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	s, err := gkvlite.NewStore(f)
+	assert.NoError(t, err)
+
+	c := s.GetCollection("BuddyFS")
+	if c == nil {
+		return nil
+	}
+	val, err := c.Get([]byte(key))
+	assert.NoError(t, err)
+	return val
+}
+
+func TestGKVStoreGroupCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gkvstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/test.gkvlite"
+
+	s, f := openTestGKVStore(t, path, gobuddyfs.GKVStoreOptions{CommitInterval: time.Hour})
+	defer f.Close()
+
+	bar := []byte("bar")
+	assert.NoError(t, s.Set("Foo", bar))
+
+	// Buffered writes are visible through the store, but not yet committed.
+	r, err := s.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, bar, r)
+	assert.Nil(t, committedValue(t, path, "Foo"))
+
+	assert.NoError(t, s.Sync())
+	assert.Equal(t, bar, committedValue(t, path, "Foo"))
+}
+
+func TestGKVStoreCommitOnDirtyBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gkvstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/test.gkvlite"
+
+	s, f := openTestGKVStore(t, path, gobuddyfs.GKVStoreOptions{
+		CommitInterval: time.Hour, MaxDirtyBytes: 10})
+	defer f.Close()
+
+	assert.NoError(t, s.Set("Foo", []byte("bar")))
+	assert.Nil(t, committedValue(t, path, "Foo"))
+
+	assert.NoError(t, s.Set("Baz", []byte("quux")))
+	assert.Equal(t, []byte("bar"), committedValue(t, path, "Foo"))
+}
+
+func TestGKVStoreCommitOnTimer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gkvstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/test.gkvlite"
+
+	s, f := openTestGKVStore(t, path, gobuddyfs.GKVStoreOptions{
+		CommitInterval: 10 * time.Millisecond})
+	defer f.Close()
+
+	assert.NoError(t, s.Set("Foo", []byte("bar")))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []byte("bar"), committedValue(t, path, "Foo"))
+}
+
+func TestGKVStoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gkvstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/test.gkvlite"
+
+	s, err := gobuddyfs.OpenGKVStore(path, "BuddyFS", gobuddyfs.GKVStoreOptions{})
+	assert.NoError(t, err)
+
+	value := make([]byte, 4096)
+	for i := 0; i < 100; i++ {
+		value[0] = byte(i)
+		assert.NoError(t, s.Set("Foo", value))
+	}
+	assert.NoError(t, s.Set("Bar", []byte("bar")))
+
+	before, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Compact())
+	after, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.True(t, after.Size() <= before.Size())
+
+	// The store keeps working on the compacted file.
+	r, err := s.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(99), r[0])
+	assert.NoError(t, s.Set("Baz", []byte("baz")))
+	assert.NoError(t, s.Close())
+
+	// And so does an offline compaction of it.
+	assert.NoError(t, gobuddyfs.CompactGKVFile(path))
+	assert.Equal(t, []byte("bar"), committedValue(t, path, "Bar"))
+	assert.Equal(t, []byte("baz"), committedValue(t, path, "Baz"))
+}
+
+func openFiles(t *testing.T) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd")
+	}
+	return len(fds)
+}
+
+// Files replaced by compaction are closed once no scan reads them, rather
+// than when the store is closed.
+func TestGKVStoreCompactClosesFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gkvstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/test.gkvlite"
+
+	s, err := gobuddyfs.OpenGKVStore(path, "BuddyFS", gobuddyfs.GKVStoreOptions{})
+	assert.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, s.Set(fmt.Sprintf("%02d", i), []byte("value")))
+	}
+
+	before := openFiles(t)
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, s.Compact())
+	}
+	assert.True(t, openFiles(t) < before+5, "%d files open, %d before",
+		openFiles(t), before)
+
+	// A scan keeps reading the file it started on across a compaction.
+	visited := 0
+	assert.NoError(t, s.Scan("", "", func(key string, value []byte) bool {
+		if visited == 0 {
+			assert.NoError(t, s.Compact())
+		}
+		assert.Equal(t, []byte("value"), value)
+		visited++
+		return true
+	}))
+	assert.Equal(t, 10, visited)
+	assert.True(t, openFiles(t) < before+5, "%d files open, %d before",
+		openFiles(t), before)
+}
+
+// A freshly compacted file holds no garbage, however small its items are
+// next to the bookkeeping gkvlite keeps for each of them.
+func TestGKVStoreNoCompactAfterCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gkvstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/test.gkvlite"
+
+	s, err := gobuddyfs.OpenGKVStore(path, "BuddyFS", gobuddyfs.GKVStoreOptions{
+		MaxDirtyBytes: 1 << 30, CompactRatio: 0.1})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 100000; i++ {
+		assert.NoError(t, s.Set(fmt.Sprintf("%06d", i), []byte("value")))
+	}
+	assert.NoError(t, s.Compact())
+	compacted, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.True(t, compacted.Size() >= 1<<20, "only %d bytes", compacted.Size())
+
+	assert.NoError(t, s.Set("Foo", []byte("bar")))
+	assert.NoError(t, s.Sync())
+	// Give a compaction, if one was started, the time to finish.
+	time.Sleep(time.Second)
+
+	now, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(compacted, now), "compacted again")
+}
+
+func isLocked(err error) bool {
+	sErr, ok := err.(*gobuddyfs.StoreError)
+	return ok && sErr.Err == gobuddyfs.ErrLocked
+}
+
+func TestGKVStoreLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gkvstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/test.gkvlite"
+
+	home, err := gobuddyfs.OpenGKVStore(path, "home", gobuddyfs.GKVStoreOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, home.Set("Foo", []byte("home")))
+
+	// The file can't be opened again, not even for another volume, until the
+	// store holding it is closed.
+	_, err = gobuddyfs.OpenGKVStore(path, "work", gobuddyfs.GKVStoreOptions{})
+	assert.True(t, isLocked(err))
+	assert.True(t, isLocked(gobuddyfs.CompactGKVFile(path)))
+
+	// The lock moves over to the compacted file.
+	assert.NoError(t, home.Compact())
+	_, err = gobuddyfs.OpenGKVStore(path, "work", gobuddyfs.GKVStoreOptions{})
+	assert.True(t, isLocked(err))
+	assert.NoError(t, home.Close())
+
+	work, err := gobuddyfs.OpenGKVStore(path, "work", gobuddyfs.GKVStoreOptions{})
+	assert.NoError(t, err)
+	_, err = work.Get("Foo", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+	assert.NoError(t, work.Set("Foo", []byte("work")))
+	assert.NoError(t, work.Close())
+
+	names, err := gobuddyfs.ListGKVVolumes(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"home", "work"}, names)
+
+	home, err = gobuddyfs.OpenGKVStore(path, "home", gobuddyfs.GKVStoreOptions{})
+	assert.NoError(t, err)
+	r, err := home.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("home"), r)
+	assert.NoError(t, home.Close())
+}
+
+func TestGKVStoreDeleteAndScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gkvstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, f := openTestGKVStore(t, dir+"/test.gkvlite", gobuddyfs.GKVStoreOptions{})
+	defer f.Close()
+
+	for _, key := range []string{"a1", "b1", "b2", "b3", "c1"} {
+		assert.NoError(t, s.Set(key, []byte(key)))
+	}
+	assert.NoError(t, s.Delete("b2"))
+	assert.NoError(t, s.Delete("missing"))
+	_, err = s.Get("b2", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+
+	keys := []string{}
+	err = gobuddyfs.ScanPrefix(s, "b", func(key string, value []byte) bool {
+		assert.Equal(t, key, string(value))
+		keys = append(keys, key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b1", "b3"}, keys)
+
+	// The end bound is exclusive.
+	keys = []string{}
+	err = s.Scan("a1", "b3", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a1", "b1"}, keys)
+
+	keys = []string{}
+	err = s.Scan("b3", "", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		// Deleting while scanning must not deadlock.
+		s.Delete(key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b3", "c1"}, keys)
+
+	_, err = s.Get("c1", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+}
+
+func TestGKVStoreCompareAndSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gkvstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, f := openTestGKVStore(t, dir+"/test.gkvlite", gobuddyfs.GKVStoreOptions{})
+	defer f.Close()
+	assert.NoError(t, s.Set("Foo", []byte("bar")))
+
+	tests := []struct {
+		key             string
+		expected, value []byte
+		err             error
+		now             []byte
+	}{
+		// A nil expected value only matches a missing key.
+		{"Foo", nil, []byte("x"), gobuddyfs.ErrConflict, []byte("bar")},
+		{"New", nil, []byte("new"), nil, []byte("new")},
+		{"Foo", []byte("baz"), []byte("x"), gobuddyfs.ErrConflict, []byte("bar")},
+		{"Missing", []byte("bar"), []byte("x"), gobuddyfs.ErrConflict, nil},
+		{"Foo", []byte("bar"), []byte("baz"), nil, []byte("baz")},
+		// A nil value deletes the key.
+		{"Foo", []byte("baz"), nil, nil, nil},
+		{"Foo", nil, []byte("again"), nil, []byte("again")},
+	}
+
+	for i, test := range tests {
+		assert.Equal(t, test.err, s.CompareAndSet(test.key, test.expected, test.value), "test %d", i)
+		val, err := s.Get(test.key, false)
+		if test.now == nil {
+			assert.Equal(t, gobuddyfs.ErrNotFound, err, "test %d", i)
+		} else {
+			assert.NoError(t, err, "test %d", i)
+			assert.Equal(t, test.now, val, "test %d", i)
+		}
+	}
+}
@@ -1,6 +1,265 @@
 package gobuddyfs
 
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// KVStore is the interface to the backing key-value store. Get returns
+// ErrNotFound when nothing is stored under the key. Other failures should be
+// reported as a *StoreError, so that callers can tell a transient failure
+// apart from missing or damaged data.
 type KVStore interface {
 	Get(string, bool) ([]byte, error)
 	Set(string, []byte) error
 }
+
+// ErrNotFound is returned by Get when no value is stored under the key.
+var ErrNotFound = errors.New("key not found")
+
+// ErrNotSupported is returned when a store lacks an optional capability.
+var ErrNotSupported = errors.New("operation not supported by store")
+
+// DeletableKVStore is implemented by stores which can delete a key
+// explicitly. Stores without it treat Set(key, nil) as a delete.
+type DeletableKVStore interface {
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+}
+
+// ErrConflict is returned by CompareAndSet when the stored value is not the
+// expected one.
+var ErrConflict = errors.New("value was changed concurrently")
+
+// CASKVStore is implemented by stores which can replace a value atomically.
+type CASKVStore interface {
+	// CompareAndSet stores value under key only if the current value equals
+	// expected, and returns ErrConflict otherwise. A nil expected value means
+	// the key must not exist yet; a nil value deletes the key.
+	CompareAndSet(key string, expected, value []byte) error
+}
+
+// SyncableKVStore is implemented by stores which buffer writes. Sync returns
+// once every write which completed before the call is durable.
+type SyncableKVStore interface {
+	Sync() error
+}
+
+// ScanFunc is called for every key visited by a scan. Returning false stops
+// the scan.
+type ScanFunc func(key string, value []byte) bool
+
+// ScannableKVStore is implemented by stores which can enumerate their keys.
+type ScannableKVStore interface {
+	// Scan visits, in ascending order, every key k with start <= k < end. An
+	// empty end leaves the range unbounded. visit may modify the store.
+	Scan(start, end string, visit ScanFunc) error
+}
+
+// ErrorClass describes how a caller should react to a failed store operation.
+type ErrorClass int
+
+const (
+	// Permanent failures will not go away by retrying the operation.
+	Permanent ErrorClass = iota
+	// Transient failures, such as an unreachable peer, may succeed if retried.
+	Transient
+	// Corrupt failures mean the stored value could not be decoded.
+	Corrupt
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case Transient:
+		return "transient"
+	case Corrupt:
+		return "corrupt"
+	}
+	return "permanent"
+}
+
+// StoreError records a failed store operation along with its class.
+type StoreError struct {
+	Class ErrorClass
+	Op    string
+	Key   string
+	Err   error
+}
+
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("%s %s: %s (%s)", e.Op, e.Key, e.Err, e.Class)
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorClassOf returns the class of err. Errors which were not classified by
+// the store are treated as permanent.
+func ErrorClassOf(err error) ErrorClass {
+	if sErr, ok := err.(*StoreError); ok {
+		return sErr.Class
+	}
+	return Permanent
+}
+
+func IsTransient(err error) bool {
+	return err != nil && ErrorClassOf(err) == Transient
+}
+
+func IsCorrupt(err error) bool {
+	return err != nil && ErrorClassOf(err) == Corrupt
+}
+
+// ContextKVStore is implemented by stores whose operations can be abandoned
+// when the caller's context is cancelled or its deadline expires.
+type ContextKVStore interface {
+	GetContext(ctx context.Context, key string, retry bool) ([]byte, error)
+	SetContext(ctx context.Context, key string, value []byte) error
+}
+
+type getResult struct {
+	value []byte
+	err   error
+}
+
+// kvGet reads a key from store, giving up as soon as ctx is done. Stores which
+// do not accept a context are called from a separate goroutine, which is left
+// to finish on its own if ctx expires first.
+//
+// Older stores report a missing key as a nil value without an error; kvGet
+// turns that into ErrNotFound.
+func kvGet(ctx context.Context, store KVStore, key string, retry bool) ([]byte, error) {
+	value, err := kvGetUnchecked(ctx, store, key, retry)
+	if err == nil && value == nil {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func kvGetUnchecked(ctx context.Context, store KVStore, key string, retry bool) ([]byte, error) {
+	if cStore, ok := store.(ContextKVStore); ok {
+		return cStore.GetContext(ctx, key, retry)
+	}
+
+	if ctx.Done() == nil {
+		return store.Get(key, retry)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan getResult, 1)
+	go func() {
+		value, err := store.Get(key, retry)
+		done <- getResult{value, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.value, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runContext runs a store operation which doesn't accept a context, giving up
+// as soon as ctx is done. An abandoned operation may still take effect after
+// runContext has returned.
+func runContext(ctx context.Context, op func() error) error {
+	if ctx.Done() == nil {
+		return op()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// kvSet writes a key to store, giving up as soon as ctx is done.
+func kvSet(ctx context.Context, store KVStore, key string, value []byte) error {
+	if cStore, ok := store.(ContextKVStore); ok {
+		return cStore.SetContext(ctx, key, value)
+	}
+
+	return runContext(ctx, func() error {
+		return store.Set(key, value)
+	})
+}
+
+// kvDelete removes key from store, falling back to setting a nil value for
+// stores without an explicit Delete.
+func kvDelete(ctx context.Context, store KVStore, key string) error {
+	if dStore, ok := store.(DeletableKVStore); ok {
+		return runContext(ctx, func() error {
+			return dStore.Delete(key)
+		})
+	}
+
+	return kvSet(ctx, store, key, nil)
+}
+
+// kvCompareAndSet replaces the value of key in store if it still equals
+// expected. Stores without compare-and-set get a plain Set, where the last
+// writer wins.
+func kvCompareAndSet(ctx context.Context, store KVStore, key string, expected, value []byte) error {
+	if casStore, ok := store.(CASKVStore); ok {
+		return runContext(ctx, func() error {
+			return casStore.CompareAndSet(key, expected, value)
+		})
+	}
+
+	return kvSet(ctx, store, key, value)
+}
+
+// kvSync makes all completed writes to store durable. Stores which don't
+// buffer writes have nothing to do.
+func kvSync(ctx context.Context, store KVStore) error {
+	if sStore, ok := store.(SyncableKVStore); ok {
+		return runContext(ctx, sStore.Sync)
+	}
+	return nil
+}
+
+// Scan visits, in ascending order, every key k in store with start <= k < end.
+// It returns ErrNotSupported if the store cannot enumerate its keys.
+func Scan(store KVStore, start, end string, visit ScanFunc) error {
+	if sStore, ok := store.(ScannableKVStore); ok {
+		return sStore.Scan(start, end, visit)
+	}
+	return ErrNotSupported
+}
+
+// ScanPrefix visits, in ascending order, every key in store which starts with
+// prefix.
+func ScanPrefix(store KVStore, prefix string, visit ScanFunc) error {
+	return Scan(store, prefix, prefixEnd(prefix), visit)
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
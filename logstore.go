@@ -0,0 +1,635 @@
+package gobuddyfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// A LogStore segment is a sequence of records, each made up of a CRC32 of the
+// rest of the record, a flags byte, the key and value lengths, the key and the
+// value. Integers are big-endian and 32 bits wide. Deletes are recorded as
+// tombstones, which have no value.
+const (
+	logRecordHeader         = 13
+	logTombstone       byte = 1
+	defaultSegmentSize      = 64 << 20
+)
+
+var errBadRecord = errors.New("invalid log record")
+
+// LogStoreOptions controls how a LogStore writes and reclaims its segments.
+type LogStoreOptions struct {
+	// SegmentSize is the size at which a new segment is started. Zero uses a
+	// default of 64MB.
+	SegmentSize int64
+	// Sync flushes every write to stable storage before it returns. Otherwise
+	// that is left to Sync.
+	Sync bool
+	// CompactRatio compacts a full segment in the background once this
+	// fraction of it is taken up by overwritten or deleted records. Zero
+	// disables background compaction.
+	CompactRatio float64
+}
+
+type logSegment struct {
+	id   uint64
+	file *os.File
+	size int64
+	// Bytes of records which are still current, and how many of those bytes
+	// are tombstones.
+	live, tombstones int64
+}
+
+type logEntry struct {
+	seg       *logSegment
+	offset    int64
+	size      int64
+	tombstone bool
+}
+
+// LogStore appends every write to the newest of a series of segment files,
+// and keeps the location of the current record of every key in memory. The
+// index is rebuilt by reading all segments when the store is opened. A record
+// torn by a crash at the end of the newest segment is cut off; damage anywhere
+// else fails the open.
+//
+// Compaction copies the current records of an old segment to the newest one
+// and then removes it. Tombstones are copied too, since an even older
+// segment may still hold the value they delete, unless the segment being
+// compacted is the oldest.
+type LogStore struct {
+	dir      string
+	opts     LogStoreOptions
+	lockFile *os.File
+
+	lock     sync.RWMutex
+	index    map[string]logEntry
+	segments []*logSegment // Oldest first; the last one is written to.
+
+	compactLock sync.Mutex
+	kick        chan struct{}
+	done        chan struct{}
+	wg          sync.WaitGroup
+
+	// Implements: KVStore, DeletableKVStore, ScannableKVStore, CASKVStore,
+	// SyncableKVStore
+}
+
+// OpenLogStore opens the store in the directory dir, creating it if needed.
+// The store holds an exclusive lock on the directory until it is closed.
+func OpenLogStore(dir string, opts LogStoreOptions) (*LogStore, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+
+	lockFile, err := openLocked(filepath.Join(dir, "LOCK"), os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+
+	self := &LogStore{dir: dir, opts: opts, lockFile: lockFile,
+		index: make(map[string]logEntry), kick: make(chan struct{}, 1),
+		done: make(chan struct{})}
+
+	if err := self.load(); err != nil {
+		self.closeFiles()
+		return nil, err
+	}
+
+	if opts.CompactRatio > 0 {
+		self.wg.Add(1)
+		go self.compactor()
+		self.kickCompactor()
+	}
+
+	return self, nil
+}
+
+func segmentName(id uint64) string {
+	return fmt.Sprintf("%016x.log", id)
+}
+
+// load opens the existing segments and rebuilds the index from them.
+func (self *LogStore) load() error {
+	d, err := os.Open(self.dir)
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+
+	var ids []uint64
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ".log"), 16, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for i, id := range ids {
+		f, err := os.OpenFile(filepath.Join(self.dir, segmentName(id)), os.O_RDWR, 0660)
+		if err != nil {
+			return err
+		}
+
+		seg := &logSegment{id: id, file: f}
+		self.segments = append(self.segments, seg)
+		if err := self.replay(seg, i == len(ids)-1); err != nil {
+			return err
+		}
+	}
+
+	if len(self.segments) == 0 {
+		return self.newSegment(1)
+	}
+	return nil
+}
+
+// replay adds the records of seg to the index.
+func (self *LogStore) replay(seg *logSegment, last bool) error {
+	fi, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	err = readRecords(seg.file, fi.Size(), func(offset int64, rec []byte, key string, tombstone bool) bool {
+		self.put(key, logEntry{seg: seg, offset: offset, size: int64(len(rec)),
+			tombstone: tombstone})
+		return true
+	}, &offset)
+
+	if err == errBadRecord {
+		if !last {
+			return &StoreError{Class: Corrupt, Op: "load", Key: seg.file.Name(), Err: err}
+		}
+
+		glog.Warningf("Truncating %s at offset %d, after the last complete record",
+			seg.file.Name(), offset)
+		if err := seg.file.Truncate(offset); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	seg.size = offset
+	return nil
+}
+
+// readRecords calls visit with every record in the first size bytes of f,
+// until visit returns false. offset is left at the end of the last valid
+// record. If a record is damaged or incomplete, errBadRecord is returned.
+func readRecords(f io.ReaderAt, size int64, visit func(offset int64, rec []byte, key string, tombstone bool) bool, offset *int64) error {
+	r := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	*offset = 0
+
+	for *offset < size {
+		hdr := make([]byte, logRecordHeader)
+		if _, err := io.ReadFull(r, hdr); err == io.ErrUnexpectedEOF || err == io.EOF {
+			return errBadRecord
+		} else if err != nil {
+			return err
+		}
+
+		recSize := int64(logRecordHeader) + int64(binary.BigEndian.Uint32(hdr[5:])) +
+			int64(binary.BigEndian.Uint32(hdr[9:]))
+		if *offset+recSize > size {
+			return errBadRecord
+		}
+
+		rec := make([]byte, recSize)
+		copy(rec, hdr)
+		if _, err := io.ReadFull(r, rec[logRecordHeader:]); err != nil {
+			return err
+		}
+
+		key, _, tombstone, ok := decodeRecord(rec)
+		if !ok {
+			return errBadRecord
+		}
+
+		if !visit(*offset, rec, key, tombstone) {
+			return nil
+		}
+		*offset += recSize
+	}
+	return nil
+}
+
+func encodeRecord(key string, value []byte, tombstone bool) []byte {
+	rec := make([]byte, logRecordHeader+len(key)+len(value))
+	if tombstone {
+		rec[4] = logTombstone
+	}
+	binary.BigEndian.PutUint32(rec[5:], uint32(len(key)))
+	binary.BigEndian.PutUint32(rec[9:], uint32(len(value)))
+	copy(rec[logRecordHeader:], key)
+	copy(rec[logRecordHeader+len(key):], value)
+	binary.BigEndian.PutUint32(rec, crc32.ChecksumIEEE(rec[4:]))
+	return rec
+}
+
+func decodeRecord(rec []byte) (key string, value []byte, tombstone bool, ok bool) {
+	if len(rec) < logRecordHeader ||
+		binary.BigEndian.Uint32(rec) != crc32.ChecksumIEEE(rec[4:]) {
+		return "", nil, false, false
+	}
+
+	keyLen := int64(binary.BigEndian.Uint32(rec[5:]))
+	valueLen := int64(binary.BigEndian.Uint32(rec[9:]))
+	if int64(len(rec)) != logRecordHeader+keyLen+valueLen {
+		return "", nil, false, false
+	}
+
+	key = string(rec[logRecordHeader : logRecordHeader+keyLen])
+	value = rec[logRecordHeader+keyLen:]
+	return key, value, rec[4]&logTombstone != 0, true
+}
+
+// put makes entry the current record for key. The caller must hold the lock.
+func (self *LogStore) put(key string, entry logEntry) {
+	if old, ok := self.index[key]; ok {
+		self.forget(old)
+	}
+
+	self.index[key] = entry
+	entry.seg.live += entry.size
+	if entry.tombstone {
+		entry.seg.tombstones += entry.size
+	}
+}
+
+// forget accounts for entry no longer being current.
+func (self *LogStore) forget(entry logEntry) {
+	entry.seg.live -= entry.size
+	if entry.tombstone {
+		entry.seg.tombstones -= entry.size
+	}
+}
+
+func (self *LogStore) active() *logSegment {
+	return self.segments[len(self.segments)-1]
+}
+
+// newSegment starts a new segment to write to. The caller must hold the lock.
+func (self *LogStore) newSegment(id uint64) error {
+	f, err := os.OpenFile(filepath.Join(self.dir, segmentName(id)),
+		os.O_RDWR|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+
+	if err := syncDir(self.dir); err != nil {
+		glog.Warningf("Unable to sync directory %s: %s", self.dir, err)
+	}
+
+	self.segments = append(self.segments, &logSegment{id: id, file: f})
+	return nil
+}
+
+// append writes a record for key to the active segment and makes it current.
+// The caller must hold the lock.
+func (self *LogStore) append(key string, value []byte, tombstone bool) error {
+	op := "set"
+	if tombstone {
+		op = "delete"
+	}
+
+	seg := self.active()
+	rec := encodeRecord(key, value, tombstone)
+
+	// A failed write may leave part of the record behind, which the next one
+	// overwrites.
+	_, err := seg.file.WriteAt(rec, seg.size)
+	if err == nil && self.opts.Sync {
+		err = seg.file.Sync()
+	}
+	if err != nil {
+		return &StoreError{Class: Permanent, Op: op, Key: key, Err: err}
+	}
+
+	self.put(key, logEntry{seg: seg, offset: seg.size, size: int64(len(rec)),
+		tombstone: tombstone})
+	seg.size += int64(len(rec))
+
+	if seg.size >= self.opts.SegmentSize {
+		self.rotate()
+	}
+	return nil
+}
+
+// rotate seals the active segment and starts a new one. The write which
+// filled the segment has succeeded already, so failures are only logged and
+// the full segment is written to for a while longer.
+func (self *LogStore) rotate() {
+	seg := self.active()
+
+	// Only the active segment needs syncing later on.
+	if err := seg.file.Sync(); err != nil {
+		glog.Errorf("Error while syncing %s: %q", seg.file.Name(), err)
+		return
+	}
+
+	if err := self.newSegment(seg.id + 1); err != nil {
+		glog.Errorf("Error while starting a new segment in %s: %q", self.dir, err)
+		return
+	}
+
+	self.kickCompactor()
+}
+
+// read returns the current value of key. The caller must hold the lock.
+func (self *LogStore) read(key string) ([]byte, error) {
+	entry, ok := self.index[key]
+	if !ok || entry.tombstone {
+		return nil, ErrNotFound
+	}
+
+	rec := make([]byte, entry.size)
+	if _, err := entry.seg.file.ReadAt(rec, entry.offset); err != nil {
+		return nil, &StoreError{Class: Permanent, Op: "get", Key: key, Err: err}
+	}
+
+	_, value, _, ok := decodeRecord(rec)
+	if !ok {
+		return nil, &StoreError{Class: Corrupt, Op: "get", Key: key, Err: errBadRecord}
+	}
+	return value, nil
+}
+
+func (self *LogStore) Get(key string, retry bool) ([]byte, error) {
+	if glog.V(2) {
+		glog.Infof("Get(%s)\n", key)
+	}
+
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	return self.read(key)
+}
+
+func (self *LogStore) Set(key string, value []byte) error {
+	if glog.V(2) {
+		glog.Infof("Set(%s)\n", key)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.set(key, value)
+}
+
+// set writes or, for a nil value, deletes key. The caller must hold the lock.
+func (self *LogStore) set(key string, value []byte) error {
+	if value == nil {
+		if entry, ok := self.index[key]; !ok || entry.tombstone {
+			// Nothing to delete.
+			return nil
+		}
+		return self.append(key, nil, true)
+	}
+	return self.append(key, value, false)
+}
+
+func (self *LogStore) Delete(key string) error {
+	return self.Set(key, nil)
+}
+
+func (self *LogStore) CompareAndSet(key string, expected, value []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	current, err := self.read(key)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	if (err == nil) != (expected != nil) || !bytes.Equal(current, expected) {
+		return ErrConflict
+	}
+
+	return self.set(key, value)
+}
+
+func (self *LogStore) Scan(start, end string, visit ScanFunc) error {
+	self.lock.RLock()
+	var keys []string
+	for key, entry := range self.index {
+		if !entry.tombstone && key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	self.lock.RUnlock()
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, err := self.Get(key, false)
+		if err == ErrNotFound {
+			// Deleted since the keys were collected.
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !visit(key, value) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Sync makes every write completed so far durable.
+func (self *LogStore) Sync() error {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	seg := self.active()
+	if err := seg.file.Sync(); err != nil {
+		return &StoreError{Class: Permanent, Op: "sync", Key: seg.file.Name(), Err: err}
+	}
+	return nil
+}
+
+// Close stops background compaction, syncs the store and releases its
+// directory.
+func (self *LogStore) Close() error {
+	close(self.done)
+	self.wg.Wait()
+
+	err := self.Sync()
+	self.closeFiles()
+	return err
+}
+
+func (self *LogStore) closeFiles() {
+	for _, seg := range self.segments {
+		seg.file.Close()
+	}
+	self.lockFile.Close()
+}
+
+func (self *LogStore) kickCompactor() {
+	select {
+	case self.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (self *LogStore) compactor() {
+	defer self.wg.Done()
+
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-self.kick:
+		}
+
+		if err := self.compact(self.opts.CompactRatio); err != nil {
+			glog.Errorf("Error while compacting %s: %q", self.dir, err)
+		}
+	}
+}
+
+// Compact compacts every full segment holding any overwritten or deleted
+// records.
+func (self *LogStore) Compact() error {
+	return self.compact(0)
+}
+
+// compact compacts the full segments whose share of garbage is at least
+// minRatio, or for a minRatio of zero, greater than zero.
+func (self *LogStore) compact(minRatio float64) error {
+	self.compactLock.Lock()
+	defer self.compactLock.Unlock()
+
+	self.lock.RLock()
+	var segs []*logSegment
+	for i, seg := range self.segments[:len(self.segments)-1] {
+		garbage := seg.size - seg.live
+		if i == 0 {
+			// Nothing older can be shadowed by its tombstones.
+			garbage += seg.tombstones
+		}
+		if garbage > 0 && float64(garbage) >= minRatio*float64(seg.size) {
+			segs = append(segs, seg)
+		}
+	}
+	self.lock.RUnlock()
+
+	for _, seg := range segs {
+		select {
+		case <-self.done:
+			return nil
+		default:
+		}
+
+		if err := self.compactSegment(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactSegment copies the current records in seg to the active segment and
+// removes seg. The caller must hold the compaction lock.
+func (self *LogStore) compactSegment(seg *logSegment) error {
+	self.lock.RLock()
+	oldest := seg == self.segments[0]
+	size, live := seg.size, seg.live
+	self.lock.RUnlock()
+
+	if glog.V(1) {
+		glog.Infof("Compacting %s, %d of %d bytes are current", seg.file.Name(),
+			live, size)
+	}
+
+	// Full segments are never written to, so they can be read without the
+	// lock. Records are checked and copied one at a time to keep writers
+	// waiting as little as possible.
+	var copyErr error
+	var offset int64
+	err := readRecords(seg.file, size, func(offset int64, rec []byte, key string, tombstone bool) bool {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+
+		entry, ok := self.index[key]
+		if !ok || entry.seg != seg || entry.offset != offset {
+			return true
+		}
+
+		if tombstone && oldest {
+			self.forget(entry)
+			delete(self.index, key)
+			return true
+		}
+
+		_, value, _, _ := decodeRecord(rec)
+		copyErr = self.append(key, value, tombstone)
+		return copyErr == nil
+	}, &offset)
+	if err == nil {
+		err = copyErr
+	}
+	if err == errBadRecord {
+		err = &StoreError{Class: Corrupt, Op: "compact", Key: seg.file.Name(), Err: err}
+	}
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	// The copies must be durable before the originals are removed.
+	err = self.active().file.Sync()
+	if err == nil {
+		for i := range self.segments {
+			if self.segments[i] == seg {
+				self.segments = append(self.segments[:i], self.segments[i+1:]...)
+				break
+			}
+		}
+	}
+	self.lock.Unlock()
+	if err != nil {
+		return &StoreError{Class: Permanent, Op: "compact", Key: seg.file.Name(), Err: err}
+	}
+
+	seg.file.Close()
+	if err := os.Remove(seg.file.Name()); err != nil {
+		return err
+	}
+	return syncDir(self.dir)
+}
+
+var _ KVStore = new(LogStore)
+var _ DeletableKVStore = new(LogStore)
+var _ CASKVStore = new(LogStore)
+var _ SyncableKVStore = new(LogStore)
+var _ ScannableKVStore = new(LogStore)
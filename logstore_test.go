@@ -0,0 +1,147 @@
+package gobuddyfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func logSegments(t *testing.T, dir string) []string {
+	segs, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	assert.NoError(t, err)
+	return segs
+}
+
+func TestLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := gobuddyfs.OpenLogStore(dir, gobuddyfs.LogStoreOptions{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Set("Foo", []byte("bar")))
+	assert.NoError(t, s.Set("Foo", []byte("baz")))
+	assert.NoError(t, s.Set("Empty", []byte{}))
+	assert.NoError(t, s.Set("Gone", []byte("gone")))
+	assert.NoError(t, s.Delete("Gone"))
+
+	r, err := s.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("baz"), r)
+	r, err = s.Get("Empty", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, r)
+	_, err = s.Get("Gone", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+
+	assert.Equal(t, gobuddyfs.ErrConflict, s.CompareAndSet("Foo", []byte("bar"), []byte("x")))
+	assert.NoError(t, s.CompareAndSet("Foo", []byte("baz"), []byte("x")))
+	assert.NoError(t, s.CompareAndSet("Gone", nil, []byte("back")))
+
+	keys := []string{}
+	err = s.Scan("", "", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Empty", "Foo", "Gone"}, keys)
+	assert.NoError(t, s.Close())
+
+	// The index is rebuilt from the log.
+	s, err = gobuddyfs.OpenLogStore(dir, gobuddyfs.LogStoreOptions{})
+	assert.NoError(t, err)
+	r, err = s.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("x"), r)
+	r, err = s.Get("Gone", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("back"), r)
+
+	// Only one store can use the directory at a time.
+	_, err = gobuddyfs.OpenLogStore(dir, gobuddyfs.LogStoreOptions{})
+	assert.True(t, isLocked(err))
+	assert.NoError(t, s.Close())
+}
+
+func TestLogStoreTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := gobuddyfs.OpenLogStore(dir, gobuddyfs.LogStoreOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set("Foo", []byte("bar")))
+	assert.NoError(t, s.Set("Baz", []byte("qux")))
+	assert.NoError(t, s.Close())
+
+	// Cut the last record short, as a crash in the middle of a write would.
+	segs := logSegments(t, dir)
+	assert.Len(t, segs, 1)
+	fi, err := os.Stat(segs[0])
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(segs[0], fi.Size()-2))
+
+	s, err = gobuddyfs.OpenLogStore(dir, gobuddyfs.LogStoreOptions{})
+	assert.NoError(t, err)
+	r, err := s.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), r)
+	_, err = s.Get("Baz", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+
+	// New records go after the last complete one.
+	assert.NoError(t, s.Set("Baz", []byte("quux")))
+	assert.NoError(t, s.Close())
+
+	s, err = gobuddyfs.OpenLogStore(dir, gobuddyfs.LogStoreOptions{})
+	assert.NoError(t, err)
+	r, err = s.Get("Baz", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("quux"), r)
+	assert.NoError(t, s.Close())
+}
+
+func TestLogStoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := gobuddyfs.LogStoreOptions{SegmentSize: 256}
+	s, err := gobuddyfs.OpenLogStore(dir, opts)
+	assert.NoError(t, err)
+
+	value := make([]byte, 100)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, s.Set("Foo", value))
+	}
+	assert.NoError(t, s.Set("Keep", []byte("keep")))
+	assert.NoError(t, s.Set("Gone", []byte("gone")))
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, s.Set("Bar"+strconv.Itoa(i), value))
+	}
+	assert.NoError(t, s.Delete("Gone"))
+
+	before := len(logSegments(t, dir))
+	assert.NoError(t, s.Compact())
+	after := len(logSegments(t, dir))
+	assert.True(t, after < before, "%d segments before, %d after", before, after)
+	assert.NoError(t, s.Close())
+
+	s, err = gobuddyfs.OpenLogStore(dir, opts)
+	assert.NoError(t, err)
+	r, err := s.Get("Keep", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("keep"), r)
+	_, err = s.Get("Gone", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+	r, err = s.Get("Bar4", false)
+	assert.NoError(t, err)
+	assert.Equal(t, value, r)
+	assert.NoError(t, s.Close())
+}
@@ -1,147 +1,228 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"os"
-	"os/user"
 	"runtime/pprof"
 	"time"
 
-	"bytes"
-
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"github.com/buddyfs/buddystore"
 	"github.com/buddyfs/gobuddyfs"
-	"github.com/golang/glog"
-	"github.com/steveyen/gkvlite"
 )
 
-var storeType = flag.String("store", "p2p",
-	"Type of backing store for filesystem. Options: mem|gkv|p2p")
+var storeURI = flag.String("store", "p2p",
+	"Backing store for filesystem. Options: mem[:///path/to/snapshot]|p2p|"+
+		"gkv[:///path/to/file][?collection=VOLUME]|dir:///path/to/dir[?sync=true]|"+
+		"log:///path/to/dir[?sync=true&compact_ratio=0.5]. "+
+		"Only one volume of a gkv file can be mounted at a time. "+
+		"Several stores separated by commas mirror each other")
+
+var writeQuorum = flag.Int("write_quorum", 0,
+	"Number of stores each write must reach. 0 requires all mirrored stores, "+
+		"or one more than -erasure_data erasure coded ones")
+
+var erasureData = flag.Int("erasure_data", 0,
+	"Erasure code values over the stores instead of mirroring them, with this "+
+		"many data shards and the remaining stores holding parity. 0 mirrors")
+
+var ring = flag.Bool("ring", false,
+	"Spread keys over the stores by consistent hashing instead of mirroring them. "+
+		"The stores must be the ring's members; see the ring subcommand")
+
+var cacheURI = flag.String("cache", "",
+	"Local store keeping recently used values of the backing store, e.g. "+
+		"dir:///var/cache/buddyfs. Its state is kept next to it. Nothing else may "+
+		"write to the backing store while it is cached")
+
+var cacheSize = flag.Int64("cache_size", 1<<30, "Size budget of the -cache store in bytes")
+
+var writeBack = flag.Bool("write_back", false,
+	"Complete writes once they are in the -cache store, and copy them to the "+
+		"backing store in the background")
+
+var keyFile = flag.String("key_file", "",
+	"Encrypt every value with keys unlocked by the contents of this file. "+
+		"Setting $BUDDYFS_PASSPHRASE uses that passphrase instead")
+
+var newKeyFile = flag.String("new_key_file", "",
+	"Key file to switch to in the rotate subcommand. $BUDDYFS_NEW_PASSPHRASE "+
+		"switches to a passphrase")
+
+var keyringKey = flag.String("keyring", "KEYRING",
+	"Key under which the encryption keys are stored in the backing store")
+
+var hashKeys = flag.Bool("hash_keys", false,
+	"Store the blocks of a new filesystem under keys derived from the encryption "+
+		"keys, so that its structure can't be told from the backing store's keys. "+
+		"Filesystems of different keys can share a backing store. Needs encryption")
+
+var compression = flag.String("compression", gobuddyfs.CompressNone,
+	"Compress the blocks of a new filesystem. Options: flate, or empty for none")
+
+var dedup = flag.Bool("dedup", false,
+	"Store the data blocks of a new filesystem by content, so that identical "+
+		"blocks are stored once. With encryption, needs -hash_keys")
+
+var chunking = flag.Bool("chunking", false,
+	"Split the files of a new filesystem into chunks by content, so that "+
+		"insertions don't change the later blocks. Best used with -dedup")
+
+var allocator = flag.String("allocator", gobuddyfs.AllocRandom,
+	"How a new filesystem allocates block ids. Options: counter, or empty for "+
+		"random")
+
+var scrubInterval = flag.Duration("scrub_interval", 0,
+	"Check every block of the filesystem for damage this often. 0 disables")
 
 var profile = flag.Bool("profile", true, "Enable profiling output")
 
+var getTimeout = flag.Duration("get_timeout", 0,
+	"Timeout for each read from the backing store. 0 waits forever")
+
+var setTimeout = flag.Duration("set_timeout", 0,
+	"Timeout for each write to the backing store. 0 waits forever")
+
+// Group commit is opt-in: by default, every write to a gkv store is committed
+// before it returns.
+var gkvCommitInterval = flag.Duration("gkv_commit_interval", 0,
+	"Longest a write to the gkv store stays buffered. 0 with -gkv_commit_bytes 0 commits every write")
+
+var gkvCommitBytes = flag.Int("gkv_commit_bytes", 0,
+	"Commit the gkv store once this many bytes are buffered. 0 sets no limit")
+
+var gkvCompactRatio = flag.Float64("gkv_compact_ratio", 0,
+	"Compact the gkv store while mounted once this fraction of it is garbage. 0 disables")
+
+var retries = flag.Int("retries", gobuddyfs.DefaultRetryPolicy.MaxAttempts,
+	"Attempts made for each p2p store operation before giving up")
+
+var retryBackoff = flag.Duration("retry_backoff",
+	gobuddyfs.DefaultRetryPolicy.InitialBackoff,
+	"Wait before the first retry of a failed p2p store operation")
+
 var PORT uint = 9000
 var TIMEOUT time.Duration = time.Duration(20 * time.Millisecond)
 
 var Usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s MOUNTPOINT\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s compact [STORE]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s volumes [STORE]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s rotate\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s ring add|remove STORE\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
-func getBuddyStoreClient() gobuddyfs.KVStore {
-	// TODO: Replace OS username with PGP key
-	currentUser, _ := user.Current()
-	glog.Infof("Logging in as user: %s", currentUser.Name)
-	config := &buddystore.BuddyStoreConfig{MyID: currentUser.Name}
-	bStore := buddystore.NewBuddyStore(config)
-	kvStore, errno := bStore.GetMyKVClient()
-
-	if errno != buddystore.OK {
-		// If there is an error instantiating the KV client, not much to do.
-		// Spit out an error and die.
-		glog.Fatalf("Error getting KVClient instance from Buddystore. %d", errno)
-		os.Exit(1)
-	}
-
-	return kvStore
-}
-
-func getInMemoryKVStoreClient() gobuddyfs.KVStore {
-	return gobuddyfs.NewMemStore()
-}
+func main() {
+	flag.Usage = Usage
+	flag.Parse()
 
-func getGKVStoreClient() (gobuddyfs.KVStore, func()) {
-	const buddyfs string = "BuddyFS"
-	f, err := os.OpenFile("/tmp/test.gkvlite", os.O_RDWR|os.O_CREATE, 0660)
-	if err != nil {
-		glog.Fatal(err)
+	if flag.NArg() >= 1 {
+		switch flag.Arg(0) {
+		case "compact":
+			compact(flag.Args()[1:])
+			return
+		case "volumes":
+			volumes(flag.Args()[1:])
+			return
+		case "rotate":
+			if err := rotate(flag.Args()[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "ring":
+			if err := ringMembers(flag.Args()[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
 	}
 
-	s, err := gkvlite.NewStore(f)
-	if err != nil {
-		glog.Fatal(err)
+	if flag.NArg() != 1 {
+		Usage()
+		os.Exit(2)
 	}
+	mountpoint := flag.Arg(0)
 
-	c := s.GetCollection(buddyfs)
-	if c == nil {
-		c = s.SetCollection(buddyfs, bytes.Compare)
+	if *compression != gobuddyfs.CompressNone && *compression != gobuddyfs.CompressFlate {
+		log.Fatalf("Unknown compression %q", *compression)
+	}
+	if *allocator != gobuddyfs.AllocRandom && *allocator != gobuddyfs.AllocCounter {
+		log.Fatalf("Unknown allocator %q", *allocator)
 	}
 
-	return gobuddyfs.NewGKVStore(c, s), func() {
-		c.Write()
-		s.Close()
-		s.Flush()
-		f.Sync()
+	if err := mount(mountpoint); err != nil {
+		log.Fatal(err)
 	}
 }
 
-func main() {
-	rand.Seed(time.Now().UTC().UnixNano())
-	flag.Usage = Usage
-	flag.Parse()
+// mount serves the filesystem at mountpoint until it is unmounted. Errors are
+// returned rather than fatal, so that the store is always closed.
+func mount(mountpoint string) error {
+	// Open the store first, so that a store which is already in use fails
+	// before anything is mounted.
+	kvStore, cleanup, err := openAll()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 
-	if flag.NArg() != 1 {
-		Usage()
-		os.Exit(2)
+	// The keys of a volume with hashed keys are derived from the keyring.
+	var keyMaterial []byte
+	if encrypted, ok := kvStore.(*gobuddyfs.EncryptedKVStore); ok {
+		if keyMaterial, err = encrypted.KeyMaterial(); err != nil {
+			return err
+		}
+		if *dedup && !*hashKeys {
+			// Content hashes would show which blocks the store holds.
+			return errors.New("-dedup with encryption needs -hash_keys")
+		}
+	} else if *hashKeys {
+		return errors.New("-hash_keys needs encryption; set -key_file or $BUDDYFS_PASSPHRASE")
 	}
-	mountpoint := flag.Arg(0)
 
 	c, err := fuse.Mount(mountpoint, fuse.FSName("gobuddyfs"),
 		fuse.Subtype("buddyfs"), fuse.LocalVolume())
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer c.Close()
 
 	if *profile {
 		f, err := os.Create("buddyfs.prof")
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 
 		heapproff, err := os.Create("buddyfs.heap")
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 		defer pprof.WriteHeapProfile(heapproff)
 	}
 
-	var kvStore gobuddyfs.KVStore
-	var cleanup func()
-
-	switch *storeType {
-	case "mem":
-		kvStore = getInMemoryKVStoreClient()
-	case "gkv":
-		kvStore, cleanup = getGKVStoreClient()
-	case "p2p":
-		kvStore = getBuddyStoreClient()
-	default:
-		log.Fatal("Unknown store type", storeType)
-		os.Exit(2)
+	bfs := gobuddyfs.NewBuddyFS(kvStore)
+	bfs.HashKeys = *hashKeys
+	bfs.KeyMaterial = keyMaterial
+	bfs.Compression = *compression
+	bfs.Dedup = *dedup
+	bfs.Chunking = *chunking
+	bfs.Allocator = *allocator
+	if *scrubInterval > 0 {
+		defer bfs.StartScrubber(*scrubInterval)()
 	}
-
-	if cleanup != nil {
-		defer cleanup()
-	}
-
-	err = fs.Serve(c, gobuddyfs.NewBuddyFS(kvStore))
-	if err != nil {
-		log.Fatal(err)
+	if err := fs.Serve(c, bfs); err != nil {
+		return err
 	}
 
 	// check if the mount process has an error to report
 	<-c.Ready
-	if err := c.MountError; err != nil {
-		log.Fatal(err)
-	}
+	return c.MountError
 }
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/buddyfs/buddystore"
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/golang/glog"
+)
+
+// The backing store is named by a URI whose scheme selects the kind of store,
+// e.g. gkv:///var/lib/buddyfs/home.db?collection=home. Stores which need no
+// further configuration can be named by the scheme alone.
+
+// Used by a bare "gkv" store, for compatibility with older versions.
+const (
+	defaultGKVPath   = "/tmp/test.gkvlite"
+	defaultGKVVolume = "BuddyFS"
+)
+
+func parseStoreURI(uri string) (*url.URL, error) {
+	if !strings.Contains(uri, ":") {
+		return &url.URL{Scheme: uri}, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid store %q: %s", uri, err)
+	}
+	return u, nil
+}
+
+// openStores opens the stores named by a comma-separated list of URIs. More
+// than one store are mirrored, with the first one as the primary. With
+// -erasure_data set they hold erasure coded shards of every value instead, and
+// with -ring each key is kept by one of them.
+func openStores(uris string) (gobuddyfs.KVStore, func(), error) {
+	var children []gobuddyfs.KVStore
+	var cleanups []func()
+	cleanup := func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+
+	uriList := strings.Split(uris, ",")
+	for _, uri := range uriList {
+		u, err := parseStoreURI(uri)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+
+		kvStore, c, err := openStore(u)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+
+		children = append(children, wrapStore(u, kvStore))
+		if c != nil {
+			cleanups = append(cleanups, c)
+		}
+	}
+
+	if *ring {
+		kvStore, c, err := openRing(uriList, children)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		cleanups = append(cleanups, c)
+		return kvStore, cleanup, nil
+	}
+
+	if *erasureData > 0 {
+		kvStore, err := gobuddyfs.NewErasureKVStore(children, *erasureData,
+			len(children)-*erasureData, *writeQuorum)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		return kvStore, cleanup, nil
+	}
+
+	if len(children) == 1 {
+		return children[0], cleanup, nil
+	}
+	return gobuddyfs.NewMirrorKVStore(children, *writeQuorum), cleanup, nil
+}
+
+// openRing puts stores, named by names, on a ring. They must be the members
+// the ring last had, which are recorded in them; the ring subcommand changes
+// them. Stores which hold no record start a new ring.
+//
+// If a change of members was interrupted, the stores may be the members
+// before or after it. The others are opened by their names, and the change is
+// resumed. The returned cleanup function closes them.
+func openRing(names []string, stores []gobuddyfs.KVStore) (*gobuddyfs.RingKVStore, func(), error) {
+	opened := make(map[string]gobuddyfs.KVStore)
+	for i, name := range names {
+		opened[name] = stores[i]
+	}
+
+	recorded, previous, err := gobuddyfs.LoadRingMembers(stores)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if recorded == nil {
+		kvStore := gobuddyfs.NewRingKVStoreWithMembers(opened, 0)
+		return kvStore, func() {}, kvStore.SaveMembers()
+	}
+
+	given := strings.Join(sortedNames(opened), ",")
+	if given != strings.Join(recorded, ",") &&
+		(previous == nil || given != strings.Join(previous, ",")) {
+		return nil, nil, fmt.Errorf("Ring members are %s, not %s; use the ring subcommand to change them",
+			strings.Join(recorded, ","), given)
+	}
+	if previous == nil {
+		return gobuddyfs.NewRingKVStoreWithMembers(opened, 0), func() {}, nil
+	}
+
+	var cleanups []func()
+	cleanup := func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+	members := func(names []string) (map[string]gobuddyfs.KVStore, error) {
+		m := make(map[string]gobuddyfs.KVStore)
+		for _, name := range names {
+			if store, ok := opened[name]; ok {
+				m[name] = store
+				continue
+			}
+
+			u, err := parseStoreURI(name)
+			if err != nil {
+				return nil, err
+			}
+			store, c, err := openStore(u)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				cleanups = append(cleanups, c)
+			}
+			opened[name] = wrapStore(u, store)
+			m[name] = opened[name]
+		}
+		return m, nil
+	}
+
+	prevMembers, err := members(previous)
+	if err == nil {
+		var curMembers map[string]gobuddyfs.KVStore
+		if curMembers, err = members(recorded); err == nil {
+			glog.Infof("Resuming change of ring members from %s to %s",
+				strings.Join(previous, ","), strings.Join(recorded, ","))
+			return gobuddyfs.ResumeRingKVStore(prevMembers, curMembers, 0), cleanup, nil
+		}
+	}
+	cleanup()
+	return nil, nil, err
+}
+
+func sortedNames(stores map[string]gobuddyfs.KVStore) []string {
+	var names []string
+	for name := range stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ringMembers adds the store named by args[1] to the ring of -store, or
+// removes it, and waits until the keys have been moved. -store must then be
+// changed to match. Running it again after it was interrupted finishes the
+// change.
+func ringMembers(args []string) error {
+	if len(args) != 2 || args[0] != "add" && args[0] != "remove" {
+		Usage()
+		os.Exit(2)
+	}
+	if !*ring {
+		return errors.New("Not a ring; set -ring")
+	}
+
+	kvStore, cleanup, err := openStores(*storeURI)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	r := kvStore.(*gobuddyfs.RingKVStore)
+	// Finish a change which was interrupted, which may be this one.
+	if err := r.Wait(); err != nil {
+		return err
+	}
+
+	name := args[1]
+	isMember := false
+	for _, member := range r.Members() {
+		isMember = isMember || member == name
+	}
+	if isMember == (args[0] == "add") {
+		fmt.Printf("Ring members are %s\n", strings.Join(r.Members(), ","))
+		return nil
+	}
+
+	if args[0] == "add" {
+		u, err := parseStoreURI(name)
+		if err != nil {
+			return err
+		}
+		store, c, err := openStore(u)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			defer c()
+		}
+		err = r.AddMember(name, wrapStore(u, store))
+	} else {
+		err = r.RemoveMember(name)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := r.Wait(); err != nil {
+		return err
+	}
+	fmt.Printf("Ring members are now %s\n", strings.Join(r.Members(), ","))
+	return nil
+}
+
+// openAll opens the stores named by -store, with the cache and encryption
+// layers the flags ask for on top.
+func openAll() (gobuddyfs.KVStore, func(), error) {
+	kvStore, cleanup, err := openStores(*storeURI)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cached, cacheCleanup, err := openCache(kvStore, cleanup)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	secret, err := readSecret(*keyFile, "BUDDYFS_PASSPHRASE")
+	if err != nil || secret == nil {
+		if err != nil {
+			cacheCleanup()
+		}
+		return cached, cacheCleanup, err
+	}
+
+	// Values are encrypted before they are cached, so that the cache holds
+	// nothing in the clear either.
+	encrypted, err := gobuddyfs.OpenEncryptedKVStore(cached, secret,
+		gobuddyfs.EncryptionOptions{KeyringKey: *keyringKey})
+	if err != nil {
+		cacheCleanup()
+		return nil, nil, err
+	}
+	return encrypted, cacheCleanup, nil
+}
+
+// readSecret returns the contents of keyFile, or the passphrase in the
+// environment variable env if no file is given. It returns nil if there is
+// neither.
+func readSecret(keyFile, env string) ([]byte, error) {
+	if keyFile != "" {
+		return ioutil.ReadFile(keyFile)
+	}
+	if passphrase := os.Getenv(env); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, nil
+}
+
+// rotate switches an encrypted filesystem to a new data key and re-encrypts
+// everything stored with older ones. With -new_key_file or
+// $BUDDYFS_NEW_PASSPHRASE set, the keyring is also locked with the new secret.
+func rotate(args []string) error {
+	if len(args) != 0 {
+		Usage()
+		os.Exit(2)
+	}
+
+	kvStore, cleanup, err := openAll()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	encrypted, ok := kvStore.(*gobuddyfs.EncryptedKVStore)
+	if !ok {
+		return errors.New("Not encrypted; set -key_file or $BUDDYFS_PASSPHRASE")
+	}
+
+	newSecret, err := readSecret(*newKeyFile, "BUDDYFS_NEW_PASSPHRASE")
+	if err != nil {
+		return err
+	}
+	if newSecret != nil {
+		if err := encrypted.ChangeSecret(newSecret); err != nil {
+			return err
+		}
+	}
+
+	if err := encrypted.Rotate(); err != nil {
+		return err
+	}
+	n, err := encrypted.Reencrypt()
+	if err != nil {
+		return err
+	}
+	if err := encrypted.Sync(); err != nil {
+		return err
+	}
+	fmt.Printf("Re-encrypted %d values\n", n)
+	return nil
+}
+
+// openCache puts the store named by -cache in front of remote, if there is
+// one. The cache's state is kept in a file next to it, so that a cache which
+// is kept on disk is still used after a restart.
+func openCache(remote gobuddyfs.KVStore, remoteCleanup func()) (gobuddyfs.KVStore, func(), error) {
+	if *cacheURI == "" {
+		return remote, remoteCleanup, nil
+	}
+
+	u, err := parseStoreURI(*cacheURI)
+	if err != nil {
+		return nil, nil, err
+	}
+	cache, cacheCleanup, err := openStore(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cacheCleanup == nil {
+		cacheCleanup = func() {}
+	}
+
+	opts := gobuddyfs.TieredKVStoreOptions{MaxBytes: *cacheSize, WriteBack: *writeBack}
+	if u.Scheme == "gkv" {
+		path, volume := gkvVolume(u)
+		opts.StatePath = path + "." + volume + ".state"
+	} else if path := storePath(u); path != "" {
+		opts.StatePath = path + ".state"
+	}
+
+	kvStore, err := gobuddyfs.NewTieredKVStore(cache, remote, opts)
+	if err != nil {
+		cacheCleanup()
+		return nil, nil, err
+	}
+
+	return kvStore, func() {
+		if err := kvStore.Close(); err != nil {
+			glog.Errorf("Error while closing cache: %q", err)
+		}
+		cacheCleanup()
+		remoteCleanup()
+	}, nil
+}
+
+// wrapStore applies the timeout and retry flags to the store named by u.
+func wrapStore(u *url.URL, kvStore gobuddyfs.KVStore) gobuddyfs.KVStore {
+	if *getTimeout > 0 || *setTimeout > 0 {
+		kvStore = gobuddyfs.NewTimeoutKVStore(kvStore, *getTimeout, *setTimeout)
+	}
+
+	if u.Scheme == "p2p" && *retries > 1 {
+		policy := gobuddyfs.DefaultRetryPolicy
+		policy.MaxAttempts = *retries
+		policy.InitialBackoff = *retryBackoff
+		// Timeouts apply to each attempt, so a hung lookup is retried too.
+		kvStore = gobuddyfs.NewRetryingKVStore(kvStore, policy, p2pRetryable)
+	}
+	return kvStore
+}
+
+// openStore opens the store named by u. The returned cleanup function, if
+// any, must be called once the filesystem is unmounted.
+func openStore(u *url.URL) (gobuddyfs.KVStore, func(), error) {
+	switch u.Scheme {
+	case "mem":
+		return getInMemoryKVStoreClient(u)
+	case "gkv":
+		return getGKVStoreClient(u)
+	case "dir":
+		return getDirStoreClient(u)
+	case "log":
+		return getLogStoreClient(u)
+	case "p2p":
+		return getBuddyStoreClient(), nil, nil
+	}
+	return nil, nil, fmt.Errorf("Unknown store type %q", u.Scheme)
+}
+
+func getBuddyStoreClient() gobuddyfs.KVStore {
+	// TODO: Replace OS username with PGP key
+	currentUser, _ := user.Current()
+	glog.Infof("Logging in as user: %s", currentUser.Name)
+	config := &buddystore.BuddyStoreConfig{MyID: currentUser.Name}
+	bStore := buddystore.NewBuddyStore(config)
+	kvStore, errno := bStore.GetMyKVClient()
+
+	if errno != buddystore.OK {
+		// If there is an error instantiating the KV client, not much to do.
+		// Spit out an error and die.
+		glog.Fatalf("Error getting KVClient instance from Buddystore. %d", errno)
+		os.Exit(1)
+	}
+
+	return kvStore
+}
+
+// p2pRetryable decides which buddystore errors are worth retrying. The DHT
+// client doesn't classify its errors, so everything except a definite miss or
+// a damaged value is assumed to be a transient network problem.
+func p2pRetryable(err error) bool {
+	return err != gobuddyfs.ErrNotFound && !gobuddyfs.IsCorrupt(err)
+}
+
+// storePath returns the file named by a store URI, which may be absolute, as
+// in mem:///var/tmp/scratch, or relative, as in mem:scratch.
+func storePath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Path
+}
+
+// getInMemoryKVStoreClient returns an empty MemStore, or for mem:PATH one
+// loaded from the snapshot at PATH. The snapshot is saved again on unmount
+// and whenever the process receives SIGUSR1.
+//
+// mem:?shards=N spreads the keys over N separately locked maps instead, which
+// can't be snapshotted.
+func getInMemoryKVStoreClient(u *url.URL) (gobuddyfs.KVStore, func(), error) {
+	path := storePath(u)
+	if shards := u.Query().Get("shards"); shards != "" {
+		n, err := strconv.Atoi(shards)
+		if err != nil || n < 1 {
+			return nil, nil, fmt.Errorf("Invalid shard count %q", shards)
+		}
+		if path != "" {
+			return nil, nil, fmt.Errorf("Sharded mem stores can't be snapshotted")
+		}
+		return gobuddyfs.NewShardedMemStore(n), nil, nil
+	}
+
+	kvStore := gobuddyfs.NewMemStore()
+	if path == "" {
+		return kvStore, nil, nil
+	}
+
+	err := kvStore.LoadSnapshot(path)
+	if os.IsNotExist(err) {
+		glog.Infof("No snapshot at %s, starting empty", path)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	save := func() {
+		if err := kvStore.SaveSnapshot(path); err != nil {
+			glog.Errorf("Error while saving snapshot to %s: %q", path, err)
+		} else {
+			glog.Infof("Saved snapshot to %s", path)
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			save()
+		}
+	}()
+
+	return kvStore, func() {
+		signal.Stop(sigs)
+		save()
+	}, nil
+}
+
+// gkvVolume returns the file and collection named by a gkv store URI. Each
+// collection in the file holds a separate filesystem, but the whole file is
+// locked while any of them is mounted.
+func gkvVolume(u *url.URL) (path, volume string) {
+	path = storePath(u)
+	if path == "" {
+		path = defaultGKVPath
+	}
+
+	volume = u.Query().Get("collection")
+	if volume == "" {
+		volume = defaultGKVVolume
+	}
+	return path, volume
+}
+
+func getGKVStoreClient(u *url.URL) (gobuddyfs.KVStore, func(), error) {
+	path, volume := gkvVolume(u)
+	kvStore, err := gobuddyfs.OpenGKVStore(path, volume, gobuddyfs.GKVStoreOptions{
+		CommitInterval: *gkvCommitInterval, MaxDirtyBytes: *gkvCommitBytes,
+		CompactRatio: *gkvCompactRatio})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	glog.Infof("Using volume %s of %s", volume, path)
+	return kvStore, func() {
+		if err := kvStore.Close(); err != nil {
+			glog.Errorf("Error while closing gkv store: %q", err)
+		}
+	}, nil
+}
+
+// getDirStoreClient opens a DirStore in the directory named by a dir store
+// URI. dir:PATH?sync=true syncs every write as it happens.
+func getDirStoreClient(u *url.URL) (gobuddyfs.KVStore, func(), error) {
+	path := storePath(u)
+	if path == "" {
+		return nil, nil, fmt.Errorf("Missing directory in store %q", u)
+	}
+
+	var opts gobuddyfs.DirStoreOptions
+	if sync := u.Query().Get("sync"); sync != "" {
+		var err error
+		if opts.Sync, err = strconv.ParseBool(sync); err != nil {
+			return nil, nil, fmt.Errorf("Invalid sync option %q", sync)
+		}
+	}
+
+	kvStore, err := gobuddyfs.OpenDirStore(path, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return kvStore, func() {
+		if err := kvStore.Close(); err != nil {
+			glog.Errorf("Error while closing dir store: %q", err)
+		}
+	}, nil
+}
+
+// getLogStoreClient opens a LogStore in the directory named by a log store
+// URI. log:PATH?sync=true syncs every write as it happens, and compact_ratio
+// sets the share of garbage at which a segment is compacted.
+func getLogStoreClient(u *url.URL) (gobuddyfs.KVStore, func(), error) {
+	path := storePath(u)
+	if path == "" {
+		return nil, nil, fmt.Errorf("Missing directory in store %q", u)
+	}
+
+	opts := gobuddyfs.LogStoreOptions{CompactRatio: 0.5}
+	query := u.Query()
+	if sync := query.Get("sync"); sync != "" {
+		var err error
+		if opts.Sync, err = strconv.ParseBool(sync); err != nil {
+			return nil, nil, fmt.Errorf("Invalid sync option %q", sync)
+		}
+	}
+	if ratio := query.Get("compact_ratio"); ratio != "" {
+		var err error
+		if opts.CompactRatio, err = strconv.ParseFloat(ratio, 64); err != nil {
+			return nil, nil, fmt.Errorf("Invalid compact_ratio option %q", ratio)
+		}
+	}
+
+	kvStore, err := gobuddyfs.OpenLogStore(path, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return kvStore, func() {
+		if err := kvStore.Close(); err != nil {
+			glog.Errorf("Error while closing log store: %q", err)
+		}
+	}, nil
+}
+
+// gkvFileArg returns the gkv file named by the optional argument of a
+// subcommand, which may be a gkv store URI or a plain path. Without an
+// argument, the first gkv store of the -store flag is used.
+func gkvFileArg(args []string) string {
+	if len(args) > 1 {
+		Usage()
+		os.Exit(2)
+	}
+
+	uris := strings.Split(*storeURI, ",")
+	if len(args) == 1 {
+		if !strings.HasPrefix(args[0], "gkv:") {
+			return args[0]
+		}
+		uris = args
+	}
+
+	for _, uri := range uris {
+		u, err := parseStoreURI(uri)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if u.Scheme == "gkv" {
+			path, _ := gkvVolume(u)
+			return path
+		}
+	}
+
+	log.Fatalf("Not a gkv store: %s", strings.Join(uris, ","))
+	return ""
+}
+
+// compact compacts an unmounted gkv store file.
+func compact(args []string) {
+	if err := gobuddyfs.CompactGKVFile(gkvFileArg(args)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// volumes lists the volumes in an unmounted gkv store file.
+func volumes(args []string) {
+	names, err := gobuddyfs.ListGKVVolumes(gkvFileArg(args))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
@@ -0,0 +1,182 @@
+package gobuddyfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A MemStore snapshot is the magic string, the number of entries, and then
+// for every entry the key length, value length, key and value, followed by a
+// CRC32 of everything before it. Integers are big-endian; lengths and the
+// checksum are 32 bits, the entry count 64 bits.
+
+var snapshotMagic = []byte("BFSMEM01")
+
+// errBadSnapshot is wrapped in a Corrupt StoreError when a snapshot is
+// truncated or fails its checksum.
+var errBadSnapshot = errors.New("invalid MemStore snapshot")
+
+// WriteSnapshot writes every key in the store to w. Writes made while the
+// snapshot is being written may or may not be included.
+func (self *MemStore) WriteSnapshot(w io.Writer) error {
+	self.lock.RLock()
+	keys := make([]string, 0, len(self.store))
+	values := make(map[string][]byte, len(self.store))
+	for key, value := range self.store {
+		keys = append(keys, key)
+		// Callers may still hold on to a value they stored, so it is copied
+		// while the lock keeps it from being changed through the store.
+		values[key] = append([]byte(nil), value...)
+	}
+	self.lock.RUnlock()
+
+	sort.Strings(keys)
+
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	var hdr [8]byte
+	bw.Write(snapshotMagic)
+	binary.BigEndian.PutUint64(hdr[:], uint64(len(keys)))
+	bw.Write(hdr[:])
+
+	for _, key := range keys {
+		value := values[key]
+		binary.BigEndian.PutUint32(hdr[:4], uint32(len(key)))
+		binary.BigEndian.PutUint32(hdr[4:], uint32(len(value)))
+		bw.Write(hdr[:])
+		bw.WriteString(key)
+		bw.Write(value)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(hdr[:4], crc.Sum32())
+	_, err := w.Write(hdr[:4])
+	return err
+}
+
+// ReadSnapshot replaces the contents of the store with a snapshot read from
+// r. If the snapshot is damaged, the store is left unchanged.
+func (self *MemStore) ReadSnapshot(r io.Reader) error {
+	crc := crc32.NewIEEE()
+	br := io.TeeReader(bufio.NewReader(r), crc)
+
+	var hdr [8]byte
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return badSnapshot(err)
+	}
+	if !bytes.Equal(magic, snapshotMagic) {
+		return badSnapshot(nil)
+	}
+
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return badSnapshot(err)
+	}
+	count := binary.BigEndian.Uint64(hdr[:])
+
+	store := make(map[string][]byte)
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return badSnapshot(err)
+		}
+		keyLen := binary.BigEndian.Uint32(hdr[:4])
+		valueLen := binary.BigEndian.Uint32(hdr[4:])
+
+		// Read through a LimitReader rather than allocating the lengths up
+		// front, so a damaged length can't exhaust memory.
+		var entry bytes.Buffer
+		n, err := io.Copy(&entry, io.LimitReader(br, int64(keyLen)+int64(valueLen)))
+		if err != nil {
+			return badSnapshot(err)
+		}
+		if n != int64(keyLen)+int64(valueLen) {
+			return badSnapshot(io.ErrUnexpectedEOF)
+		}
+
+		data := entry.Bytes()
+		value := data[keyLen:]
+		if value == nil {
+			// Empty, not missing.
+			value = []byte{}
+		}
+		store[string(data[:keyLen])] = value
+	}
+
+	sum := crc.Sum32()
+	if _, err := io.ReadFull(br, hdr[:4]); err != nil {
+		return badSnapshot(err)
+	}
+	if binary.BigEndian.Uint32(hdr[:4]) != sum {
+		return badSnapshot(nil)
+	}
+
+	self.lock.Lock()
+	self.store = store
+	self.lock.Unlock()
+
+	return nil
+}
+
+func badSnapshot(err error) error {
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errBadSnapshot
+	}
+	return &StoreError{Class: Corrupt, Op: "load", Key: "snapshot", Err: err}
+}
+
+// SaveSnapshot writes a snapshot of the store to the file at path. The file
+// is replaced atomically, so a crash leaves either the old or the new
+// snapshot in place.
+func (self *MemStore) SaveSnapshot(path string) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+
+	err = self.WriteSnapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// LoadSnapshot replaces the contents of the store with the snapshot in the
+// file at path.
+func (self *MemStore) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := self.ReadSnapshot(f); err != nil {
+		if sErr, ok := err.(*StoreError); ok {
+			sErr.Key = path
+		}
+		return err
+	}
+	return nil
+}
@@ -1,9 +1,12 @@
 package gobuddyfs
 
 import (
+	"bytes"
+	"sort"
 	"sync"
 
 	"github.com/golang/glog"
+	"golang.org/x/net/context"
 )
 
 type MemStore struct {
@@ -26,7 +29,7 @@ func (self *MemStore) Get(key string, retry bool) ([]byte, error) {
 	val, ok := self.store[key]
 
 	if !ok {
-		return nil, nil
+		return nil, ErrNotFound
 	}
 
 	return val, nil
@@ -49,4 +52,71 @@ func (self *MemStore) Set(key string, value []byte) error {
 	return nil
 }
 
+func (self *MemStore) Delete(key string) error {
+	return self.Set(key, nil)
+}
+
+func (self *MemStore) CompareAndSet(key string, expected, value []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	current, ok := self.store[key]
+	if ok != (expected != nil) || !bytes.Equal(current, expected) {
+		return ErrConflict
+	}
+
+	if value == nil {
+		delete(self.store, key)
+	} else {
+		self.store[key] = value
+	}
+
+	return nil
+}
+
+func (self *MemStore) Scan(start, end string, visit ScanFunc) error {
+	self.lock.RLock()
+	keys := make([]string, 0, len(self.store))
+	for key := range self.store {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	self.lock.RUnlock()
+
+	sort.Strings(keys)
+
+	// Visit without holding the lock, so that visit can modify the store.
+	for _, key := range keys {
+		value, err := self.Get(key, false)
+		if err == ErrNotFound {
+			// Deleted since the keys were collected.
+			continue
+		}
+		if !visit(key, value) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (self *MemStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return self.Get(key, retry)
+}
+
+func (self *MemStore) SetContext(ctx context.Context, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return self.Set(key, value)
+}
+
 var _ KVStore = new(MemStore)
+var _ ContextKVStore = new(MemStore)
+var _ DeletableKVStore = new(MemStore)
+var _ CASKVStore = new(MemStore)
+var _ ScannableKVStore = new(MemStore)
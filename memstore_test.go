@@ -2,12 +2,17 @@ package gobuddyfs_test
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 
+	"bazil.org/fuse"
 	"github.com/buddyfs/gobuddyfs"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 func TestGetSet(t *testing.T) {
@@ -21,6 +26,48 @@ func TestGetSet(t *testing.T) {
 	assert.Equal(t, bar, r)
 }
 
+func TestGetMissing(t *testing.T) {
+	s := gobuddyfs.NewMemStore()
+	s.Set("Foo", []byte("bar"))
+	s.Set("Foo", nil)
+
+	r, err := s.Get("Foo", false)
+
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+	assert.Nil(t, r)
+}
+
+func TestDeleteAndScan(t *testing.T) {
+	s := gobuddyfs.NewMemStore()
+	for _, key := range []string{"a1", "b1", "b2", "b3", "c1"} {
+		s.Set(key, []byte(key))
+	}
+	assert.NoError(t, s.Delete("b2"))
+	assert.NoError(t, s.Delete("missing"))
+
+	keys := []string{}
+	err := gobuddyfs.ScanPrefix(s, "b", func(key string, value []byte) bool {
+		assert.Equal(t, key, string(value))
+		keys = append(keys, key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b1", "b3"}, keys)
+
+	keys = []string{}
+	err = s.Scan("b3", "", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		// Deleting while scanning must not deadlock.
+		s.Delete(key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b3", "c1"}, keys)
+
+	_, err = s.Get("c1", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+}
+
 func TestParallelGetSet(t *testing.T) {
 	s := gobuddyfs.NewMemStore()
 	bar := []byte("bar")
@@ -67,8 +114,99 @@ func TestParallelGetSet(t *testing.T) {
 	}
 }
 
-func BenchmarkSets(b *testing.B) {
+func TestShardedMemStore(t *testing.T) {
+	s := gobuddyfs.NewShardedMemStore(4)
+	for i := 0; i < 20; i++ {
+		key := strconv.Itoa(i)
+		assert.NoError(t, s.Set(key, []byte(key)))
+	}
+
+	r, err := s.Get("7", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("7"), r)
+
+	assert.NoError(t, s.Set("7", nil))
+	_, err = s.Get("7", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+
+	assert.Equal(t, gobuddyfs.ErrConflict, s.CompareAndSet("8", []byte("9"), []byte("x")))
+	assert.NoError(t, s.CompareAndSet("8", []byte("8"), []byte("x")))
+	assert.NoError(t, s.CompareAndSet("7", nil, []byte("7")))
+
+	// Scans are ordered across shards.
+	keys := []string{}
+	err = s.Scan("1", "2", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "10", "11", "12", "13", "14", "15", "16", "17", "18", "19"}, keys)
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/mem.snapshot"
+
+	s := gobuddyfs.NewMemStore()
+	s.Set("Foo", []byte("bar"))
+	s.Set("Empty", []byte{})
+	s.Set("", []byte("empty key"))
+	assert.NoError(t, s.SaveSnapshot(path))
+
+	loaded := gobuddyfs.NewMemStore()
+	loaded.Set("Stale", []byte("stale"))
+	assert.NoError(t, loaded.LoadSnapshot(path))
+
+	r, err := loaded.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), r)
+	r, err = loaded.Get("Empty", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, r)
+	r, err = loaded.Get("", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("empty key"), r)
+	_, err = loaded.Get("Stale", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
 	s := gobuddyfs.NewMemStore()
+	s.Set("Foo", []byte("bar"))
+
+	var buf bytes.Buffer
+	assert.NoError(t, s.WriteSnapshot(&buf))
+	snapshot := buf.Bytes()
+
+	damaged := append([]byte(nil), snapshot...)
+	damaged[len(damaged)-6] ^= 1
+	truncated := snapshot[:len(snapshot)-1]
+
+	for _, data := range [][]byte{damaged, truncated, []byte("junk")} {
+		loaded := gobuddyfs.NewMemStore()
+		loaded.Set("Foo", []byte("old"))
+
+		err := loaded.ReadSnapshot(bytes.NewReader(data))
+		assert.True(t, gobuddyfs.IsCorrupt(err))
+
+		// The store is left as it was.
+		r, err := loaded.Get("Foo", false)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("old"), r)
+	}
+}
+
+func BenchmarkSets(b *testing.B) {
+	benchmarkSets(b, gobuddyfs.NewMemStore())
+}
+
+func BenchmarkShardedSets(b *testing.B) {
+	benchmarkSets(b, gobuddyfs.NewShardedMemStore(16))
+}
+
+func benchmarkSets(b *testing.B, s gobuddyfs.KVStore) {
 	keyChan := make(chan string, b.N)
 
 	bar := []byte("bar")
@@ -97,3 +235,44 @@ func BenchmarkSets(b *testing.B) {
 	close(keyChan)
 	wg.Wait()
 }
+
+func BenchmarkFlushes(b *testing.B) {
+	benchmarkFlushes(b, gobuddyfs.NewMemStore())
+}
+
+func BenchmarkShardedFlushes(b *testing.B) {
+	benchmarkFlushes(b, gobuddyfs.NewShardedMemStore(16))
+}
+
+// benchmarkFlushes writes and flushes a separate file from every goroutine.
+func benchmarkFlushes(b *testing.B, s gobuddyfs.KVStore) {
+	root, err := gobuddyfs.NewBuddyFS(s).Root()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var fileNo int64
+	data := make([]byte, 4096)
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		name := strconv.FormatInt(atomic.AddInt64(&fileNo, 1), 10)
+		node, _, err := root.(*gobuddyfs.FSMeta).Create(context.TODO(),
+			&fuse.CreateRequest{Name: name}, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		file := node.(*gobuddyfs.File)
+
+		for offset := int64(0); pb.Next(); offset += int64(len(data)) {
+			req := &fuse.WriteRequest{Data: data, Offset: offset % (1 << 20)}
+			if err := file.Write(context.TODO(), req, &fuse.WriteResponse{}); err != nil {
+				b.Fatal(err)
+			}
+			if err := file.Flush(context.TODO(), &fuse.FlushRequest{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -1,8 +1,10 @@
 package gobuddyfs
 
 import (
-	"math/rand"
-	"strconv"
+	"bytes"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
 )
 
 type Marshalable interface {
@@ -22,9 +24,9 @@ type Cacheable interface {
 }
 
 type Storable interface {
-	WriteBlock(m Marshalable, store KVStore) error
-	ReadBlock(m Marshalable, store KVStore) error
-	Delete(store KVStore)
+	WriteBlock(ctx context.Context, m Marshalable, store KVStore) error
+	ReadBlock(ctx context.Context, m Marshalable, store KVStore) error
+	Delete(ctx context.Context, store KVStore)
 }
 
 type StorageUnit interface {
@@ -37,12 +39,26 @@ type Block struct {
 	Name  string
 	Id    int64
 	dirty bool `json:"-"`
+	// stored is the encoding last read from or written to the store. It is the
+	// expected value for CompareAndWriteBlock.
+	stored []byte
+	// hash is set for a content-addressed data block, which is stored under
+	// the hash of its contents instead of its id.
+	hash []byte
 }
 
 var _ StorageUnit = new(Block)
 
-func (b *Block) Delete(store KVStore) {
-	store.Set(strconv.FormatInt(b.Id, 10), nil)
+// key returns the key b is stored under.
+func (b *Block) key(store KVStore) string {
+	if b.hash != nil {
+		return contentKey(store, b.hash)
+	}
+	return blockKey(store, b.Id)
+}
+
+func (b *Block) Delete(ctx context.Context, store KVStore) {
+	kvDelete(ctx, store, b.key(store))
 }
 
 func (b *Block) SetId(id int64) {
@@ -65,7 +81,7 @@ func (b Block) IsDirty() bool {
 	return b.dirty
 }
 
-func (b *Block) WriteBlock(m Marshalable, store KVStore) error {
+func (b *Block) WriteBlock(ctx context.Context, m Marshalable, store KVStore) error {
 	// Don't make a write if not dirty
 	if b.dirty == false {
 		return nil
@@ -75,27 +91,84 @@ func (b *Block) WriteBlock(m Marshalable, store KVStore) error {
 	if err != nil {
 		return err
 	}
+	if bEncoded, err = encodeBlock(store, bEncoded); err != nil {
+		return err
+	}
 
-	err = store.Set(strconv.FormatInt(b.Id, 10), bEncoded)
+	err = kvSet(ctx, store, b.key(store), bEncoded)
 	if err == nil {
 		b.dirty = false
+		b.remember(m, bEncoded)
 	}
 	return err
 }
 
-func (b *Block) ReadBlock(m Marshalable, store KVStore) error {
-	encoded, err := store.Get(strconv.FormatInt(b.Id, 10), true)
+// CompareAndWriteBlock is like WriteBlock, but only succeeds if the block in
+// the store is still the one last read or written through b. Otherwise it
+// returns ErrConflict, and the block should be re-read before trying again.
+// A block which was never read or written is expected not to exist yet.
+func (b *Block) CompareAndWriteBlock(ctx context.Context, m Marshalable, store KVStore) error {
+	if b.dirty == false {
+		return nil
+	}
+
+	bEncoded, err := m.Marshal()
 	if err != nil {
 		return err
 	}
+	if bEncoded, err = encodeBlock(store, bEncoded); err != nil {
+		return err
+	}
 
-	err = m.Unmarshal(encoded)
+	err = kvCompareAndSet(ctx, store, b.key(store), b.stored, bEncoded)
+	if err == nil {
+		b.dirty = false
+		b.remember(m, bEncoded)
+	}
+	return err
+}
 
-	if err != nil {
+// remember records the stored encoding of m for later compare-and-set writes.
+// Data blocks are never updated that way, so they are skipped.
+func (b *Block) remember(m Marshalable, encoded []byte) {
+	if _, isData := m.(*DataBlock); !isData {
+		b.stored = encoded
+	}
+}
+
+func (b *Block) ReadBlock(ctx context.Context, m Marshalable, store KVStore) error {
+	key := b.key(store)
+	encoded, err := kvGet(ctx, store, key, true)
+	if err == ErrNotFound {
+		// Blocks are only read by following a reference to them, so a missing
+		// block means the filesystem is damaged.
+		return &StoreError{Class: Corrupt, Op: "get", Key: key, Err: err}
+	} else if err != nil {
 		return err
 	}
 
+	contents := encoded
+	if b.hash != nil {
+		if _, contents, err = splitRefs(key, encoded); err != nil {
+			return err
+		}
+	}
+
+	decoded, err := decodeBlock(store, contents)
+	if err == nil && b.hash != nil && !bytes.Equal(contentHash(decoded), b.hash) {
+		err = errChecksum
+	}
+	if err == nil {
+		err = m.Unmarshal(decoded)
+	}
+
+	if err != nil {
+		glog.Errorf("Block %d (key %s) is damaged: %s", b.Id, key, err)
+		return &StoreError{Class: Corrupt, Op: "decode", Key: key, Err: err}
+	}
+
 	b.dirty = false
+	b.remember(m, encoded)
 
 	return nil
 }
@@ -107,30 +180,16 @@ type DataBlock struct {
 
 var _ Marshalable = new(DataBlock)
 
+// Marshal and Unmarshal copy the contents, which are modified in place by
+// writes, so that they never share memory with values held by the store.
 func (dBlock DataBlock) Marshal() ([]byte, error) {
-	return dBlock.Data, nil
+	data := make([]byte, len(dBlock.Data))
+	copy(data, dBlock.Data)
+	return data, nil
 }
 
 func (dBlock *DataBlock) Unmarshal(data []byte) error {
-	dBlock.Data = data
+	dBlock.Data = make([]byte, len(data))
+	copy(dBlock.Data, data)
 	return nil
 }
-
-type BlockGenerator interface {
-	NewBlock() StorageUnit
-	NewNamedBlock(name string) Block
-}
-
-type RandomizedBlockGenerator struct {
-	// Implements: BlockGenerator
-}
-
-var _ BlockGenerator = new(RandomizedBlockGenerator)
-
-func (r RandomizedBlockGenerator) NewBlock() StorageUnit {
-	return &Block{Id: rand.Int63()}
-}
-
-func (r RandomizedBlockGenerator) NewNamedBlock(name string) Block {
-	return Block{Id: rand.Int63(), Name: name}
-}
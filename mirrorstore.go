@@ -0,0 +1,411 @@
+package gobuddyfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// How long a child which failed is passed over by reads.
+const mirrorRetryAfter = 5 * time.Second
+
+type mirrorChild struct {
+	store KVStore
+	// Set after the child fails, until it can be tried again.
+	downUntil time.Time
+	// Keys whose last write to the child failed, so that its copy is out of
+	// date.
+	stale map[string]bool
+	// For keys with writes to the child queued or running, the turn of the
+	// last one. Writes of a key to a child are made one at a time, in the
+	// order they were issued, so that an older value never lands last.
+	pending map[string]chan struct{}
+}
+
+// mirrorTurn is a write's place in a child's queue for a key. The write waits
+// for prev, the previous write's done, and closes done when it is over.
+type mirrorTurn struct {
+	prev, done chan struct{}
+}
+
+func (t mirrorTurn) wait() {
+	if t.prev != nil {
+		<-t.prev
+	}
+}
+
+// MirrorKVStore keeps a full copy of every key in each of its children. A
+// write succeeds once a quorum of children have taken it; the others are
+// still written to in the background, and keys which they failed to take are
+// remembered as stale. Each child takes the writes of a key one at a time, in
+// the order they were issued. Reads go to the first child which is healthy and not
+// stale for the key, and fall back to the next one on a miss or an error.
+// Children found missing or behind on a key are then repaired with the value
+// that was read.
+//
+// Compare-and-set is decided by the first child, the primary, and then
+// propagated to the others like a plain write.
+type MirrorKVStore struct {
+	children []*mirrorChild
+	quorum   int
+	lock     sync.Mutex
+
+	// Implements: KVStore, ContextKVStore, DeletableKVStore, ScannableKVStore,
+	// CASKVStore, SyncableKVStore
+}
+
+// NewMirrorKVStore mirrors children, the first of which is the primary. Writes
+// must succeed on quorum children; a quorum outside 1..len(children) requires
+// all of them.
+func NewMirrorKVStore(children []KVStore, quorum int) *MirrorKVStore {
+	if quorum < 1 || quorum > len(children) {
+		quorum = len(children)
+	}
+
+	m := &MirrorKVStore{quorum: quorum}
+	for _, store := range children {
+		m.children = append(m.children, &mirrorChild{store: store,
+			stale: make(map[string]bool), pending: make(map[string]chan struct{})})
+	}
+	return m
+}
+
+// failed records an error from child i. Misses and conflicts are answers, not
+// failures.
+func (self *MirrorKVStore) failed(i int, err error) {
+	if err == ErrNotFound || err == ErrConflict {
+		return
+	}
+
+	self.lock.Lock()
+	self.children[i].downUntil = time.Now().Add(mirrorRetryAfter)
+	self.lock.Unlock()
+
+	if glog.V(1) {
+		glog.Infof("Mirror child %d failed: %s", i, err)
+	}
+}
+
+// wrote records the outcome of a write of key to child i.
+func (self *MirrorKVStore) wrote(i int, key string, err error) {
+	self.lock.Lock()
+	if err == nil {
+		delete(self.children[i].stale, key)
+	} else {
+		self.children[i].stale[key] = true
+	}
+	self.lock.Unlock()
+
+	if err != nil {
+		self.failed(i, err)
+	}
+}
+
+// enqueue takes a turn to write key on every child, behind the writes of key
+// already issued.
+func (self *MirrorKVStore) enqueue(key string) []mirrorTurn {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	turns := make([]mirrorTurn, len(self.children))
+	for i, child := range self.children {
+		turns[i] = mirrorTurn{prev: child.pending[key], done: make(chan struct{})}
+		child.pending[key] = turns[i].done
+	}
+	return turns
+}
+
+// finish ends a turn taken on child i, letting the next write of key go ahead.
+func (self *MirrorKVStore) finish(i int, key string, turn mirrorTurn) {
+	self.lock.Lock()
+	if self.children[i].pending[key] == turn.done {
+		delete(self.children[i].pending, key)
+	}
+	self.lock.Unlock()
+	close(turn.done)
+}
+
+// pass gives up the turns of the children but skip, without writing to them.
+func (self *MirrorKVStore) pass(key string, turns []mirrorTurn, skip int) {
+	for i, turn := range turns {
+		if i == skip {
+			continue
+		}
+		go func(i int, turn mirrorTurn) {
+			turn.wait()
+			self.finish(i, key, turn)
+		}(i, turn)
+	}
+}
+
+// readOrder lists the children to read key from: healthy ones first, then
+// those recently failed, and last those still taking a write of key, along
+// with the turn to wait for before reading them. Children holding a stale
+// copy are left out.
+func (self *MirrorKVStore) readOrder(key string) ([]int, map[int]chan struct{}) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	var healthy, down, busy []int
+	waits := make(map[int]chan struct{})
+	for i, child := range self.children {
+		if child.stale[key] {
+			continue
+		}
+		if pending, ok := child.pending[key]; ok {
+			// A write which reached a quorum may still be queued here.
+			busy = append(busy, i)
+			waits[i] = pending
+		} else if now.Before(child.downUntil) {
+			down = append(down, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	return append(append(healthy, down...), busy...), waits
+}
+
+func (self *MirrorKVStore) isStale(i int, key string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.children[i].stale[key]
+}
+
+func (self *MirrorKVStore) staleFor(key string) []int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var stale []int
+	for i, child := range self.children {
+		if child.stale[key] {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+func (self *MirrorKVStore) Get(key string, retry bool) ([]byte, error) {
+	return self.GetContext(context.Background(), key, retry)
+}
+
+func (self *MirrorKVStore) Set(key string, value []byte) error {
+	return self.SetContext(context.Background(), key, value)
+}
+
+func (self *MirrorKVStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	var missing []int
+	var firstErr error
+
+	order, waits := self.readOrder(key)
+	for _, i := range order {
+		if pending, ok := waits[i]; ok {
+			select {
+			case <-pending:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if self.isStale(i, key) {
+				continue
+			}
+		}
+
+		value, err := kvGet(ctx, self.children[i].store, key, retry)
+		if err == nil {
+			self.repair(ctx, key, value, missing)
+			return value, nil
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+
+		self.failed(i, err)
+		if err == ErrNotFound {
+			missing = append(missing, i)
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		// Some child might have had it.
+		return nil, firstErr
+	}
+	return nil, ErrNotFound
+}
+
+// repair writes value to the children which were found to be missing key, and
+// to those known to hold a stale copy of it. Writes are conditional on the
+// copy being as it was, so that a concurrent write is never undone.
+func (self *MirrorKVStore) repair(ctx context.Context, key string, value []byte, missing []int) {
+	for _, i := range missing {
+		err := kvCompareAndSet(ctx, self.children[i].store, key, nil, value)
+		self.repaired(i, key, err)
+	}
+
+	for _, i := range self.staleFor(key) {
+		current, err := kvGet(ctx, self.children[i].store, key, false)
+		if err == ErrNotFound {
+			current, err = nil, nil
+		}
+		if err == nil {
+			err = kvCompareAndSet(ctx, self.children[i].store, key, current, value)
+		}
+		self.repaired(i, key, err)
+	}
+}
+
+func (self *MirrorKVStore) repaired(i int, key string, err error) {
+	if err == nil {
+		if glog.V(1) {
+			glog.Infof("Repaired %s on mirror child %d", key, i)
+		}
+		self.wrote(i, key, nil)
+	} else if err != ErrConflict {
+		self.failed(i, err)
+	}
+}
+
+// fanOut runs write on every child but skip, each in its turn, and returns
+// once quorum of them have succeeded, or too many have failed for that to
+// happen. Writes which are still waiting or running carry on in the
+// background.
+func (self *MirrorKVStore) fanOut(ctx context.Context, op, key string, turns []mirrorTurn,
+	skip, quorum int, write func(ctx context.Context, store KVStore) error) error {
+	results := make(chan error, len(self.children))
+	n := 0
+	for i, child := range self.children {
+		if i == skip {
+			continue
+		}
+		n++
+
+		go func(i int, store KVStore) {
+			turns[i].wait()
+			// Writes which outlive the caller's context still have to land,
+			// so they are not tied to it.
+			err := write(context.Background(), store)
+			self.wrote(i, key, err)
+			self.finish(i, key, turns[i])
+			results <- err
+		}(i, child.store)
+	}
+
+	var succeeded, failed int
+	var firstErr error
+	for succeeded < quorum && failed <= n-quorum {
+		select {
+		case err := <-results:
+			if err == nil {
+				succeeded++
+			} else {
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if succeeded >= quorum {
+		return nil
+	}
+	return &StoreError{Class: ErrorClassOf(firstErr), Op: op, Key: key,
+		Err: fmt.Errorf("%d of %d writes failed: %s", failed, n, firstErr)}
+}
+
+func (self *MirrorKVStore) SetContext(ctx context.Context, key string, value []byte) error {
+	return self.fanOut(ctx, "set", key, self.enqueue(key), -1, self.quorum,
+		func(ctx context.Context, store KVStore) error {
+			return kvSet(ctx, store, key, value)
+		})
+}
+
+func (self *MirrorKVStore) Delete(key string) error {
+	return self.fanOut(context.Background(), "delete", key, self.enqueue(key), -1, self.quorum,
+		func(ctx context.Context, store KVStore) error {
+			return kvDelete(ctx, store, key)
+		})
+}
+
+func (self *MirrorKVStore) CompareAndSet(key string, expected, value []byte) error {
+	ctx := context.Background()
+	// The turns are taken on every child at once, so that the others take the
+	// outcome in the same order relative to other writes as the primary.
+	turns := self.enqueue(key)
+	turns[0].wait()
+	err := kvCompareAndSet(ctx, self.children[0].store, key, expected, value)
+	if err != nil {
+		self.failed(0, err)
+		self.finish(0, key, turns[0])
+		self.pass(key, turns, 0)
+		return err
+	}
+	self.wrote(0, key, nil)
+	self.finish(0, key, turns[0])
+
+	return self.fanOut(ctx, "set", key, turns, 0, self.quorum-1, func(ctx context.Context, store KVStore) error {
+		if value == nil {
+			return kvDelete(ctx, store, key)
+		}
+		return kvSet(ctx, store, key, value)
+	})
+}
+
+// Scan scans the first healthy child which can enumerate its keys.
+func (self *MirrorKVStore) Scan(start, end string, visit ScanFunc) error {
+	order, _ := self.readOrder("")
+	for _, i := range order {
+		if _, ok := self.children[i].store.(ScannableKVStore); ok {
+			return Scan(self.children[i].store, start, end, visit)
+		}
+	}
+	return ErrNotSupported
+}
+
+// Sync waits for the writes still queued on children, then syncs every
+// child, and succeeds if a quorum of them did.
+func (self *MirrorKVStore) Sync() error {
+	self.lock.Lock()
+	var pending []chan struct{}
+	for _, child := range self.children {
+		for _, done := range child.pending {
+			pending = append(pending, done)
+		}
+	}
+	self.lock.Unlock()
+	for _, done := range pending {
+		<-done
+	}
+
+	var succeeded int
+	var firstErr error
+	for i, child := range self.children {
+		if err := kvSync(context.Background(), child.store); err != nil {
+			self.failed(i, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			succeeded++
+		}
+	}
+
+	if succeeded >= self.quorum {
+		return nil
+	}
+	return firstErr
+}
+
+var _ KVStore = new(MirrorKVStore)
+var _ ContextKVStore = new(MirrorKVStore)
+var _ DeletableKVStore = new(MirrorKVStore)
+var _ CASKVStore = new(MirrorKVStore)
+var _ SyncableKVStore = new(MirrorKVStore)
+var _ ScannableKVStore = new(MirrorKVStore)
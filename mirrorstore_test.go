@@ -0,0 +1,203 @@
+package gobuddyfs_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// FlakyKVStore is a MemStore which can be made to fail, like a disk which was
+// unplugged or a peer which went away.
+type FlakyKVStore struct {
+	*gobuddyfs.MemStore
+	lock sync.Mutex
+	down bool
+}
+
+var errUnplugged = &gobuddyfs.StoreError{Class: gobuddyfs.Transient, Op: "test",
+	Err: errors.New("unplugged")}
+
+func NewFlakyKVStore() *FlakyKVStore {
+	return &FlakyKVStore{MemStore: gobuddyfs.NewMemStore()}
+}
+
+func (f *FlakyKVStore) SetDown(down bool) {
+	f.lock.Lock()
+	f.down = down
+	f.lock.Unlock()
+}
+
+func (f *FlakyKVStore) isDown() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.down
+}
+
+func (f *FlakyKVStore) Get(key string, retry bool) ([]byte, error) {
+	if f.isDown() {
+		return nil, errUnplugged
+	}
+	return f.MemStore.Get(key, retry)
+}
+
+func (f *FlakyKVStore) Set(key string, value []byte) error {
+	if f.isDown() {
+		return errUnplugged
+	}
+	return f.MemStore.Set(key, value)
+}
+
+func (f *FlakyKVStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	return f.Get(key, retry)
+}
+
+func (f *FlakyKVStore) SetContext(ctx context.Context, key string, value []byte) error {
+	return f.Set(key, value)
+}
+
+func (f *FlakyKVStore) Delete(key string) error {
+	return f.Set(key, nil)
+}
+
+func (f *FlakyKVStore) CompareAndSet(key string, expected, value []byte) error {
+	if f.isDown() {
+		return errUnplugged
+	}
+	return f.MemStore.CompareAndSet(key, expected, value)
+}
+
+// SlowKVStore takes its time over writing some values, like a peer behind a
+// congested link.
+type SlowKVStore struct {
+	*gobuddyfs.MemStore
+	delays map[string]time.Duration
+}
+
+func (s *SlowKVStore) Set(key string, value []byte) error {
+	time.Sleep(s.delays[string(value)])
+	return s.MemStore.Set(key, value)
+}
+
+func (s *SlowKVStore) SetContext(ctx context.Context, key string, value []byte) error {
+	return s.Set(key, value)
+}
+
+func hasValue(s gobuddyfs.KVStore, key string, value []byte) func() bool {
+	return func() bool {
+		r, err := s.Get(key, false)
+		return err == nil && string(r) == string(value)
+	}
+}
+
+func TestMirrorWriteQuorum(t *testing.T) {
+	a, b := NewFlakyKVStore(), NewFlakyKVStore()
+	m := gobuddyfs.NewMirrorKVStore([]gobuddyfs.KVStore{a, b}, 1)
+
+	b.SetDown(true)
+	assert.NoError(t, m.Set("Foo", []byte("bar")))
+	r, err := m.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), r)
+
+	// With both children required, the write fails.
+	all := gobuddyfs.NewMirrorKVStore([]gobuddyfs.KVStore{a, b}, 0)
+	err = all.Set("Baz", []byte("qux"))
+	assert.Error(t, err)
+	assert.True(t, gobuddyfs.IsTransient(err))
+}
+
+func TestMirrorReadRepair(t *testing.T) {
+	a, b := NewFlakyKVStore(), NewFlakyKVStore()
+	m := gobuddyfs.NewMirrorKVStore([]gobuddyfs.KVStore{a, b}, 1)
+
+	// b misses a write, and reads of the key are repaired once it is back.
+	assert.NoError(t, m.Set("Foo", []byte("old")))
+	assert.Eventually(t, hasValue(b, "Foo", []byte("old")), time.Second, time.Millisecond)
+	b.SetDown(true)
+	assert.NoError(t, m.Set("Foo", []byte("new")))
+	b.SetDown(false)
+
+	assert.Eventually(t, func() bool {
+		r, err := m.Get("Foo", false)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("new"), r)
+		return hasValue(b, "Foo", []byte("new"))()
+	}, time.Second, time.Millisecond)
+
+	// A key missing from the primary is read from the other child and
+	// copied back.
+	b.MemStore.Set("Bar", []byte("bar"))
+	r, err := m.Get("Bar", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), r)
+	assert.True(t, hasValue(a, "Bar", []byte("bar"))())
+
+	// A failed child is skipped.
+	a.SetDown(true)
+	r, err = m.Get("Bar", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), r)
+}
+
+func TestMirrorCompareAndSet(t *testing.T) {
+	a, b := NewFlakyKVStore(), NewFlakyKVStore()
+	m := gobuddyfs.NewMirrorKVStore([]gobuddyfs.KVStore{a, b}, 2)
+
+	assert.NoError(t, m.CompareAndSet("Foo", nil, []byte("bar")))
+	assert.Equal(t, gobuddyfs.ErrConflict, m.CompareAndSet("Foo", nil, []byte("baz")))
+	assert.True(t, hasValue(b, "Foo", []byte("bar"))())
+
+	assert.NoError(t, m.CompareAndSet("Foo", []byte("bar"), nil))
+	_, err := b.Get("Foo", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+}
+
+func TestMirrorWriteOrder(t *testing.T) {
+	a := gobuddyfs.NewMemStore()
+	b := &SlowKVStore{MemStore: gobuddyfs.NewMemStore(),
+		delays: map[string]time.Duration{"first": 50 * time.Millisecond}}
+	m := gobuddyfs.NewMirrorKVStore([]gobuddyfs.KVStore{a, b}, 1)
+
+	// Both writes return as soon as a has them, while b is still busy with
+	// the first.
+	assert.NoError(t, m.Set("Foo", []byte("first")))
+	assert.NoError(t, m.Set("Foo", []byte("second")))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, hasValue(a, "Foo", []byte("second"))())
+	assert.True(t, hasValue(b, "Foo", []byte("second"))())
+
+	// A compare-and-set decided by a is taken by b after the writes before it.
+	b.delays["third"] = 50 * time.Millisecond
+	assert.NoError(t, m.Set("Foo", []byte("third")))
+	assert.NoError(t, m.CompareAndSet("Foo", []byte("third"), []byte("fourth")))
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, hasValue(b, "Foo", []byte("fourth"))())
+}
+
+func TestMirrorReadYourWrites(t *testing.T) {
+	a := &SlowKVStore{MemStore: gobuddyfs.NewMemStore(), delays: map[string]time.Duration{
+		"new": 50 * time.Millisecond, "newer": 50 * time.Millisecond}}
+	b := gobuddyfs.NewMemStore()
+	m := gobuddyfs.NewMirrorKVStore([]gobuddyfs.KVStore{a, b}, 1)
+
+	assert.NoError(t, m.Set("Foo", []byte("old")))
+	assert.Eventually(t, hasValue(a, "Foo", []byte("old")), time.Second, time.Millisecond)
+
+	// The write returns once b has it, while the primary is still busy, and
+	// is read back all the same.
+	assert.NoError(t, m.Set("Foo", []byte("new")))
+	r, err := m.Get("Foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), r)
+
+	// Sync waits for the writes still queued.
+	assert.NoError(t, m.Set("Foo", []byte("newer")))
+	assert.NoError(t, m.Sync())
+	assert.True(t, hasValue(a, "Foo", []byte("newer"))())
+}
@@ -0,0 +1,149 @@
+package gobuddyfs
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"bazil.org/fuse/fs"
+)
+
+// nodeTable holds the nodes of a mount by block id, so that every lookup of
+// an entry gives the same node, and everything done through it shares one copy
+// of its state. A nil table holds nothing.
+//
+// Nodes are reference counted. The kernel holds one reference from the first
+// lookup which returns a node until it forgets the node, and code which looks
+// up a node for itself holds one until it releases it. A node leaves the table
+// with its last reference.
+type nodeTable struct {
+	lock  sync.Mutex
+	nodes map[int64]*nodeEntry
+}
+
+type nodeEntry struct {
+	node   fs.Node
+	refs   int
+	kernel bool
+}
+
+func newNodeTable() *nodeTable {
+	return &nodeTable{nodes: make(map[int64]*nodeEntry)}
+}
+
+// get returns the block's node with a reference taken, or nil.
+func (t *nodeTable) get(id int64) fs.Node {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	entry, ok := t.nodes[id]
+	if !ok {
+		return nil
+	}
+	entry.refs++
+	return entry.node
+}
+
+// put adds node to the table, unless another node for the block got there
+// first, which is returned instead. Either way, a reference is taken.
+func (t *nodeTable) put(id int64, node fs.Node) fs.Node {
+	if t == nil {
+		return node
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	entry, ok := t.nodes[id]
+	if !ok {
+		entry = &nodeEntry{node: node}
+		t.nodes[id] = entry
+	}
+	entry.refs++
+	return entry.node
+}
+
+func (t *nodeTable) releaseLocked(id int64, entry *nodeEntry) {
+	entry.refs--
+	if entry.refs == 0 {
+		delete(t.nodes, id)
+	}
+}
+
+// release drops a reference taken with get or put.
+func (t *nodeTable) release(id int64) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if entry, ok := t.nodes[id]; ok {
+		t.releaseLocked(id, entry)
+	}
+}
+
+// handOver passes a reference taken with get or put to the kernel, which only
+// ever holds one.
+func (t *nodeTable) handOver(id int64) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	entry, ok := t.nodes[id]
+	if !ok {
+		return
+	}
+	if entry.kernel {
+		t.releaseLocked(id, entry)
+	}
+	entry.kernel = true
+}
+
+// forget drops the kernel's reference to node.
+func (t *nodeTable) forget(id int64, node fs.Node) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if entry, ok := t.nodes[id]; ok && entry.node == node && entry.kernel {
+		entry.kernel = false
+		t.releaseLocked(id, entry)
+	}
+}
+
+// refresh re-reads a directory found in the node table, which another mount
+// may have changed since.
+func (dir *Dir) refresh(ctx context.Context) error {
+	dir.Lock.Lock()
+	defer dir.Lock.Unlock()
+	return dir.ReadBlock(ctx, dir, dir.KVS)
+}
+
+// refresh re-reads a file found in the node table, which another mount may
+// have changed since, unless it holds changes of its own.
+func (file *File) refresh(ctx context.Context) error {
+	file.Lock.Lock()
+	defer file.Lock.Unlock()
+
+	if file.IsDirty() || len(file.released) > 0 {
+		return nil
+	}
+	for _, dBlk := range file.BlockCache {
+		if dBlk != nil && dBlk.IsDirty() {
+			return nil
+		}
+	}
+
+	now := &File{Block: Block{Id: file.Id}}
+	if err := now.ReadBlock(ctx, now, file.KVS); err != nil {
+		return err
+	}
+	// Data blocks may have been rewritten in place, so none of the cached ones
+	// are kept.
+	file.Blocks, file.Size, file.BlockSize = now.Blocks, now.Size, now.BlockSize
+	file.chunkEnds, file.BlockCache = now.chunkEnds, now.BlockCache
+	file.stored = now.stored
+	return nil
+}
@@ -0,0 +1,191 @@
+package gobuddyfs
+
+import "errors"
+
+// Arithmetic in GF(2^8), generated by x^8 + x^4 + x^3 + x^2 + 1. Addition is
+// XOR; multiplication goes through a full product table.
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+// gfInv returns the multiplicative inverse of a, which must not be zero.
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+var errTooFewShards = errors.New("too few shards to reconstruct value")
+
+// reedSolomon is a systematic Reed-Solomon code with k data and m parity
+// shards. Its encoding matrix is the identity on top of an m by k Cauchy
+// matrix, so every k by k submatrix is invertible and any k shards are
+// enough to reconstruct the data.
+type reedSolomon struct {
+	k, m   int
+	matrix [][]byte
+}
+
+func newReedSolomon(k, m int) (*reedSolomon, error) {
+	if k < 1 || m < 0 || k+m > 256 {
+		return nil, errors.New("invalid number of shards")
+	}
+
+	rs := &reedSolomon{k: k, m: m, matrix: make([][]byte, k+m)}
+	for i := range rs.matrix {
+		rs.matrix[i] = make([]byte, k)
+		if i < k {
+			rs.matrix[i][i] = 1
+			continue
+		}
+		// Rows are labelled k..k+m-1 and columns 0..k-1, so no row label
+		// equals a column label and every entry is defined.
+		for j := 0; j < k; j++ {
+			rs.matrix[i][j] = gfInv(byte(i) ^ byte(j))
+		}
+	}
+	return rs, nil
+}
+
+// mulAdd adds c times in to out.
+func mulAdd(out, in []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	table := &gfMul[c]
+	for i, b := range in {
+		out[i] ^= table[b]
+	}
+}
+
+// encode splits data into k equally sized data shards, zero padding the last
+// one, and computes m parity shards from them.
+func (rs *reedSolomon) encode(data []byte) [][]byte {
+	size := (len(data) + rs.k - 1) / rs.k
+	shards := make([][]byte, rs.k+rs.m)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+	}
+
+	for i := 0; i < rs.k; i++ {
+		if i*size < len(data) {
+			copy(shards[i], data[i*size:])
+		}
+	}
+
+	for i := rs.k; i < rs.k+rs.m; i++ {
+		for j := 0; j < rs.k; j++ {
+			mulAdd(shards[i], shards[j], rs.matrix[i][j])
+		}
+	}
+	return shards
+}
+
+// decode reconstructs the first length bytes of data from shards, in which
+// missing shards are nil. All present shards must be the same size.
+func (rs *reedSolomon) decode(shards [][]byte, length int) ([]byte, error) {
+	var rows []int
+	for i, shard := range shards {
+		if shard != nil && len(rows) < rs.k {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < rs.k {
+		return nil, errTooFewShards
+	}
+
+	size := len(shards[rows[0]])
+	data := make([]byte, 0, rs.k*size)
+
+	if rows[rs.k-1] == rs.k-1 {
+		// All data shards are present.
+		for i := 0; i < rs.k; i++ {
+			data = append(data, shards[i]...)
+		}
+	} else {
+		sub := make([][]byte, rs.k)
+		for i, row := range rows {
+			sub[i] = append([]byte(nil), rs.matrix[row]...)
+		}
+		inv, err := gfInvert(sub)
+		if err != nil {
+			return nil, err
+		}
+
+		shard := make([]byte, size)
+		for i := 0; i < rs.k; i++ {
+			for j := range shard {
+				shard[j] = 0
+			}
+			for j, row := range rows {
+				mulAdd(shard, shards[row], inv[i][j])
+			}
+			data = append(data, shard...)
+		}
+	}
+
+	if length > len(data) {
+		return nil, errTooFewShards
+	}
+	return data[:length], nil
+}
+
+// gfInvert inverts the square matrix m by Gauss-Jordan elimination. m is
+// destroyed.
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := gfInv(m[col][col])
+		for j := 0; j < n; j++ {
+			m[col][j] = gfMul[scale][m[col][j]]
+			inv[col][j] = gfMul[scale][inv[col][j]]
+		}
+
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			c := m[row][col]
+			mulAdd(m[row], m[col], c)
+			mulAdd(inv[row], inv[col], c)
+		}
+	}
+	return inv, nil
+}
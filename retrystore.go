@@ -0,0 +1,178 @@
+package gobuddyfs
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// RetryPolicy controls how often RetryingKVStore retries an operation and how
+// long it waits in between.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry. It doubles with every
+	// further retry, up to MaxBackoff if that is positive.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter is the fraction of each wait, between 0 and 1, which is chosen at
+	// random so that clients failing together don't retry together.
+	Jitter float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Jitter:         0.5,
+}
+
+// RetryingKVStore retries failed operations on the wrapped store with
+// exponential backoff. Reads are only retried when the caller passes
+// retry=true. A Set always replaces the whole value, so repeating one is
+// harmless and writes are always retried, as are deletes and syncs.
+// Compare-and-set is not retried, since a failed attempt may have applied and
+// would then make the retry conflict; nor are scans, since part of the range
+// may already have been visited.
+type RetryingKVStore struct {
+	store     KVStore
+	policy    RetryPolicy
+	retryable func(error) bool
+
+	// Implements: KVStore, ContextKVStore, DeletableKVStore, ScannableKVStore,
+	// CASKVStore, SyncableKVStore
+}
+
+// NewRetryingKVStore wraps store. retryable decides which errors are worth
+// another attempt; if it is nil, only errors classified as Transient are.
+func NewRetryingKVStore(store KVStore, policy RetryPolicy, retryable func(error) bool) *RetryingKVStore {
+	if retryable == nil {
+		retryable = IsTransient
+	}
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	return &RetryingKVStore{store: store, policy: policy, retryable: retryable}
+}
+
+func (self *RetryingKVStore) backoff(retry int) time.Duration {
+	wait := self.policy.InitialBackoff
+	capped := self.policy.MaxBackoff > 0
+	for i := 0; i < retry && (!capped || wait < self.policy.MaxBackoff); i++ {
+		if wait > math.MaxInt64/2 {
+			break
+		}
+		wait *= 2
+	}
+	if self.policy.MaxBackoff > 0 && wait > self.policy.MaxBackoff {
+		wait = self.policy.MaxBackoff
+	}
+	if self.policy.Jitter > 0 {
+		wait -= time.Duration(rand.Float64() * self.policy.Jitter * float64(wait))
+	}
+	return wait
+}
+
+// do runs op until it succeeds, fails with an error which is not retryable,
+// runs out of attempts or ctx is done.
+func (self *RetryingKVStore) do(ctx context.Context, op, key string, attempts int, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !self.retryable(err) {
+			return err
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// The caller has given up, which is not the store's fault.
+			return ctxErr
+		}
+
+		if attempt+1 >= attempts {
+			break
+		}
+
+		wait := self.backoff(attempt)
+		if glog.V(1) {
+			glog.Infof("Retrying %s(%s) in %s after error: %s", op, key, wait, err)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err == context.DeadlineExceeded || err == context.Canceled || IsTransient(err) {
+		return err
+	}
+
+	// The classifier considered this error temporary even though the store
+	// didn't say so; make sure the caller sees it that way too.
+	return &StoreError{Class: Transient, Op: op, Key: key, Err: err}
+}
+
+func (self *RetryingKVStore) Get(key string, retry bool) ([]byte, error) {
+	return self.GetContext(context.Background(), key, retry)
+}
+
+func (self *RetryingKVStore) Set(key string, value []byte) error {
+	return self.SetContext(context.Background(), key, value)
+}
+
+func (self *RetryingKVStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	attempts := 1
+	if retry {
+		attempts = self.policy.MaxAttempts
+	}
+
+	var value []byte
+	err := self.do(ctx, "get", key, attempts, func() error {
+		var err error
+		value, err = kvGet(ctx, self.store, key, retry)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (self *RetryingKVStore) SetContext(ctx context.Context, key string, value []byte) error {
+	return self.do(ctx, "set", key, self.policy.MaxAttempts, func() error {
+		return kvSet(ctx, self.store, key, value)
+	})
+}
+
+func (self *RetryingKVStore) Delete(key string) error {
+	ctx := context.Background()
+	return self.do(ctx, "delete", key, self.policy.MaxAttempts, func() error {
+		return kvDelete(ctx, self.store, key)
+	})
+}
+
+func (self *RetryingKVStore) CompareAndSet(key string, expected, value []byte) error {
+	return kvCompareAndSet(context.Background(), self.store, key, expected, value)
+}
+
+func (self *RetryingKVStore) Scan(start, end string, visit ScanFunc) error {
+	return Scan(self.store, start, end, visit)
+}
+
+func (self *RetryingKVStore) Sync() error {
+	ctx := context.Background()
+	return self.do(ctx, "sync", "", self.policy.MaxAttempts, func() error {
+		return kvSync(ctx, self.store)
+	})
+}
+
+var _ KVStore = new(RetryingKVStore)
+var _ ContextKVStore = new(RetryingKVStore)
+var _ DeletableKVStore = new(RetryingKVStore)
+var _ CASKVStore = new(RetryingKVStore)
+var _ SyncableKVStore = new(RetryingKVStore)
+var _ ScannableKVStore = new(RetryingKVStore)
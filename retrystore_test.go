@@ -0,0 +1,79 @@
+package gobuddyfs_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var testRetryPolicy = gobuddyfs.RetryPolicy{MaxAttempts: 3,
+	InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+var errUnreachable = &gobuddyfs.StoreError{Class: gobuddyfs.Transient,
+	Op: "get", Key: "Foo", Err: fmt.Errorf("Peer unreachable")}
+
+func TestRetryGetSucceedsAfterTransientErrors(t *testing.T) {
+	mkv := new(MockKVStore)
+	s := gobuddyfs.NewRetryingKVStore(mkv, testRetryPolicy, nil)
+	mkv.On("Get", "Foo", true).Return(nil, errUnreachable).Twice()
+	mkv.On("Get", "Foo", true).Return([]byte("bar"), nil).Once()
+
+	r, err := s.Get("Foo", true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), r)
+	mkv.AssertExpectations(t)
+}
+
+func TestRetryGetHonorsRetryFlag(t *testing.T) {
+	mkv := new(MockKVStore)
+	s := gobuddyfs.NewRetryingKVStore(mkv, testRetryPolicy, nil)
+	mkv.On("Get", "Foo", false).Return(nil, errUnreachable).Once()
+
+	_, err := s.Get("Foo", false)
+
+	assert.Equal(t, errUnreachable, err)
+	mkv.AssertExpectations(t)
+}
+
+func TestRetryGetDoesNotRetryMisses(t *testing.T) {
+	mkv := new(MockKVStore)
+	s := gobuddyfs.NewRetryingKVStore(mkv, testRetryPolicy, nil)
+	mkv.On("Get", "Foo", true).Return(nil, gobuddyfs.ErrNotFound).Once()
+
+	_, err := s.Get("Foo", true)
+
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+	mkv.AssertExpectations(t)
+}
+
+func TestRetrySetGivesUpAsTransient(t *testing.T) {
+	mkv := new(MockKVStore)
+	retryAll := func(err error) bool { return err != gobuddyfs.ErrNotFound }
+	s := gobuddyfs.NewRetryingKVStore(mkv, testRetryPolicy, retryAll)
+	mkv.On("Set", "Foo", mock.Anything).Return(fmt.Errorf("DHT error")).Times(3)
+
+	err := s.Set("Foo", []byte("bar"))
+
+	assert.True(t, gobuddyfs.IsTransient(err))
+	mkv.AssertExpectations(t)
+}
+
+func TestRetryBackoffGrowsWithoutCap(t *testing.T) {
+	mkv := new(MockKVStore)
+	policy := gobuddyfs.RetryPolicy{MaxAttempts: 5, InitialBackoff: 5 * time.Millisecond}
+	s := gobuddyfs.NewRetryingKVStore(mkv, policy, nil)
+	mkv.On("Get", "Foo", true).Return(nil, errUnreachable).Times(5)
+
+	start := time.Now()
+	_, err := s.Get("Foo", true)
+
+	// 5, 10, 20 and 40ms; without growth, the waits would add up to 20ms.
+	assert.True(t, gobuddyfs.IsTransient(err))
+	assert.True(t, time.Since(start) >= 75*time.Millisecond, "retried after %s", time.Since(start))
+	mkv.AssertExpectations(t)
+}
@@ -0,0 +1,632 @@
+package gobuddyfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Number of points each member gets on the ring by default.
+const defaultVirtualNodes = 64
+
+// Number of locks which operations on the same key are serialized on.
+const ringLocks = 64
+
+// RING_MEMBERS_KEY holds the ring's membership in every member, so that a
+// ring is reopened with the members it last had, and a change which was
+// interrupted is resumed. It is not part of the keys the ring spreads over its
+// members.
+const RING_MEMBERS_KEY = "RING_MEMBERS"
+
+var ErrMemberExists = errors.New("ring member already exists")
+var ErrNoMember = errors.New("no such ring member")
+
+// errRingDiverged is wrapped in a Corrupt StoreError when a key being moved
+// has different values with its previous and its current owner, so that it
+// can't be told which one is newer.
+var errRingDiverged = errors.New("key differs between its previous and current owner")
+
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+// hashRing maps keys to members by consistent hashing.
+type hashRing struct {
+	points  []ringPoint
+	members map[string]KVStore
+}
+
+// ringHash hashes s onto the ring. FNV alone leaves the high bits of short,
+// similar strings such as block ids close together, so its result is mixed
+// with the MurmurHash3 finalizer.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func newHashRing(members map[string]KVStore, vnodes int) *hashRing {
+	r := &hashRing{members: members}
+	for name := range members {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringPoint{ringHash(name + "#" + strconv.Itoa(i)), name})
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].member < r.points[j].member
+	})
+	return r
+}
+
+// owner returns the member responsible for key, which is the one at the first
+// point at or after the key's hash.
+func (r *hashRing) owner(key string) (string, KVStore) {
+	if len(r.points) == 0 {
+		return "", nil
+	}
+
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	name := r.points[i].member
+	return name, r.members[name]
+}
+
+// RingKVStore spreads keys over its members by consistent hashing, with every
+// member placed at several virtual points on the ring so that keys are spread
+// evenly. When a member is added or removed, only the keys whose owner changed
+// are moved, in the background. Until that is done, keys which haven't been
+// moved yet are read from their previous owner, and a key is moved first
+// whenever it is written. Moving keys requires every member to be scannable.
+//
+// Once the membership has been recorded with SaveMembers, every change is
+// recorded, along with the previous membership, before any key is moved, and
+// recorded again once they all are.
+type RingKVStore struct {
+	lock     sync.RWMutex
+	vnodes   int
+	current  *hashRing
+	previous *hashRing // Set while rebalancing.
+	recorded bool
+
+	keyLocks [ringLocks]sync.Mutex
+
+	changeLock sync.Mutex
+	rebalanced chan struct{}
+	err        error
+
+	// Implements: KVStore, ContextKVStore, DeletableKVStore, ScannableKVStore,
+	// CASKVStore, SyncableKVStore
+}
+
+// NewRingKVStore returns a ring without members, with vnodes points per
+// member. A vnodes of zero uses a default.
+func NewRingKVStore(vnodes int) *RingKVStore {
+	if vnodes < 1 {
+		vnodes = defaultVirtualNodes
+	}
+
+	done := make(chan struct{})
+	close(done)
+	return &RingKVStore{vnodes: vnodes, rebalanced: done,
+		current: newHashRing(map[string]KVStore{}, vnodes)}
+}
+
+// NewRingKVStoreWithMembers returns a ring of members, with vnodes points per
+// member, which is taken to hold its keys where they belong already, as when
+// reopening a ring with the members it last had.
+func NewRingKVStoreWithMembers(members map[string]KVStore, vnodes int) *RingKVStore {
+	r := NewRingKVStore(vnodes)
+	copied := make(map[string]KVStore, len(members))
+	for name, store := range members {
+		copied[name] = store
+	}
+	r.current = newHashRing(copied, r.vnodes)
+	return r
+}
+
+// ResumeRingKVStore returns a ring which is moving its keys from the previous
+// members to members, as LoadRingMembers finds it after a change was
+// interrupted, and carries on moving them.
+func ResumeRingKVStore(previous, members map[string]KVStore, vnodes int) *RingKVStore {
+	r := NewRingKVStoreWithMembers(members, vnodes)
+	copied := make(map[string]KVStore, len(previous))
+	for name, store := range previous {
+		copied[name] = store
+	}
+	r.previous = newHashRing(copied, r.vnodes)
+	r.recorded = true
+	r.rebalanced = make(chan struct{})
+
+	go r.rebalance()
+	return r
+}
+
+// ringMembers is the membership recorded under RING_MEMBERS_KEY. Every change
+// bumps the version, so that members which missed a change are outvoted.
+type ringMembers struct {
+	Version uint64
+	Members []string
+	// Set while keys are moved from these members to Members.
+	Previous []string `json:",omitempty"`
+}
+
+// LoadRingMembers returns the newest membership recorded in stores, or nil if
+// none is. If a change of membership didn't finish, previous is the
+// membership before it.
+func LoadRingMembers(stores []KVStore) (members, previous []string, err error) {
+	var newest *ringMembers
+	for _, store := range stores {
+		data, err := kvGet(context.Background(), store, RING_MEMBERS_KEY, true)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		var record ringMembers
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, nil, &StoreError{Class: Corrupt, Op: "get", Key: RING_MEMBERS_KEY, Err: err}
+		}
+		if newest == nil || record.Version > newest.Version {
+			newest = &record
+		}
+	}
+
+	if newest == nil {
+		return nil, nil, nil
+	}
+	return newest.Members, newest.Previous, nil
+}
+
+// SaveMembers records the ring's membership in every member, and has later
+// changes recorded too. It should be called once the keys have been moved
+// after a change.
+func (self *RingKVStore) SaveMembers() error {
+	self.lock.Lock()
+	self.recorded = true
+	current := self.current
+	self.lock.Unlock()
+
+	return saveMembers(current, nil)
+}
+
+func memberNames(r *hashRing) []string {
+	var names []string
+	for name := range r.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// saveMembers records the membership of current in its members and, while
+// moving keys from previous, in those of previous too. Members of neither are
+// left alone; the record of previous members which left is deleted.
+func saveMembers(current, previous *hashRing) error {
+	record := ringMembers{Members: memberNames(current)}
+	stores := make(map[string]KVStore)
+	for name, store := range current.members {
+		stores[name] = store
+	}
+	if previous != nil {
+		record.Previous = memberNames(previous)
+		for name, store := range previous.members {
+			stores[name] = store
+		}
+	}
+
+	ctx := context.Background()
+	for _, store := range stores {
+		data, err := kvGet(ctx, store, RING_MEMBERS_KEY, true)
+		if err == nil {
+			var old ringMembers
+			if json.Unmarshal(data, &old) == nil && old.Version >= record.Version {
+				record.Version = old.Version + 1
+			}
+		} else if err != ErrNotFound {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	for _, store := range stores {
+		if err := kvSet(ctx, store, RING_MEMBERS_KEY, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetMembers deletes the record of the members of previous which are not in
+// current.
+func forgetMembers(current, previous *hashRing) error {
+	for name, store := range previous.members {
+		if _, ok := current.members[name]; ok {
+			continue
+		}
+		err := kvDelete(context.Background(), store, RING_MEMBERS_KEY)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Members returns the names of the ring's members.
+func (self *RingKVStore) Members() []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return memberNames(self.current)
+}
+
+// AddMember adds store to the ring under name, and starts moving the keys it
+// now owns to it.
+func (self *RingKVStore) AddMember(name string, store KVStore) error {
+	return self.change(func(members map[string]KVStore) error {
+		if _, ok := members[name]; ok {
+			return ErrMemberExists
+		}
+		members[name] = store
+		return nil
+	})
+}
+
+// RemoveMember removes the named member from the ring, and starts moving its
+// keys to the remaining members. The member's store must stay available until
+// Wait returns.
+func (self *RingKVStore) RemoveMember(name string) error {
+	return self.change(func(members map[string]KVStore) error {
+		if _, ok := members[name]; !ok {
+			return ErrNoMember
+		}
+		delete(members, name)
+		return nil
+	})
+}
+
+// change applies update to a copy of the membership and rebalances the keys.
+// It first waits for the previous rebalance to finish.
+func (self *RingKVStore) change(update func(members map[string]KVStore) error) error {
+	self.changeLock.Lock()
+	defer self.changeLock.Unlock()
+
+	if err := self.Wait(); err != nil {
+		// Keys may still be on the previous ring's members; move them
+		// before forgetting where they were.
+		self.lock.Lock()
+		self.rebalanced = make(chan struct{})
+		self.lock.Unlock()
+
+		self.rebalance()
+		if err := self.Wait(); err != nil {
+			return err
+		}
+	}
+
+	self.lock.Lock()
+	members := make(map[string]KVStore, len(self.current.members)+1)
+	for name, store := range self.current.members {
+		members[name] = store
+	}
+	if err := update(members); err != nil {
+		self.lock.Unlock()
+		return err
+	}
+	previous, current := self.current, newHashRing(members, self.vnodes)
+	recorded := self.recorded
+	self.lock.Unlock()
+
+	// Nothing is moved before the change is recorded, so that a change which
+	// is interrupted is resumed rather than forgotten.
+	if recorded {
+		if err := saveMembers(current, previous); err != nil {
+			return err
+		}
+	}
+
+	self.lock.Lock()
+	self.previous, self.current = previous, current
+	self.rebalanced = make(chan struct{})
+	self.lock.Unlock()
+
+	go self.rebalance()
+	return nil
+}
+
+// Wait waits until the keys have been moved after the last membership change,
+// and returns the error which stopped that, if any.
+func (self *RingKVStore) Wait() error {
+	self.lock.RLock()
+	done := self.rebalanced
+	self.lock.RUnlock()
+
+	<-done
+
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.err
+}
+
+// rebalance moves every key whose owner has changed to its new owner.
+func (self *RingKVStore) rebalance() {
+	self.lock.RLock()
+	previous, current := self.previous, self.current
+	done, recorded := self.rebalanced, self.recorded
+	self.lock.RUnlock()
+
+	var err error
+	moved := 0
+	for name, store := range previous.members {
+		var keys []string
+		err = Scan(store, "", "", func(key string, value []byte) bool {
+			if key == RING_MEMBERS_KEY {
+				return true
+			}
+			if owner, _ := previous.owner(key); owner != name {
+				// A leftover from an earlier move.
+				return true
+			}
+			if owner, _ := current.owner(key); owner != name {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		if err != nil {
+			break
+		}
+
+		for _, key := range keys {
+			if err = self.settle(context.Background(), key); err != nil {
+				break
+			}
+			moved++
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil && recorded {
+		if err = saveMembers(current, nil); err == nil {
+			err = forgetMembers(current, previous)
+		}
+	}
+
+	self.lock.Lock()
+	self.err = err
+	if err == nil {
+		self.previous = nil
+	} else {
+		glog.Errorf("Error while rebalancing ring: %q", err)
+	}
+	self.lock.Unlock()
+	close(done)
+
+	if err == nil && glog.V(1) {
+		glog.Infof("Rebalanced ring, moved %d keys", moved)
+	}
+}
+
+func (self *RingKVStore) keyLock(key string) *sync.Mutex {
+	return &self.keyLocks[ringHash(key)%ringLocks]
+}
+
+// owners returns the current owner of key and, if the key may not have been
+// moved there yet, its previous owner.
+func (self *RingKVStore) owners(key string) (KVStore, KVStore) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	name, owner := self.current.owner(key)
+	if self.previous == nil {
+		return owner, nil
+	}
+	if prevName, prev := self.previous.owner(key); prevName != name {
+		return owner, prev
+	}
+	return owner, nil
+}
+
+// settle moves key to its current owner, if it is still with its previous
+// one. It locks the key.
+func (self *RingKVStore) settle(ctx context.Context, key string) error {
+	l := self.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	owner, prev := self.owners(key)
+	if prev == nil {
+		return nil
+	}
+	return self.move(ctx, key, owner, prev)
+}
+
+// move copies key from prev to owner, and then deletes it from prev. If owner
+// has the key already, as when an earlier move was interrupted, it must have
+// the same value; otherwise both are left as they are. The caller must hold
+// the key's lock.
+func (self *RingKVStore) move(ctx context.Context, key string, owner, prev KVStore) error {
+	value, err := kvGet(ctx, prev, key, true)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = kvCompareAndSet(ctx, owner, key, nil, value)
+	if err == ErrConflict {
+		var current []byte
+		current, err = kvGet(ctx, owner, key, true)
+		if err == nil && !bytes.Equal(current, value) {
+			err = &StoreError{Class: Corrupt, Op: "move", Key: key, Err: errRingDiverged}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return kvCompareAndSet(ctx, prev, key, value, nil)
+}
+
+// write runs op on the current owner of key, moving the key there first if
+// needed.
+func (self *RingKVStore) write(ctx context.Context, key string, op func(owner KVStore) error) error {
+	l := self.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	owner, prev := self.owners(key)
+	if owner == nil {
+		return ErrNoMember
+	}
+	if prev != nil {
+		if err := self.move(ctx, key, owner, prev); err != nil {
+			return err
+		}
+	}
+	return op(owner)
+}
+
+func (self *RingKVStore) Get(key string, retry bool) ([]byte, error) {
+	return self.GetContext(context.Background(), key, retry)
+}
+
+func (self *RingKVStore) Set(key string, value []byte) error {
+	return self.SetContext(context.Background(), key, value)
+}
+
+func (self *RingKVStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	owner, prev := self.owners(key)
+	if owner == nil {
+		return nil, ErrNoMember
+	}
+
+	value, err := kvGet(ctx, owner, key, retry)
+	if err != ErrNotFound || prev == nil {
+		return value, err
+	}
+
+	value, err = kvGet(ctx, prev, key, retry)
+	if err != ErrNotFound {
+		return value, err
+	}
+
+	// It may have been moved in the meantime.
+	return kvGet(ctx, owner, key, retry)
+}
+
+func (self *RingKVStore) SetContext(ctx context.Context, key string, value []byte) error {
+	return self.write(ctx, key, func(owner KVStore) error {
+		return kvSet(ctx, owner, key, value)
+	})
+}
+
+func (self *RingKVStore) Delete(key string) error {
+	ctx := context.Background()
+	return self.write(ctx, key, func(owner KVStore) error {
+		return kvDelete(ctx, owner, key)
+	})
+}
+
+func (self *RingKVStore) CompareAndSet(key string, expected, value []byte) error {
+	ctx := context.Background()
+	return self.write(ctx, key, func(owner KVStore) error {
+		return kvCompareAndSet(ctx, owner, key, expected, value)
+	})
+}
+
+// Scan visits the keys of every member, including those of the previous ring
+// while rebalancing.
+func (self *RingKVStore) Scan(start, end string, visit ScanFunc) error {
+	self.lock.RLock()
+	stores := make(map[string]KVStore)
+	for name, store := range self.current.members {
+		stores[name] = store
+	}
+	if self.previous != nil {
+		for name, store := range self.previous.members {
+			stores[name] = store
+		}
+	}
+	self.lock.RUnlock()
+
+	keys := make(map[string]bool)
+	for _, store := range stores {
+		err := Scan(store, start, end, func(key string, value []byte) bool {
+			if key != RING_MEMBERS_KEY {
+				keys[key] = true
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		value, err := self.Get(key, false)
+		if err == ErrNotFound {
+			// Deleted since the keys were collected.
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !visit(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (self *RingKVStore) Sync() error {
+	self.lock.RLock()
+	var stores []KVStore
+	for _, store := range self.current.members {
+		stores = append(stores, store)
+	}
+	self.lock.RUnlock()
+
+	for _, store := range stores {
+		if err := kvSync(context.Background(), store); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ KVStore = new(RingKVStore)
+var _ ContextKVStore = new(RingKVStore)
+var _ DeletableKVStore = new(RingKVStore)
+var _ CASKVStore = new(RingKVStore)
+var _ SyncableKVStore = new(RingKVStore)
+var _ ScannableKVStore = new(RingKVStore)
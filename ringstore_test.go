@@ -0,0 +1,211 @@
+package gobuddyfs_test
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func countKeys(t *testing.T, s gobuddyfs.KVStore) int {
+	n := 0
+	err := gobuddyfs.Scan(s, "", "", func(key string, value []byte) bool {
+		n++
+		return true
+	})
+	assert.NoError(t, err)
+	return n
+}
+
+func TestRingRebalance(t *testing.T) {
+	const numKeys = 1000
+	r := gobuddyfs.NewRingKVStore(0)
+	stores := map[string]*gobuddyfs.MemStore{}
+	for _, name := range []string{"a", "b", "c"} {
+		stores[name] = gobuddyfs.NewMemStore()
+		assert.NoError(t, r.AddMember(name, stores[name]))
+	}
+	assert.NoError(t, r.Wait())
+
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(i)
+		assert.NoError(t, r.Set(key, []byte(key)))
+	}
+	for _, s := range stores {
+		assert.True(t, countKeys(t, s) > numKeys/10)
+	}
+
+	readAll := func() {
+		for i := 0; i < numKeys; i++ {
+			key := strconv.Itoa(i)
+			v, err := r.Get(key, false)
+			assert.NoError(t, err)
+			assert.Equal(t, key, string(v))
+		}
+	}
+
+	before := map[string]int{}
+	for name, s := range stores {
+		before[name] = countKeys(t, s)
+	}
+
+	stores["d"] = gobuddyfs.NewMemStore()
+	assert.NoError(t, r.AddMember("d", stores["d"]))
+	// Keys can be read while they are being moved.
+	readAll()
+	assert.NoError(t, r.Wait())
+	readAll()
+
+	// Keys are only moved to the new member, not between the old ones.
+	total := 0
+	for name, s := range stores {
+		n := countKeys(t, s)
+		total += n
+		if name != "d" {
+			assert.True(t, n <= before[name])
+		}
+	}
+	assert.Equal(t, numKeys, total)
+	assert.True(t, countKeys(t, stores["d"]) > numKeys/10)
+
+	assert.Equal(t, gobuddyfs.ErrMemberExists, r.AddMember("d", stores["d"]))
+	assert.NoError(t, r.RemoveMember("a"))
+	// Writes during the rebalance land with the new owner.
+	assert.NoError(t, r.Set("0", []byte("0")))
+	assert.NoError(t, r.Delete("1"))
+	assert.NoError(t, r.Wait())
+
+	assert.Equal(t, 0, countKeys(t, stores["a"]))
+	assert.Equal(t, []string{"b", "c", "d"}, r.Members())
+	assert.Equal(t, numKeys-1, countKeys(t, r))
+	_, err := r.Get("1", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+	v, err := r.Get("2", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), v)
+}
+
+func TestRingMembers(t *testing.T) {
+	stores := map[string]gobuddyfs.KVStore{}
+	var list []gobuddyfs.KVStore
+	for _, name := range []string{"a", "b", "c"} {
+		stores[name] = gobuddyfs.NewMemStore()
+		list = append(list, stores[name])
+	}
+
+	members, _, err := gobuddyfs.LoadRingMembers(list)
+	assert.NoError(t, err)
+	assert.Nil(t, members)
+
+	r := gobuddyfs.NewRingKVStoreWithMembers(stores, 0)
+	assert.NoError(t, r.SaveMembers())
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		assert.NoError(t, r.Set(key, []byte(key)))
+	}
+	// The record is not one of the ring's keys.
+	assert.Equal(t, 100, countKeys(t, r))
+
+	// Reopening the ring with the same members moves nothing.
+	r = gobuddyfs.NewRingKVStoreWithMembers(stores, 0)
+	for i := 0; i < 100; i++ {
+		v, err := r.Get(strconv.Itoa(i), false)
+		assert.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(i), string(v))
+	}
+
+	// A member which missed a change is outvoted.
+	d := gobuddyfs.NewMemStore()
+	assert.NoError(t, r.AddMember("d", d))
+	assert.NoError(t, r.Wait())
+	assert.NoError(t, r.RemoveMember("a"))
+	assert.NoError(t, r.Wait())
+	assert.NoError(t, r.SaveMembers())
+	members, _, err = gobuddyfs.LoadRingMembers(append(list, d))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c", "d"}, members)
+	assert.Equal(t, 100, countKeys(t, r))
+}
+
+// UnreadableKVStore is a MemStore whose values other than the ring's record
+// can't be read for a while, but which still takes writes.
+type UnreadableKVStore struct {
+	*gobuddyfs.MemStore
+	unreadable atomic.Bool
+}
+
+func (u *UnreadableKVStore) Get(key string, retry bool) ([]byte, error) {
+	if u.unreadable.Load() && key != gobuddyfs.RING_MEMBERS_KEY {
+		return nil, errUnplugged
+	}
+	return u.MemStore.Get(key, retry)
+}
+
+func (u *UnreadableKVStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	return u.Get(key, retry)
+}
+
+func TestRingResume(t *testing.T) {
+	a := &UnreadableKVStore{MemStore: gobuddyfs.NewMemStore()}
+	b, c, d := gobuddyfs.NewMemStore(), gobuddyfs.NewMemStore(), gobuddyfs.NewMemStore()
+	before := map[string]gobuddyfs.KVStore{"a": a, "b": b, "c": c}
+	r := gobuddyfs.NewRingKVStoreWithMembers(before, 0)
+	assert.NoError(t, r.SaveMembers())
+	for i := 0; i < 200; i++ {
+		key := strconv.Itoa(i)
+		assert.NoError(t, r.Set(key, []byte(key)))
+	}
+
+	// The change is recorded before anything is moved, so it is still known
+	// after moving the keys failed part way.
+	a.unreadable.Store(true)
+	assert.NoError(t, r.AddMember("d", d))
+	assert.Error(t, r.Wait())
+	members, previous, err := gobuddyfs.LoadRingMembers([]gobuddyfs.KVStore{b, c, d})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, members)
+	assert.Equal(t, []string{"a", "b", "c"}, previous)
+	a.unreadable.Store(false)
+
+	// A key which has different values with its previous and current owners
+	// is left alone.
+	var moved string
+	for i := 0; i < 200 && moved == ""; i++ {
+		key := strconv.Itoa(i)
+		// Writes move the key first, which fails for keys still with a.
+		if r.Set(key, []byte(key)) == nil && hasValue(d, key, []byte(key))() {
+			moved = key
+		}
+	}
+	assert.NotEmpty(t, moved)
+	for _, s := range []*gobuddyfs.MemStore{a.MemStore, b, c} {
+		assert.NoError(t, s.Set(moved, []byte("stale")))
+	}
+	err = r.Set(moved, []byte("new"))
+	assert.True(t, gobuddyfs.IsCorrupt(err), "%v", err)
+	v, err := d.Get(moved, false)
+	assert.NoError(t, err)
+	assert.Equal(t, moved, string(v))
+	for _, s := range []*gobuddyfs.MemStore{a.MemStore, b, c} {
+		assert.NoError(t, s.Delete(moved))
+	}
+
+	// Reopened as recorded, the ring finishes the change.
+	after := map[string]gobuddyfs.KVStore{"a": a, "b": b, "c": c, "d": d}
+	r = gobuddyfs.ResumeRingKVStore(before, after, 0)
+	assert.NoError(t, r.Wait())
+	members, previous, err = gobuddyfs.LoadRingMembers([]gobuddyfs.KVStore{a, b, c, d})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, members)
+	assert.Nil(t, previous)
+	for i := 0; i < 200; i++ {
+		v, err := r.Get(strconv.Itoa(i), false)
+		assert.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(i), string(v))
+	}
+	assert.Equal(t, 200, countKeys(t, r))
+}
@@ -0,0 +1,169 @@
+package gobuddyfs
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// ScrubResult describes a pass over every block of a volume.
+type ScrubResult struct {
+	// Number of blocks read.
+	Blocks int
+	// Ids of the blocks which are missing or fail to decode.
+	Damaged []int64
+}
+
+type scrubber struct {
+	store  KVStore
+	result ScrubResult
+}
+
+// Scrub reads every block reachable from the root, so that damage is found
+// before the data is needed. Blocks which fail their checksum or can't be
+// decoded are logged and reported, but the pass goes on; other errors, such
+// as an unreachable store, end it.
+//
+// The filesystem may be changed while it is scrubbed. A block which can't be
+// read is only reported if the block referring to it still does.
+func (bfs *BuddyFS) Scrub(ctx context.Context) (*ScrubResult, error) {
+	if _, err := bfs.Root(); err != nil {
+		return nil, err
+	}
+
+	bfs.Lock.Lock()
+	s := &scrubber{store: bfs.Store}
+	rootId := bfs.FSM.Id
+	bfs.Lock.Unlock()
+
+	err := s.dir(ctx, rootId, func() bool { return true })
+	return &s.result, err
+}
+
+// check reads block b into m. It returns false if the block is damaged, or if
+// it no longer exists because it was removed meanwhile.
+func (s *scrubber) check(ctx context.Context, b *Block, m Marshalable, referenced func() bool) (bool, error) {
+	s.result.Blocks++
+	err := b.ReadBlock(ctx, m, s.store)
+	if err == nil {
+		return true, nil
+	} else if !IsCorrupt(err) {
+		return false, err
+	}
+
+	if referenced() {
+		glog.Errorf("Scrub found damaged block %d: %s", b.Id, err)
+		s.result.Damaged = append(s.result.Damaged, b.Id)
+	}
+	return false, nil
+}
+
+func (s *scrubber) dir(ctx context.Context, id int64, referenced func() bool) error {
+	dir := &Dir{Block: Block{Id: id}}
+	if ok, err := s.check(ctx, &dir.Block, dir, referenced); !ok {
+		return err
+	}
+
+	// Whether the directory, as it is now, still has an entry with the id.
+	hasEntry := func(id int64) func() bool {
+		return func() bool {
+			now := &Dir{Block: Block{Id: dir.Id}}
+			if now.ReadBlock(ctx, now, s.store) != nil {
+				return referenced()
+			}
+			for _, entry := range append(now.Dirs, now.Files...) {
+				if entry.Id == id {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	for _, entry := range dir.Dirs {
+		if err := s.dir(ctx, entry.Id, hasEntry(entry.Id)); err != nil {
+			return err
+		}
+	}
+	for _, entry := range dir.Files {
+		if err := s.file(ctx, entry.Id, hasEntry(entry.Id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *scrubber) file(ctx context.Context, id int64, referenced func() bool) error {
+	file := &File{Block: Block{Id: id}}
+	if ok, err := s.check(ctx, &file.Block, file, referenced); !ok {
+		return err
+	}
+
+	// Blocks are compared by key, as content-addressed ones have no lasting id.
+	hasBlock := func(key string) func() bool {
+		return func() bool {
+			now := &File{Block: Block{Id: file.Id}}
+			if now.ReadBlock(ctx, now, s.store) != nil {
+				return referenced()
+			}
+			for _, blk := range now.Blocks {
+				if b, ok := blk.(*Block); ok && b.key(s.store) == key {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	for _, blk := range file.Blocks {
+		b := &Block{Id: blk.GetId(), hash: blockHash(blk)}
+		_, err := s.check(ctx, b, &DataBlock{StorageUnit: b}, hasBlock(b.key(s.store)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartScrubber scrubs the volume every interval in the background, until the
+// returned function is called.
+func (bfs *BuddyFS) StartScrubber(interval time.Duration) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			start := time.Now()
+			result, err := bfs.Scrub(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					glog.Warningf("Scrub stopped early: %s", err)
+				}
+				continue
+			}
+			if len(result.Damaged) > 0 {
+				glog.Errorf("Scrub found %d damaged blocks out of %d", len(result.Damaged),
+					result.Blocks)
+			} else if glog.V(1) {
+				glog.Infof("Scrubbed %d blocks in %s", result.Blocks, time.Since(start))
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,55 @@
+package gobuddyfs_test
+
+import (
+	"strconv"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestScrub(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	bfs := gobuddyfs.NewBuddyFS(memkv)
+	root, err := bfs.Root()
+	assert.NoError(t, err)
+
+	node, err := root.(*gobuddyfs.FSMeta).Mkdir(context.TODO(), &fuse.MkdirRequest{Name: "dir"})
+	assert.NoError(t, err)
+	node, _, err = node.(*gobuddyfs.Dir).Create(context.TODO(), &fuse.CreateRequest{Name: "file"}, nil)
+	assert.NoError(t, err)
+	file := node.(*gobuddyfs.File)
+	assert.NoError(t, file.Write(context.TODO(), &fuse.WriteRequest{Data: []byte("hello")},
+		&fuse.WriteResponse{}))
+	assert.NoError(t, file.Flush(context.TODO(), &fuse.FlushRequest{}))
+
+	result, err := bfs.Scrub(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 4, result.Blocks)
+	assert.Empty(t, result.Damaged)
+
+	// Flip a bit in the data block.
+	id := file.Blocks[0].GetId()
+	key := strconv.FormatInt(id, 10)
+	value, err := memkv.Get(key, false)
+	assert.NoError(t, err)
+	value[len(value)-1] ^= 1
+	assert.NoError(t, memkv.Set(key, value))
+
+	result, err = bfs.Scrub(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{id}, result.Damaged)
+
+	// Reading it fails instead of returning the damaged data.
+	root, err = gobuddyfs.NewBuddyFS(memkv).Root()
+	assert.NoError(t, err)
+	node, err = lookup(root, "dir")
+	assert.NoError(t, err)
+	node, err = lookup(node, "file")
+	assert.NoError(t, err)
+	err = node.(*gobuddyfs.File).Read(context.TODO(), &fuse.ReadRequest{Size: 5},
+		&fuse.ReadResponse{})
+	assert.Equal(t, fuse.EIO, err)
+}
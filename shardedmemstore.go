@@ -0,0 +1,92 @@
+package gobuddyfs
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// ShardedMemStore spreads keys over several independently locked MemStores,
+// so that writers to different keys rarely wait for each other. It behaves
+// like a single MemStore.
+type ShardedMemStore struct {
+	shards []*MemStore
+
+	// Implements: KVStore, ContextKVStore, DeletableKVStore, ScannableKVStore,
+	// CASKVStore
+}
+
+// NewShardedMemStore returns an empty store with the given number of shards.
+func NewShardedMemStore(shards int) *ShardedMemStore {
+	if shards < 1 {
+		shards = 1
+	}
+
+	s := &ShardedMemStore{shards: make([]*MemStore, shards)}
+	for i := range s.shards {
+		s.shards[i] = NewMemStore()
+	}
+	return s
+}
+
+func (self *ShardedMemStore) shard(key string) *MemStore {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return self.shards[h.Sum32()%uint32(len(self.shards))]
+}
+
+func (self *ShardedMemStore) Get(key string, retry bool) ([]byte, error) {
+	return self.shard(key).Get(key, retry)
+}
+
+func (self *ShardedMemStore) Set(key string, value []byte) error {
+	return self.shard(key).Set(key, value)
+}
+
+func (self *ShardedMemStore) Delete(key string) error {
+	return self.shard(key).Delete(key)
+}
+
+func (self *ShardedMemStore) CompareAndSet(key string, expected, value []byte) error {
+	return self.shard(key).CompareAndSet(key, expected, value)
+}
+
+func (self *ShardedMemStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	return self.shard(key).GetContext(ctx, key, retry)
+}
+
+func (self *ShardedMemStore) SetContext(ctx context.Context, key string, value []byte) error {
+	return self.shard(key).SetContext(ctx, key, value)
+}
+
+func (self *ShardedMemStore) Scan(start, end string, visit ScanFunc) error {
+	var keys []string
+	for _, shard := range self.shards {
+		shard.Scan(start, end, func(key string, value []byte) bool {
+			keys = append(keys, key)
+			return true
+		})
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, err := self.Get(key, false)
+		if err == ErrNotFound {
+			// Deleted since the keys were collected.
+			continue
+		}
+		if !visit(key, value) {
+			break
+		}
+	}
+
+	return nil
+}
+
+var _ KVStore = new(ShardedMemStore)
+var _ ContextKVStore = new(ShardedMemStore)
+var _ DeletableKVStore = new(ShardedMemStore)
+var _ CASKVStore = new(ShardedMemStore)
+var _ ScannableKVStore = new(ShardedMemStore)
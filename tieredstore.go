@@ -0,0 +1,769 @@
+package gobuddyfs
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Number of locks which writes to the same key are serialized on.
+const tierLocks = 64
+
+// TieredKVStoreOptions controls the cache of a TieredKVStore.
+type TieredKVStoreOptions struct {
+	// MaxBytes is the total size of the values kept in the cache. Keys with
+	// writes which haven't reached the remote store yet can't be evicted, so
+	// in write-back mode the cache may exceed it for a while.
+	MaxBytes int64
+	// WriteBack completes writes once they are in the cache, and copies them
+	// to the remote store in the background. Otherwise writes go to the
+	// remote store first.
+	WriteBack bool
+	// FlushInterval is how often writes are copied to the remote store in
+	// write-back mode. Zero uses a default of one second.
+	FlushInterval time.Duration
+	// StatePath is the file the cache's contents and pending writes are
+	// recorded in, so that they survive a restart. Without it the cache
+	// starts out empty.
+	StatePath string
+}
+
+type tierEntry struct {
+	Key  string
+	Size int64
+}
+
+// tierState is what is stored at StatePath.
+type tierState struct {
+	// Cached keys, most recently used first.
+	Entries []tierEntry
+	// Keys written, or deleted if not cached, but not yet copied to the
+	// remote store.
+	Dirty []string
+	// Keys which were being written or deleted in write-back mode. Loading
+	// the state settles them by looking at the cache.
+	Writing  []string `json:",omitempty"`
+	Deleting []string `json:",omitempty"`
+}
+
+// TieredKVStore keeps recently used values of a slow remote store in a faster
+// local one, evicting the least recently used ones to stay within a size
+// budget.
+//
+// In write-back mode writes, including deletes, are only recorded in the
+// cache and copied to the remote store by a background flusher and by Sync.
+// With a StatePath, a write is recorded there before it completes, so that it
+// is still copied after a crash; without one, writes which haven't been
+// synced are lost if the process dies.
+//
+// Cached values are never checked against the remote store again, and in
+// write-back mode compare-and-set only compares against what this store has
+// seen. Whichever the mode, nothing else may write to the remote store.
+type TieredKVStore struct {
+	cache, remote KVStore
+	opts          TieredKVStoreOptions
+
+	keyLocks [tierLocks]sync.Mutex
+
+	lock    sync.Mutex
+	lru     *list.List // Of *tierEntry, most recently used first.
+	entries map[string]*list.Element
+	size    int64
+	dirty   map[string]bool
+	// Counts writes, so that a value read from the remote store is only
+	// cached if nothing was written meanwhile.
+	writes uint64
+	// Set when the state has changed since it was last saved.
+	changed bool
+	// Keys being written or deleted in write-back mode, which the state
+	// records until the cache is done with them.
+	writing, deleting map[string]bool
+	// Number of snapshots of the state taken for saving, and the number of
+	// the last one saved.
+	snapshots, saved uint64
+	// For each dirty key, the first snapshot which records it as it is.
+	recorded map[string]uint64
+	// Serializes saveState.
+	saveLock sync.Mutex
+
+	kick chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// Implements: KVStore, ContextKVStore, DeletableKVStore, ScannableKVStore,
+	// CASKVStore, SyncableKVStore
+}
+
+// NewTieredKVStore puts cache in front of remote. If opts.StatePath names an
+// existing state file, the cache picks up where it was left; otherwise
+// anything already in a scannable cache store is cleared out.
+func NewTieredKVStore(cache, remote KVStore, opts TieredKVStoreOptions) (*TieredKVStore, error) {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+
+	self := &TieredKVStore{cache: cache, remote: remote, opts: opts, lru: list.New(),
+		entries: make(map[string]*list.Element), dirty: make(map[string]bool),
+		writing: make(map[string]bool), deleting: make(map[string]bool),
+		recorded: make(map[string]uint64), kick: make(chan struct{}, 1), done: make(chan struct{})}
+
+	if err := self.loadState(); err != nil {
+		return nil, err
+	}
+
+	if opts.WriteBack {
+		self.wg.Add(1)
+		go self.flusher()
+	}
+	return self, nil
+}
+
+func (self *TieredKVStore) loadState() error {
+	var state tierState
+	data, err := ioutil.ReadFile(self.opts.StatePath)
+	if self.opts.StatePath == "" || os.IsNotExist(err) {
+		// Whatever the cache holds can't be trusted to be current.
+		var keys []string
+		Scan(self.cache, "", "", func(key string, value []byte) bool {
+			keys = append(keys, key)
+			return true
+		})
+		for _, key := range keys {
+			kvDelete(context.Background(), self.cache, key)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return &StoreError{Class: Corrupt, Op: "load", Key: self.opts.StatePath, Err: err}
+	}
+
+	for _, entry := range state.Entries {
+		entry := entry
+		self.entries[entry.Key] = self.lru.PushBack(&entry)
+		self.size += entry.Size
+	}
+	for _, key := range state.Dirty {
+		self.dirty[key] = true
+		self.recorded[key] = 0
+	}
+
+	// Writes which were under way may or may not have reached the cache.
+	ctx := context.Background()
+	for _, key := range state.Writing {
+		value, err := kvGet(ctx, self.cache, key, false)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		self.cached(key, int64(len(value)), true)
+	}
+	for _, key := range state.Deleting {
+		if err := kvDelete(ctx, self.cache, key); err != nil {
+			return err
+		}
+		self.uncached(key)
+		self.dirty[key] = true
+		self.recorded[key] = 0
+		self.changed = true
+	}
+
+	// Values cached after the state was last saved aren't listed in it.
+	var stray []string
+	Scan(self.cache, "", "", func(key string, value []byte) bool {
+		if _, ok := self.entries[key]; !ok {
+			stray = append(stray, key)
+		}
+		return true
+	})
+	for _, key := range stray {
+		kvDelete(ctx, self.cache, key)
+	}
+
+	return self.saveState()
+}
+
+// saveState records the state of the cache at StatePath, if it changed.
+func (self *TieredKVStore) saveState() error {
+	if self.opts.StatePath == "" {
+		return nil
+	}
+
+	self.saveLock.Lock()
+	defer self.saveLock.Unlock()
+
+	self.lock.Lock()
+	if !self.changed {
+		self.lock.Unlock()
+		return nil
+	}
+	var state tierState
+	for e := self.lru.Front(); e != nil; e = e.Next() {
+		state.Entries = append(state.Entries, *e.Value.(*tierEntry))
+	}
+	for key := range self.dirty {
+		state.Dirty = append(state.Dirty, key)
+	}
+	for key := range self.writing {
+		state.Writing = append(state.Writing, key)
+	}
+	for key := range self.deleting {
+		state.Deleting = append(state.Deleting, key)
+	}
+	self.snapshots++
+	snapshot := self.snapshots
+	self.changed = false
+	self.lock.Unlock()
+
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+
+	// The state must never claim that the cache holds a value it doesn't,
+	// so the cache is made durable first.
+	err = kvSync(context.Background(), self.cache)
+	if err == nil {
+		err = writeFileAtomic(self.opts.StatePath, data)
+	}
+
+	self.lock.Lock()
+	if err != nil {
+		self.changed = true
+	} else {
+		self.saved = snapshot
+	}
+	self.lock.Unlock()
+	return err
+}
+
+// writeFileAtomic replaces the file at path with data, so that a crash leaves
+// either the old or the new contents behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, data, 0660)
+	if err == nil {
+		err = syncDir(tmpPath)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func (self *TieredKVStore) keyLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &self.keyLocks[h.Sum32()%tierLocks]
+}
+
+// cached records that the cache holds value under key, which is dirty if it
+// hasn't been written to the remote store yet. The caller must hold the lock.
+func (self *TieredKVStore) cached(key string, size int64, dirty bool) {
+	_, wasCached := self.entries[key]
+	if dirty && (!self.dirty[key] || !wasCached) {
+		self.recorded[key] = self.snapshots + 1
+	}
+
+	if e, ok := self.entries[key]; ok {
+		entry := e.Value.(*tierEntry)
+		self.size += size - entry.Size
+		entry.Size = size
+		self.lru.MoveToFront(e)
+	} else {
+		self.entries[key] = self.lru.PushFront(&tierEntry{Key: key, Size: size})
+		self.size += size
+	}
+
+	if dirty {
+		self.dirty[key] = true
+	} else {
+		delete(self.dirty, key)
+		delete(self.recorded, key)
+	}
+	self.changed = true
+}
+
+// uncached records that the cache no longer holds key. The caller must hold
+// the lock.
+func (self *TieredKVStore) uncached(key string) {
+	if e, ok := self.entries[key]; ok {
+		self.size -= e.Value.(*tierEntry).Size
+		self.lru.Remove(e)
+		delete(self.entries, key)
+		self.changed = true
+	}
+}
+
+// record saves the state with key listed in pending, unless the saved state
+// already has a pending write of key which is cached, or not, as isCached
+// says. A crash once it returns can't lose the write, or delete, which the
+// caller is about to make to the cache. The caller must hold the key's lock,
+// and call unrecord when done with the cache.
+func (self *TieredKVStore) record(key string, pending map[string]bool, isCached bool) error {
+	if self.opts.StatePath == "" {
+		return nil
+	}
+
+	self.lock.Lock()
+	_, ok := self.entries[key]
+	at, dirty := self.recorded[key]
+	if dirty && ok == isCached && at <= self.saved {
+		self.lock.Unlock()
+		return nil
+	}
+	pending[key] = true
+	self.changed = true
+	self.lock.Unlock()
+
+	err := self.saveState()
+	if err != nil {
+		self.unrecord(key, pending)
+	}
+	return err
+}
+
+func (self *TieredKVStore) unrecord(key string, pending map[string]bool) {
+	self.lock.Lock()
+	if pending[key] {
+		delete(pending, key)
+		self.changed = true
+	}
+	self.lock.Unlock()
+}
+
+// shrink evicts the least recently used values which have reached the remote
+// store until the cache is within its budget. The caller must not hold any
+// key's lock.
+func (self *TieredKVStore) shrink() {
+	for {
+		self.lock.Lock()
+		var key string
+		found := false
+		if self.size > self.opts.MaxBytes {
+			for e := self.lru.Back(); e != nil; e = e.Prev() {
+				if entry := e.Value.(*tierEntry); !self.dirty[entry.Key] {
+					key, found = entry.Key, true
+					break
+				}
+			}
+		}
+		self.lock.Unlock()
+
+		if !found || !self.evict(key) {
+			return
+		}
+	}
+}
+
+// evict removes key from the cache, unless it was written or removed since it
+// was picked. It returns false if that failed.
+func (self *TieredKVStore) evict(key string) bool {
+	l := self.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	self.lock.Lock()
+	_, ok := self.entries[key]
+	dirty := self.dirty[key]
+	self.lock.Unlock()
+	if !ok || dirty {
+		return true
+	}
+
+	if err := kvDelete(context.Background(), self.cache, key); err != nil {
+		glog.Warningf("Unable to evict %s from cache: %s", key, err)
+		return false
+	}
+
+	self.lock.Lock()
+	self.uncached(key)
+	self.lock.Unlock()
+	return true
+}
+
+func (self *TieredKVStore) Get(key string, retry bool) ([]byte, error) {
+	return self.GetContext(context.Background(), key, retry)
+}
+
+func (self *TieredKVStore) Set(key string, value []byte) error {
+	return self.SetContext(context.Background(), key, value)
+}
+
+func (self *TieredKVStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	value, err := self.get(ctx, key, retry, false)
+	self.shrink()
+	return value, err
+}
+
+// get reads key from the cache, or else from the remote store, caching what
+// it read. locked tells whether the caller holds the key's lock.
+func (self *TieredKVStore) get(ctx context.Context, key string, retry, locked bool) ([]byte, error) {
+	self.lock.Lock()
+	_, isCached := self.entries[key]
+	dirty := self.dirty[key]
+	writes := self.writes
+	self.lock.Unlock()
+
+	if isCached {
+		value, err := kvGet(ctx, self.cache, key, false)
+		if err == nil {
+			self.lock.Lock()
+			if e, ok := self.entries[key]; ok {
+				self.lru.MoveToFront(e)
+			}
+			self.lock.Unlock()
+			return value, nil
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		} else if dirty {
+			// The cache holds the only copy.
+			return nil, err
+		} else if err != ErrNotFound {
+			// Otherwise it was just evicted.
+			glog.Warningf("Dropping %s from cache after error: %s", key, err)
+			self.lock.Lock()
+			if self.writes == writes {
+				self.uncached(key)
+			}
+			self.lock.Unlock()
+		}
+	} else if dirty {
+		// Deleted, and not yet deleted from the remote store.
+		return nil, ErrNotFound
+	}
+
+	value, err := kvGet(ctx, self.remote, key, retry)
+	if err != nil {
+		return nil, err
+	}
+
+	if !locked {
+		l := self.keyLock(key)
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	// The value is only cached if nothing was written meanwhile; with the
+	// key's lock held, nothing can be until it is.
+	self.lock.Lock()
+	unchanged := self.writes == writes
+	self.lock.Unlock()
+	if unchanged && kvSet(ctx, self.cache, key, value) == nil {
+		self.lock.Lock()
+		self.cached(key, int64(len(value)), false)
+		self.lock.Unlock()
+	}
+	return value, nil
+}
+
+func (self *TieredKVStore) SetContext(ctx context.Context, key string, value []byte) error {
+	if value == nil {
+		return self.delete(ctx, key)
+	}
+
+	l := self.keyLock(key)
+	l.Lock()
+	err := self.write(ctx, key, value)
+	l.Unlock()
+
+	self.shrink()
+	return err
+}
+
+// invalidate drops key from the cache ahead of a write to the remote store,
+// so that the cache never holds a value older than the remote one. The caller
+// must hold the key's lock.
+func (self *TieredKVStore) invalidate(ctx context.Context, key string) error {
+	self.lock.Lock()
+	self.writes++
+	self.uncached(key)
+	self.lock.Unlock()
+	return kvDelete(ctx, self.cache, key)
+}
+
+// writeThrough runs op on the remote store, and then caches value under key
+// if op succeeded and value isn't nil. The caller must hold the key's lock.
+func (self *TieredKVStore) writeThrough(ctx context.Context, key string, value []byte,
+	op func() error) error {
+	if err := self.invalidate(ctx, key); err != nil {
+		return err
+	}
+
+	err := op()
+	if err == nil && value != nil {
+		cacheErr := kvSet(ctx, self.cache, key, value)
+		if cacheErr == nil {
+			self.lock.Lock()
+			self.writes++
+			self.cached(key, int64(len(value)), false)
+			self.lock.Unlock()
+			return nil
+		}
+		// The remote store has the value, so the cache can do without.
+		glog.Warningf("Unable to cache %s: %s", key, cacheErr)
+		kvDelete(ctx, self.cache, key)
+	}
+
+	self.lock.Lock()
+	self.writes++
+	self.lock.Unlock()
+	return err
+}
+
+// write stores value under key. The caller must hold the key's lock.
+func (self *TieredKVStore) write(ctx context.Context, key string, value []byte) error {
+	if !self.opts.WriteBack {
+		return self.writeThrough(ctx, key, value, func() error {
+			return kvSet(ctx, self.remote, key, value)
+		})
+	}
+
+	if err := self.record(key, self.writing, true); err != nil {
+		return err
+	}
+	defer self.unrecord(key, self.writing)
+
+	if err := kvSet(ctx, self.cache, key, value); err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	self.writes++
+	self.cached(key, int64(len(value)), true)
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *TieredKVStore) Delete(key string) error {
+	return self.delete(context.Background(), key)
+}
+
+func (self *TieredKVStore) delete(ctx context.Context, key string) error {
+	l := self.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	return self.remove(ctx, key)
+}
+
+// remove deletes key. The caller must hold the key's lock.
+func (self *TieredKVStore) remove(ctx context.Context, key string) error {
+	if !self.opts.WriteBack {
+		return self.writeThrough(ctx, key, nil, func() error {
+			return kvDelete(ctx, self.remote, key)
+		})
+	}
+
+	if err := self.record(key, self.deleting, false); err != nil {
+		return err
+	}
+	defer self.unrecord(key, self.deleting)
+
+	if err := kvDelete(ctx, self.cache, key); err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	self.writes++
+	if _, ok := self.entries[key]; ok || !self.dirty[key] {
+		self.recorded[key] = self.snapshots + 1
+	}
+	self.uncached(key)
+	self.dirty[key] = true
+	self.changed = true
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *TieredKVStore) CompareAndSet(key string, expected, value []byte) error {
+	ctx := context.Background()
+
+	l := self.keyLock(key)
+	l.Lock()
+	err := self.compareAndSet(ctx, key, expected, value)
+	l.Unlock()
+
+	self.shrink()
+	return err
+}
+
+// compareAndSet does the work of CompareAndSet. The caller must hold the key's
+// lock.
+func (self *TieredKVStore) compareAndSet(ctx context.Context, key string, expected, value []byte) error {
+	if !self.opts.WriteBack {
+		// A conflict leaves the key out of the cache, since someone else
+		// changed it.
+		return self.writeThrough(ctx, key, value, func() error {
+			return kvCompareAndSet(ctx, self.remote, key, expected, value)
+		})
+	}
+
+	current, err := self.get(ctx, key, true, true)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if (err == nil) != (expected != nil) || !bytes.Equal(current, expected) {
+		return ErrConflict
+	}
+
+	if value == nil {
+		return self.remove(ctx, key)
+	}
+	return self.write(ctx, key, value)
+}
+
+// Scan scans the remote store, once every pending write has reached it.
+func (self *TieredKVStore) Scan(start, end string, visit ScanFunc) error {
+	if err := self.flush(); err != nil {
+		return err
+	}
+	return Scan(self.remote, start, end, visit)
+}
+
+// flush copies every pending write to the remote store.
+func (self *TieredKVStore) flush() error {
+	self.lock.Lock()
+	keys := make([]string, 0, len(self.dirty))
+	for key := range self.dirty {
+		keys = append(keys, key)
+	}
+	self.lock.Unlock()
+
+	for _, key := range keys {
+		if err := self.flushKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *TieredKVStore) flushKey(key string) error {
+	l := self.keyLock(key)
+	l.Lock()
+	err := self.flushLocked(key)
+	l.Unlock()
+
+	// The key may be evicted now.
+	self.shrink()
+	return err
+}
+
+// flushLocked copies the pending write of key to the remote store. The caller
+// must hold the key's lock.
+func (self *TieredKVStore) flushLocked(key string) error {
+	ctx := context.Background()
+
+	self.lock.Lock()
+	dirty := self.dirty[key]
+	_, isCached := self.entries[key]
+	self.lock.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	var value []byte
+	var err error
+	if isCached {
+		if value, err = kvGet(ctx, self.cache, key, false); err != nil {
+			return err
+		}
+	}
+
+	// Writes to the key wait for its lock, so it can't change while the
+	// remote store is written.
+	if isCached {
+		err = kvSet(ctx, self.remote, key, value)
+	} else {
+		err = kvDelete(ctx, self.remote, key)
+	}
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	delete(self.dirty, key)
+	delete(self.recorded, key)
+	self.changed = true
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *TieredKVStore) flusher() {
+	defer self.wg.Done()
+
+	ticker := time.NewTicker(self.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := self.flush(); err != nil {
+			// Most likely the remote store is unreachable; try again later.
+			if glog.V(1) {
+				glog.Infof("Unable to write back to remote store: %s", err)
+			}
+		}
+		if err := self.saveState(); err != nil {
+			glog.Errorf("Error while saving cache state: %q", err)
+		}
+	}
+}
+
+// Sync copies every pending write to the remote store and syncs both stores.
+func (self *TieredKVStore) Sync() error {
+	if err := self.flush(); err != nil {
+		return err
+	}
+	if err := kvSync(context.Background(), self.remote); err != nil {
+		return err
+	}
+	return self.saveState()
+}
+
+// Close stops the background flusher, makes a last attempt at copying pending
+// writes to the remote store and saves the cache's state. Writes which didn't
+// make it are copied after the next restart.
+func (self *TieredKVStore) Close() error {
+	close(self.done)
+	self.wg.Wait()
+
+	err := self.flush()
+	if err != nil {
+		glog.Warningf("Unable to write back to remote store before closing: %s", err)
+	}
+
+	self.lock.Lock()
+	self.changed = true
+	self.lock.Unlock()
+	return self.saveState()
+}
+
+var _ KVStore = new(TieredKVStore)
+var _ ContextKVStore = new(TieredKVStore)
+var _ DeletableKVStore = new(TieredKVStore)
+var _ CASKVStore = new(TieredKVStore)
+var _ SyncableKVStore = new(TieredKVStore)
+var _ ScannableKVStore = new(TieredKVStore)
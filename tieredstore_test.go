@@ -0,0 +1,235 @@
+package gobuddyfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// BlockingKVStore is a MemStore in which reads of one key wait until released,
+// like a disk stuck on a bad sector.
+type BlockingKVStore struct {
+	*gobuddyfs.MemStore
+	key     string
+	release chan struct{}
+}
+
+func (b *BlockingKVStore) Get(key string, retry bool) ([]byte, error) {
+	if key == b.key {
+		<-b.release
+	}
+	return b.MemStore.Get(key, retry)
+}
+
+func (b *BlockingKVStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	return b.Get(key, retry)
+}
+
+// UnacknowledgedKVStore takes writes but reports them as failed, like a store
+// which timed out waiting for their acknowledgement.
+type UnacknowledgedKVStore struct {
+	*gobuddyfs.MemStore
+}
+
+func (u UnacknowledgedKVStore) Set(key string, value []byte) error {
+	u.MemStore.Set(key, value)
+	return errUnplugged
+}
+
+func (u UnacknowledgedKVStore) SetContext(ctx context.Context, key string, value []byte) error {
+	return u.Set(key, value)
+}
+
+func TestTieredWriteThrough(t *testing.T) {
+	cache := gobuddyfs.NewMemStore()
+	remote := NewFlakyKVStore()
+	s, err := gobuddyfs.NewTieredKVStore(cache, remote,
+		gobuddyfs.TieredKVStoreOptions{MaxBytes: 10})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Set("a", []byte("aaaa")))
+	assert.NoError(t, s.Set("b", []byte("bbbb")))
+	assert.True(t, hasValue(remote, "a", []byte("aaaa"))())
+	assert.True(t, hasValue(cache, "a", []byte("aaaa"))())
+
+	// "a" is used more recently than "b", so "b" makes room for "c".
+	_, err = s.Get("a", false)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set("c", []byte("cccc")))
+	assert.True(t, hasValue(cache, "a", []byte("aaaa"))())
+	assert.False(t, hasValue(cache, "b", []byte("bbbb"))())
+
+	// Cached values are read without the remote store.
+	remote.SetDown(true)
+	assert.True(t, hasValue(s, "c", []byte("cccc"))())
+	_, err = s.Get("b", false)
+	assert.Error(t, err)
+	assert.Error(t, s.Set("d", []byte("dddd")))
+
+	remote.SetDown(false)
+	assert.True(t, hasValue(s, "b", []byte("bbbb"))())
+	assert.True(t, hasValue(cache, "b", []byte("bbbb"))())
+
+	assert.NoError(t, s.Delete("a"))
+	_, err = s.Get("a", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+	_, err = remote.Get("a", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+
+	// A conflict drops the cached value, which someone else changed.
+	assert.NoError(t, remote.Set("b", []byte("BBBB")))
+	assert.Equal(t, gobuddyfs.ErrConflict, s.CompareAndSet("b", []byte("bbbb"), []byte("x")))
+	assert.True(t, hasValue(s, "b", []byte("BBBB"))())
+
+	assert.NoError(t, s.Close())
+}
+
+func TestTieredWriteBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiered")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := gobuddyfs.NewMemStore()
+	remote := NewFlakyKVStore()
+	assert.NoError(t, remote.Set("old", []byte("old")))
+	opts := gobuddyfs.TieredKVStoreOptions{MaxBytes: 1 << 20, WriteBack: true,
+		FlushInterval: 10 * time.Millisecond, StatePath: filepath.Join(dir, "state")}
+
+	// Writes complete while the remote store is unreachable.
+	remote.SetDown(true)
+	s, err := gobuddyfs.NewTieredKVStore(cache, remote, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set("a", []byte("a")))
+	assert.NoError(t, s.Delete("old"))
+	assert.True(t, hasValue(s, "a", []byte("a"))())
+	_, err = s.Get("old", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+	assert.Error(t, s.Sync())
+	assert.NoError(t, s.Close())
+
+	// They are still pending after a restart, and reach the remote store
+	// once it is back.
+	s, err = gobuddyfs.NewTieredKVStore(cache, remote, opts)
+	assert.NoError(t, err)
+	assert.True(t, hasValue(s, "a", []byte("a"))())
+
+	remote.SetDown(false)
+	assert.Eventually(t, hasValue(remote, "a", []byte("a")), time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		_, err := remote.Get("old", false)
+		return err == gobuddyfs.ErrNotFound
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, s.Set("b", []byte("b")))
+	assert.NoError(t, s.Sync())
+	assert.True(t, hasValue(remote, "b", []byte("b"))())
+	assert.NoError(t, s.Close())
+
+	// Without state, whatever the cache holds is not trusted.
+	assert.NoError(t, remote.Set("b", []byte("B")))
+	opts.StatePath = ""
+	s, err = gobuddyfs.NewTieredKVStore(cache, remote, opts)
+	assert.NoError(t, err)
+	assert.True(t, hasValue(s, "b", []byte("B"))())
+	assert.NoError(t, s.Close())
+}
+
+// Writes survive a crash which leaves the state as it was when they completed,
+// and values cached after the state was saved don't take up space forever.
+func TestTieredWriteBackCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiered")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := gobuddyfs.NewMemStore()
+	remote := gobuddyfs.NewMemStore()
+	assert.NoError(t, remote.Set("clean", []byte("old")))
+	assert.NoError(t, remote.Set("gone", []byte("gone")))
+	assert.NoError(t, remote.Set("read", []byte("read")))
+	opts := gobuddyfs.TieredKVStoreOptions{MaxBytes: 1 << 20, WriteBack: true,
+		FlushInterval: time.Hour, StatePath: filepath.Join(dir, "state")}
+
+	s, err := gobuddyfs.NewTieredKVStore(cache, remote, opts)
+	assert.NoError(t, err)
+	assert.True(t, hasValue(s, "clean", []byte("old"))())
+	assert.NoError(t, s.Sync())
+
+	assert.NoError(t, s.Set("clean", []byte("new")))
+	assert.NoError(t, s.Set("fresh", []byte("fresh")))
+	assert.NoError(t, s.Delete("gone"))
+	assert.True(t, hasValue(s, "read", []byte("read"))())
+
+	// Another store picks up the cache and state as they are, as it would
+	// after the process died.
+	s, err = gobuddyfs.NewTieredKVStore(cache, remote, opts)
+	assert.NoError(t, err)
+	assert.True(t, hasValue(s, "clean", []byte("new"))())
+	assert.True(t, hasValue(s, "fresh", []byte("fresh"))())
+	_, err = s.Get("gone", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+	_, err = cache.Get("read", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+
+	assert.NoError(t, s.Sync())
+	assert.True(t, hasValue(remote, "clean", []byte("new"))())
+	assert.True(t, hasValue(remote, "fresh", []byte("fresh"))())
+	_, err = remote.Get("gone", false)
+	assert.Equal(t, gobuddyfs.ErrNotFound, err)
+	assert.NoError(t, s.Close())
+}
+
+// A read stuck on the cache doesn't hold up reads of other keys.
+func TestTieredConcurrentReads(t *testing.T) {
+	cache := &BlockingKVStore{MemStore: gobuddyfs.NewMemStore(), key: "slow",
+		release: make(chan struct{})}
+	s, err := gobuddyfs.NewTieredKVStore(cache, gobuddyfs.NewMemStore(),
+		gobuddyfs.TieredKVStoreOptions{MaxBytes: 1 << 20})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set("slow", []byte("slow")))
+	assert.NoError(t, s.Set("fast", []byte("fast")))
+
+	slow := make(chan []byte)
+	go func() {
+		v, _ := s.Get("slow", false)
+		slow <- v
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	fast := make(chan []byte)
+	go func() {
+		v, _ := s.Get("fast", false)
+		fast <- v
+	}()
+	select {
+	case v := <-fast:
+		assert.Equal(t, []byte("fast"), v)
+	case <-time.After(time.Second):
+		t.Error("read of a cached key waited for another one")
+	}
+
+	close(cache.release)
+	assert.Equal(t, []byte("slow"), <-slow)
+	if t.Failed() {
+		<-fast
+	}
+}
+
+// A write-through write which may have reached the remote store leaves no
+// older value in the cache.
+func TestTieredWriteThroughInvalidates(t *testing.T) {
+	remote := UnacknowledgedKVStore{gobuddyfs.NewMemStore()}
+	remote.MemStore.Set("Foo", []byte("old"))
+	s, err := gobuddyfs.NewTieredKVStore(gobuddyfs.NewMemStore(), remote,
+		gobuddyfs.TieredKVStoreOptions{MaxBytes: 1 << 20})
+	assert.NoError(t, err)
+	assert.True(t, hasValue(s, "Foo", []byte("old"))())
+
+	assert.Error(t, s.Set("Foo", []byte("new")))
+	assert.True(t, hasValue(s, "Foo", []byte("new"))())
+}
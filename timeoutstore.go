@@ -0,0 +1,83 @@
+package gobuddyfs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TimeoutKVStore bounds every operation on the wrapped store by a fixed
+// timeout, on top of any deadline already carried by the caller's context.
+// A zero timeout leaves that kind of operation unbounded.
+type TimeoutKVStore struct {
+	store      KVStore
+	getTimeout time.Duration
+	setTimeout time.Duration
+
+	// Implements: KVStore, ContextKVStore, DeletableKVStore, ScannableKVStore,
+	// CASKVStore, SyncableKVStore
+}
+
+func NewTimeoutKVStore(store KVStore, getTimeout, setTimeout time.Duration) *TimeoutKVStore {
+	return &TimeoutKVStore{store: store, getTimeout: getTimeout, setTimeout: setTimeout}
+}
+
+// withTimeout bounds ctx by timeout. Without a timeout, ctx is returned as it
+// is, so that operations under a context which is never done run directly.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (self *TimeoutKVStore) Get(key string, retry bool) ([]byte, error) {
+	return self.GetContext(context.Background(), key, retry)
+}
+
+func (self *TimeoutKVStore) Set(key string, value []byte) error {
+	return self.SetContext(context.Background(), key, value)
+}
+
+func (self *TimeoutKVStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, self.getTimeout)
+	defer cancel()
+	return kvGet(ctx, self.store, key, retry)
+}
+
+func (self *TimeoutKVStore) SetContext(ctx context.Context, key string, value []byte) error {
+	ctx, cancel := withTimeout(ctx, self.setTimeout)
+	defer cancel()
+	return kvSet(ctx, self.store, key, value)
+}
+
+func (self *TimeoutKVStore) Delete(key string) error {
+	ctx, cancel := withTimeout(context.Background(), self.setTimeout)
+	defer cancel()
+	return kvDelete(ctx, self.store, key)
+}
+
+func (self *TimeoutKVStore) CompareAndSet(key string, expected, value []byte) error {
+	ctx, cancel := withTimeout(context.Background(), self.setTimeout)
+	defer cancel()
+	return kvCompareAndSet(ctx, self.store, key, expected, value)
+}
+
+// Scan is not bounded by a timeout, since its duration depends on the number
+// of keys visited.
+func (self *TimeoutKVStore) Scan(start, end string, visit ScanFunc) error {
+	return Scan(self.store, start, end, visit)
+}
+
+func (self *TimeoutKVStore) Sync() error {
+	ctx, cancel := withTimeout(context.Background(), self.setTimeout)
+	defer cancel()
+	return kvSync(ctx, self.store)
+}
+
+var _ KVStore = new(TimeoutKVStore)
+var _ ContextKVStore = new(TimeoutKVStore)
+var _ DeletableKVStore = new(TimeoutKVStore)
+var _ CASKVStore = new(TimeoutKVStore)
+var _ SyncableKVStore = new(TimeoutKVStore)
+var _ ScannableKVStore = new(TimeoutKVStore)
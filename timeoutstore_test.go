@@ -0,0 +1,86 @@
+package gobuddyfs_test
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/buddyfs/gobuddyfs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// HungKVStore doesn't answer until released, like a DHT lookup stuck on an
+// unreachable peer.
+type HungKVStore struct {
+	gobuddyfs.KVStore
+	release chan struct{}
+}
+
+func NewHungKVStore() *HungKVStore {
+	return &HungKVStore{release: make(chan struct{})}
+}
+
+func (h *HungKVStore) Get(key string, retry bool) ([]byte, error) {
+	<-h.release
+	return nil, errors.New("released")
+}
+
+func (h *HungKVStore) Set(key string, value []byte) error {
+	<-h.release
+	return errors.New("released")
+}
+
+func TestTimeoutStoreGetTimesOut(t *testing.T) {
+	hung := NewHungKVStore()
+	defer close(hung.release)
+	s := gobuddyfs.NewTimeoutKVStore(hung, 10*time.Millisecond, 0)
+
+	val, err := s.Get("Foo", true)
+	assert.Nil(t, val)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestTimeoutStoreSetCancelled(t *testing.T) {
+	hung := NewHungKVStore()
+	defer close(hung.release)
+	s := gobuddyfs.NewTimeoutKVStore(hung, 0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- s.SetContext(ctx, "Foo", []byte("bar"))
+	}()
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func TestMkdirTimesOut(t *testing.T) {
+	memkv := gobuddyfs.NewMemStore()
+	bfs := gobuddyfs.NewBuddyFS(memkv)
+	root, _ := bfs.Root()
+
+	hung := NewHungKVStore()
+	defer close(hung.release)
+	root.(*gobuddyfs.FSMeta).KVS = gobuddyfs.NewTimeoutKVStore(hung, 0, 10*time.Millisecond)
+	node, err := root.(*gobuddyfs.FSMeta).Mkdir(context.TODO(), &fuse.MkdirRequest{Name: "foo"})
+	assert.Nil(t, node)
+	assert.Equal(t, fuse.Errno(syscall.ETIMEDOUT), err)
+}
+
+// A store operation without a timeout runs on the caller's goroutine.
+func TestTimeoutStoreZeroTimeout(t *testing.T) {
+	s := gobuddyfs.NewTimeoutKVStore(gobuddyfs.NewMemStore(), 0, 0)
+	assert.NoError(t, s.Set("Foo", []byte("bar")))
+
+	before := runtime.NumGoroutine()
+	allocs := testing.AllocsPerRun(100, func() {
+		s.Get("Foo", true)
+	})
+	assert.Equal(t, before, runtime.NumGoroutine())
+	assert.True(t, allocs <= 1, "%v allocations per Get", allocs)
+}
@@ -0,0 +1,276 @@
+package gobuddyfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/context"
+)
+
+// VOLUME_KEYS_KEY marks a store holding volumes created with BuddyFS.HashKeys
+// set, so that missing or wrong key material is told apart from a new volume.
+// Each of the volumes is marked under a key derived from its secret as block
+// keys are, so that volumes of different secrets can share a store. Older
+// volumes instead kept a check value of their secret here.
+const VOLUME_KEYS_KEY = "VOLUME_KEYS"
+
+// volumeMark is the value of the keys marking volumes with hashed keys.
+var volumeMark = []byte("hashed")
+
+// ErrNoKeyMaterial is returned for a volume with hashed keys, or one to be
+// created with them, when BuddyFS.KeyMaterial is not set.
+var ErrNoKeyMaterial = errors.New("hashed keys need key material")
+
+// ErrDedupKeys is returned when creating a volume with content-addressed
+// blocks and key material, but without hashed keys. The keys of its blocks
+// would be the plain hashes of their contents, which tell anyone able to list
+// the store whether it holds a given block.
+var ErrDedupKeys = errors.New("dedup with key material needs hashed keys")
+
+// The root key of older volumes holds just the varint of the root block's id.
+// Ids are never negative, so the first byte of such a value is always even
+// and can't be mistaken for the version byte of a superblock.
+const superblockVersion = 1
+
+// Compression methods a volume can be created with.
+const (
+	CompressNone  = ""
+	CompressFlate = "flate"
+)
+
+// Every block of a volume with a superblock starts with a header byte, which
+// says how the rest of it is encoded. If blockChecksum is set, it is followed
+// by a big-endian CRC32C of the block's decoded contents.
+const (
+	blockRaw      = 0
+	blockFlate    = 1
+	blockChecksum = 0x80
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var errChecksum = errors.New("checksum mismatch")
+
+// superblock is stored under the root key, as the version byte followed by
+// JSON. It records how the volume is laid out.
+type superblock struct {
+	Root        int64
+	Compression string `json:",omitempty"`
+	Dedup       bool   `json:",omitempty"`
+	Chunking    bool   `json:",omitempty"`
+	// The first block id a CounterBlockGenerator hasn't reserved, or zero if
+	// the volume allocates ids at random.
+	NextId int64 `json:",omitempty"`
+
+	// Zero for an older volume, whose blocks have no header.
+	version byte
+}
+
+func (sb *superblock) encode() ([]byte, error) {
+	data, err := json.Marshal(sb)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{superblockVersion}, data...), nil
+}
+
+func decodeSuperblock(value []byte) (*superblock, error) {
+	if len(value) > 0 && value[0] == superblockVersion {
+		sb := &superblock{version: superblockVersion}
+		if err := json.Unmarshal(value[1:], sb); err != nil {
+			return nil, err
+		}
+		if sb.Compression != CompressNone && sb.Compression != CompressFlate {
+			return nil, errors.New("unknown compression " + strconv.Quote(sb.Compression))
+		}
+		return sb, nil
+	}
+
+	id, n := binary.Varint(value)
+	if n <= 0 {
+		return nil, errors.New("invalid root key")
+	}
+	return &superblock{Root: id}, nil
+}
+
+// volumeStore is the store of a volume which differs from the original layout,
+// and tells the blocks how to store themselves. It passes every operation on
+// to the underlying store unchanged.
+//
+// With a secret, blocks are stored under an HMAC of their id keyed with it, so
+// that the store's keys reveal neither which block is the root nor how the
+// blocks are numbered. The secret is derived from key material held by the
+// user, and is never stored.
+type volumeStore struct {
+	store  KVStore
+	secret []byte
+	sb     superblock
+
+	// Implements: KVStore, ContextKVStore, DeletableKVStore, ScannableKVStore,
+	// CASKVStore, SyncableKVStore
+}
+
+func (self *volumeStore) key(name string) string {
+	if self.secret == nil {
+		return name
+	}
+	mac := hmac.New(sha256.New, self.secret)
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// volumeSecret derives the secret which the keys of a volume's blocks are
+// hashed with from material.
+func volumeSecret(material []byte) ([]byte, error) {
+	secret := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, material, nil, []byte("buddyfs volume keys")), secret)
+	return secret, err
+}
+
+// blockKey returns the key the block with the given id is stored under.
+func blockKey(store KVStore, id int64) string {
+	name := strconv.FormatInt(id, 10)
+	if vs, ok := store.(*volumeStore); ok {
+		return vs.key(name)
+	}
+	return name
+}
+
+// rootBlockKey returns the key which holds the superblock.
+func rootBlockKey(store KVStore) string {
+	if vs, ok := store.(*volumeStore); ok {
+		return vs.key(ROOT_BLOCK_KEY)
+	}
+	return ROOT_BLOCK_KEY
+}
+
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+// encodeBlock returns what is stored for a block whose contents are data.
+// Compressed blocks which don't get smaller are stored raw.
+func encodeBlock(store KVStore, data []byte) ([]byte, error) {
+	vs, ok := store.(*volumeStore)
+	if !ok || vs.sb.version == 0 {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data) + 5)
+	buf.WriteByte(blockRaw | blockChecksum)
+	binary.Write(&buf, binary.BigEndian, crc32.Checksum(data, castagnoli))
+
+	if vs.sb.Compression == CompressFlate {
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(&buf)
+		_, err := w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		flateWriters.Put(w)
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() < len(data)+5 {
+			encoded := buf.Bytes()
+			encoded[0] = blockFlate | blockChecksum
+			return encoded, nil
+		}
+		buf.Truncate(5)
+	}
+
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// decodeBlock returns the contents of a block from what is stored, checking
+// them against the block's checksum.
+func decodeBlock(store KVStore, encoded []byte) ([]byte, error) {
+	vs, ok := store.(*volumeStore)
+	if !ok || vs.sb.version == 0 {
+		return encoded, nil
+	}
+
+	if len(encoded) == 0 {
+		return nil, errors.New("missing block header")
+	}
+	header, payload := encoded[0], encoded[1:]
+
+	var sum uint32
+	if header&blockChecksum != 0 {
+		if len(payload) < 4 {
+			return nil, errChecksum
+		}
+		sum = binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+	}
+
+	var data []byte
+	var err error
+	switch header &^ blockChecksum {
+	case blockRaw:
+		data = payload
+	case blockFlate:
+		data, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+	default:
+		err = errors.New("unknown block encoding " + strconv.Itoa(int(header)))
+	}
+
+	if err == nil && header&blockChecksum != 0 && crc32.Checksum(data, castagnoli) != sum {
+		err = errChecksum
+	}
+	return data, err
+}
+
+func (self *volumeStore) Get(key string, retry bool) ([]byte, error) {
+	return self.store.Get(key, retry)
+}
+
+func (self *volumeStore) Set(key string, value []byte) error {
+	return self.store.Set(key, value)
+}
+
+func (self *volumeStore) GetContext(ctx context.Context, key string, retry bool) ([]byte, error) {
+	return kvGet(ctx, self.store, key, retry)
+}
+
+func (self *volumeStore) SetContext(ctx context.Context, key string, value []byte) error {
+	return kvSet(ctx, self.store, key, value)
+}
+
+func (self *volumeStore) Delete(key string) error {
+	return kvDelete(context.Background(), self.store, key)
+}
+
+func (self *volumeStore) CompareAndSet(key string, expected, value []byte) error {
+	return kvCompareAndSet(context.Background(), self.store, key, expected, value)
+}
+
+func (self *volumeStore) Scan(start, end string, visit ScanFunc) error {
+	return Scan(self.store, start, end, visit)
+}
+
+func (self *volumeStore) Sync() error {
+	return kvSync(context.Background(), self.store)
+}
+
+var _ KVStore = new(volumeStore)
+var _ ContextKVStore = new(volumeStore)
+var _ DeletableKVStore = new(volumeStore)
+var _ CASKVStore = new(volumeStore)
+var _ SyncableKVStore = new(volumeStore)
+var _ ScannableKVStore = new(volumeStore)